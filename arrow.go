@@ -0,0 +1,1062 @@
+package ceftools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Arrow IPC constants, from the FlatBuffers schemas of the Arrow format (Schema.fbs, Message.fbs
+// and File.fbs)
+const (
+	arrowVersion = 4 // MetadataVersion V5
+
+	// Message header types
+	arrowSchema          = 1
+	arrowDictionaryBatch = 2
+	arrowRecordBatch     = 3
+
+	// Field types (the members of the Type union that can be read)
+	arrowInt         = 2
+	arrowFloat       = 3
+	arrowBinary      = 4
+	arrowUtf8        = 5
+	arrowBool        = 6
+	arrowLargeBinary = 19
+	arrowLargeUtf8   = 20
+
+	// Body compression codecs
+	arrowLz4  = 0
+	arrowZstd = 1
+)
+
+var arrowMagic = []byte("ARROW1")
+
+// arrowColumn is a column written by WriteArrow: strings, float32 values (with NaN written
+// as null) or int32 positions
+type arrowColumn struct {
+	name     string
+	strings  []string
+	values   []float32
+	ints     []int32
+	large    bool // Use 64-bit string offsets (for more than 2 GB of strings)
+	metadata [][2]string
+}
+
+// WriteArrow writes an Arrow IPC file (also known as Feather version 2), which can be read by
+// pyarrow, pandas (read_feather), R (arrow::read_feather) and the like, holding a single record
+// batch without compression. In the wide layout, there is one row for each row of the main
+// matrix: the row attributes are string columns, followed by one float32 column for each
+// column of the main matrix, named by the first column attribute (or numbered, if there are
+// none), with all the column attributes in the metadata of the column. In the long layout,
+// there is one row for each non-zero value (like 'cef export --format tsv --long'), giving
+// the row attributes, the column attributes and the float32 column 'Value', followed by the
+// int32 columns 'cef.row_index' and 'cef.column_index' (the positions of the row and column,
+// counting from zero, since the attribute values need not be unique). Missing values are
+// written as nulls. The headers (as JSON name-value pairs), the layout and the names of
+// the attributes are kept in the schema metadata, as 'cef.headers', 'cef.layout',
+// 'cef.row_attributes' and 'cef.column_attributes'. In the long layout, the values of the
+// attributes are also kept, as 'cef.row_keys' and 'cef.column_keys' (a list of the values
+// of each attribute), so that all rows and columns can be restored in order.
+func WriteArrow(cef *Cef, f io.Writer, long bool, transposed bool) error {
+	if transposed {
+		cef = cef.Transpose()
+	}
+	columns := make([]*arrowColumn, 0)
+	length := cef.Rows
+	layout := "wide"
+	if long {
+		if len(cef.RowAttributes) == 0 || len(cef.ColumnAttributes) == 0 {
+			return errors.New("The long layout needs at least one row attribute and one column attribute (to tell the rows and columns apart)")
+		}
+		layout = "long"
+		rows := make([]int32, 0)
+		cols := make([]int32, 0)
+		values := make([]float32, 0)
+		for i := 0; i < cef.Rows; i++ {
+			js, vals := cef.nonZeros(i)
+			for k, j := range js {
+				rows = append(rows, int32(i))
+				cols = append(cols, j)
+				values = append(values, vals[k])
+			}
+		}
+		length = len(values)
+		pick := func(attr Attribute, indexes []int32) *arrowColumn {
+			col := &arrowColumn{name: attr.Name, strings: make([]string, len(indexes))}
+			for k, ix := range indexes {
+				col.strings[k] = attr.Values[ix]
+			}
+			return col
+		}
+		for _, attr := range cef.RowAttributes {
+			columns = append(columns, pick(attr, rows))
+		}
+		for _, attr := range cef.ColumnAttributes {
+			columns = append(columns, pick(attr, cols))
+		}
+		columns = append(columns, &arrowColumn{name: "Value", values: values})
+		columns = append(columns, &arrowColumn{name: "cef.row_index", ints: rows}, &arrowColumn{name: "cef.column_index", ints: cols})
+	} else {
+		for _, attr := range cef.RowAttributes {
+			columns = append(columns, &arrowColumn{name: attr.Name, strings: attr.Values})
+		}
+		values := make([][]float32, cef.Columns)
+		for j := 0; j < cef.Columns; j++ {
+			values[j] = make([]float32, cef.Rows)
+		}
+		for i := 0; i < cef.Rows; i++ {
+			for j, v := range cef.GetRow(i) {
+				values[j][i] = v
+			}
+		}
+		for j := 0; j < cef.Columns; j++ {
+			col := &arrowColumn{name: strconv.Itoa(j + 1), values: values[j]}
+			if len(cef.ColumnAttributes) > 0 {
+				col.name = cef.ColumnAttributes[0].Values[j]
+			}
+			for _, attr := range cef.ColumnAttributes {
+				col.metadata = append(col.metadata, [2]string{attr.Name, attr.Values[j]})
+			}
+			columns = append(columns, col)
+		}
+	}
+	for _, col := range columns {
+		size := 0
+		for _, s := range col.strings {
+			size += len(s)
+		}
+		col.large = size > math.MaxInt32
+	}
+
+	// The schema metadata
+	headers := make([][2]string, 0)
+	for _, hdr := range withHistory(withChecksum(cef.Headers, "")) {
+		headers = append(headers, [2]string{hdr.Name, hdr.Value})
+	}
+	rowNames := make([]string, 0)
+	for _, attr := range cef.RowAttributes {
+		rowNames = append(rowNames, attr.Name)
+	}
+	colNames := make([]string, 0)
+	for _, attr := range cef.ColumnAttributes {
+		colNames = append(colNames, attr.Name)
+	}
+	metadata := [][2]string{
+		{"cef.layout", layout},
+		{"cef.headers", arrowJSON(headers)},
+		{"cef.row_attributes", arrowJSON(rowNames)},
+		{"cef.column_attributes", arrowJSON(colNames)},
+	}
+	if long {
+		keys := func(attrs []Attribute) string {
+			values := make([][]string, len(attrs))
+			for a, attr := range attrs {
+				values[a] = append(make([]string, 0, len(attr.Values)), attr.Values...)
+			}
+			return arrowJSON(values)
+		}
+		metadata = append(metadata, [2]string{"cef.row_keys", keys(cef.RowAttributes)}, [2]string{"cef.column_keys", keys(cef.ColumnAttributes)})
+	}
+
+	body := new(arrowBody)
+	for _, col := range columns {
+		body.add(col)
+	}
+	schema := arrowMessage(arrowSchema, 0, func(b *fbBuilder) int {
+		return arrowSchemaTable(b, columns, metadata)
+	})
+	batch := arrowMessage(arrowRecordBatch, len(body.data), func(b *fbBuilder) int {
+		nodes := b.createStructs(body.nodes, 16)
+		buffers := b.createStructs(body.buffers, 16)
+		b.startTable(3)
+		b.addUint64(0, uint64(length))
+		b.addOffset(1, nodes)
+		b.addOffset(2, buffers)
+		return b.endTable()
+	})
+
+	// The magic number (padded to 8 bytes), the messages and the end of stream marker
+	w := bufio.NewWriter(f)
+	w.Write(arrowMagic)
+	w.Write([]byte{0, 0})
+	offset := 8 + writeArrowMessage(w, schema, nil)
+	batchLength := writeArrowMessage(w, batch, body.data)
+	w.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0})
+
+	// The footer, which repeats the schema and locates the record batch
+	b := newFbBuilder()
+	footerSchema := arrowSchemaTable(b, columns, metadata)
+	dictionaries := b.createStructs(nil, 24)
+	batches := b.createStructs([][]int64{{int64(offset), int64(batchLength), int64(len(body.data))}}, 24)
+	b.startTable(4)
+	b.addOffset(1, footerSchema)
+	b.addOffset(2, dictionaries)
+	b.addOffset(3, batches)
+	b.addUint16(0, arrowVersion)
+	footer := b.finish(b.endTable())
+	w.Write(footer)
+	w.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(footer))))
+	w.Write(arrowMagic)
+	return w.Flush()
+}
+
+// arrowJSON encodes a value of the schema metadata
+func arrowJSON(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// arrowBody collects the buffers of a record batch, each padded to 8 bytes
+type arrowBody struct {
+	data    []byte
+	nodes   [][]int64 // The length and null count of each column
+	buffers [][]int64 // The offset and length of each buffer
+}
+
+func (body *arrowBody) add(col *arrowColumn) {
+	if col.ints != nil {
+		// No validity bitmap, and the values
+		body.nodes = append(body.nodes, []int64{int64(len(col.ints)), 0})
+		body.end(len(body.data))
+		start := len(body.data)
+		for _, v := range col.ints {
+			body.data = binary.LittleEndian.AppendUint32(body.data, uint32(v))
+		}
+		body.end(start)
+		return
+	}
+	if col.values == nil {
+		// No validity bitmap, the offsets and the UTF-8 data
+		body.nodes = append(body.nodes, []int64{int64(len(col.strings)), 0})
+		body.end(len(body.data))
+		start := len(body.data)
+		size := 0
+		for k := 0; k <= len(col.strings); k++ {
+			if col.large {
+				body.data = binary.LittleEndian.AppendUint64(body.data, uint64(size))
+			} else {
+				body.data = binary.LittleEndian.AppendUint32(body.data, uint32(size))
+			}
+			if k < len(col.strings) {
+				size += len(col.strings[k])
+			}
+		}
+		body.end(start)
+		start = len(body.data)
+		for _, s := range col.strings {
+			body.data = append(body.data, s...)
+		}
+		body.end(start)
+		return
+	}
+
+	// The validity bitmap (if there are nulls), and the values
+	nulls := 0
+	for _, v := range col.values {
+		if v != v {
+			nulls++
+		}
+	}
+	body.nodes = append(body.nodes, []int64{int64(len(col.values)), int64(nulls)})
+	start := len(body.data)
+	if nulls > 0 {
+		bitmap := make([]byte, (len(col.values)+7)/8)
+		for i, v := range col.values {
+			if v == v {
+				bitmap[i/8] |= 1 << (i % 8)
+			}
+		}
+		body.data = append(body.data, bitmap...)
+	}
+	body.end(start)
+	start = len(body.data)
+	for _, v := range col.values {
+		body.data = binary.LittleEndian.AppendUint32(body.data, math.Float32bits(v))
+	}
+	body.end(start)
+}
+
+// end records the buffer that started at the given offset, and pads it
+func (body *arrowBody) end(start int) {
+	body.buffers = append(body.buffers, []int64{int64(start), int64(len(body.data) - start)})
+	for len(body.data)%8 != 0 {
+		body.data = append(body.data, 0)
+	}
+}
+
+// arrowSchemaTable builds a Schema table
+func arrowSchemaTable(b *fbBuilder, columns []*arrowColumn, metadata [][2]string) int {
+	fields := make([]int, len(columns))
+	for k, col := range columns {
+		name := b.createString(col.name)
+		children := b.createOffsets(nil)
+		meta := 0
+		if len(col.metadata) > 0 {
+			meta = arrowMetadataVector(b, col.metadata)
+		}
+		typeID := uint8(arrowUtf8)
+		if col.large {
+			typeID = arrowLargeUtf8
+		}
+		b.startTable(2)
+		if col.values != nil {
+			typeID = arrowFloat
+			b.addUint16(0, 1) // Single precision
+		}
+		if col.ints != nil {
+			typeID = arrowInt
+			b.addUint32(0, 32)
+			b.addUint8(1, 1) // Signed
+		}
+		typ := b.endTable()
+
+		b.startTable(7)
+		b.addOffset(0, name)
+		b.addOffset(3, typ)
+		b.addOffset(5, children)
+		if meta != 0 {
+			b.addOffset(6, meta)
+		}
+		if col.values != nil {
+			b.addUint8(1, 1) // Nullable
+		}
+		b.addUint8(2, typeID)
+		fields[k] = b.endTable()
+	}
+	vector := b.createOffsets(fields)
+	meta := arrowMetadataVector(b, metadata)
+	b.startTable(3)
+	b.addOffset(1, vector)
+	b.addOffset(2, meta)
+	return b.endTable()
+}
+
+// arrowMetadataVector builds a vector of KeyValue tables
+func arrowMetadataVector(b *fbBuilder, pairs [][2]string) int {
+	refs := make([]int, len(pairs))
+	for k, pair := range pairs {
+		key := b.createString(pair[0])
+		value := b.createString(pair[1])
+		b.startTable(2)
+		b.addOffset(0, key)
+		b.addOffset(1, value)
+		refs[k] = b.endTable()
+	}
+	return b.createOffsets(refs)
+}
+
+// arrowMessage builds the metadata of a message, with the header built by the given function
+func arrowMessage(headerType uint8, bodyLength int, header func(b *fbBuilder) int) []byte {
+	b := newFbBuilder()
+	ref := header(b)
+	b.startTable(4)
+	b.addUint64(3, uint64(bodyLength))
+	b.addOffset(2, ref)
+	b.addUint16(0, arrowVersion)
+	b.addUint8(1, headerType)
+	return b.finish(b.endTable())
+}
+
+// writeArrowMessage writes an encapsulated message, and returns the length of its metadata
+// (including the prefix and the padding)
+func writeArrowMessage(w *bufio.Writer, meta []byte, body []byte) int {
+	pad := -len(meta) & 7
+	prefix := make([]byte, 8)
+	binary.LittleEndian.PutUint32(prefix, 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)+pad))
+	w.Write(prefix)
+	w.Write(meta)
+	w.Write(make([]byte, pad))
+	w.Write(body)
+	return 8 + len(meta) + pad
+}
+
+// arrowField is a field of the schema of an Arrow file being read
+type arrowField struct {
+	name     string
+	typ      uint8 // The type ID (of the values, if dictionary-encoded)
+	bits     int   // The width of integer and floating point types
+	signed   bool
+	dict     int64 // The ID of the dictionary, or -1 if not dictionary-encoded
+	index    int   // The width of the (signed or unsigned) dictionary indexes
+	unsigned bool
+	metadata map[string]string
+}
+
+// numeric reports whether the field holds numbers (integers, floating point numbers or booleans)
+func (field *arrowField) numeric() bool {
+	return field.typ == arrowInt || field.typ == arrowFloat || field.typ == arrowBool
+}
+
+// arrowData is the data of a field: strings for string and binary fields, and numbers
+// otherwise (with nulls as NaN)
+type arrowData struct {
+	strings []string
+	numbers []float64
+}
+
+func (d *arrowData) append(other *arrowData) {
+	d.strings = append(d.strings, other.strings...)
+	d.numbers = append(d.numbers, other.numbers...)
+}
+
+// text returns the data as strings, with nulls as empty strings
+func (d *arrowData) text(field *arrowField) []string {
+	if d.strings != nil || d.numbers == nil {
+		return d.strings
+	}
+	result := make([]string, len(d.numbers))
+	for i, v := range d.numbers {
+		switch {
+		case v != v:
+		case field.typ == arrowFloat:
+			result[i] = strconv.FormatFloat(v, 'g', -1, field.bits)
+		case field.typ == arrowBool:
+			result[i] = strconv.FormatBool(v != 0)
+		default:
+			result[i] = strconv.FormatInt(int64(v), 10)
+		}
+	}
+	return result
+}
+
+// ReadArrow reads an Arrow IPC file (also known as Feather version 2) or stream, such as
+// written by WriteArrow, pyarrow or pandas (to_feather). If the schema metadata written by
+// WriteArrow is present, the layout, attributes and headers are restored. Otherwise, the file
+// is read in the wide layout: string fields become row attributes, and numeric fields become
+// columns of the main matrix, with the field names as the column attribute 'Name'. The long
+// layout can only be read with the metadata; the entries are placed by 'cef.row_index' and
+// 'cef.column_index' if present, and otherwise by their attribute values (so rows or columns
+// with the same values are merged). Without 'cef.row_keys' and 'cef.column_keys', the rows
+// and columns are ordered by first appearance, and those that had no non-zero values are lost. Fields can be strings (also dictionary-encoded, as for categoricals),
+// integers, floating point numbers or booleans, and the buffers can be compressed with LZ4
+// (the default of Feather files) or zstd. Multiple record batches are concatenated.
+func ReadArrow(f io.Reader, transposed bool) (result *Cef, err error) {
+	r, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	defer recoverFb(&err, "Arrow file")
+
+	// A file holds a stream between the magic number and the footer
+	pos, end := 0, len(data)
+	if bytes.HasPrefix(data, arrowMagic) {
+		pos = 8
+		if len(data) >= 18 && bytes.HasSuffix(data, arrowMagic) {
+			footer := int(int32(binary.LittleEndian.Uint32(data[len(data)-10:])))
+			if footer >= 0 && footer <= len(data)-18 {
+				end = len(data) - 10 - footer
+			}
+		}
+	}
+
+	var fields []*arrowField
+	var metadata map[string]string
+	var columns []*arrowData
+	length := 0
+	dictionaries := make(map[int64]*arrowData)
+	for pos < end {
+		meta, body, next := readArrowMessage(data, pos, end)
+		if meta == nil {
+			break
+		}
+		pos = next
+		msg := fbRoot(meta)
+		if version := msg.uint16(0, 0); version < 3 {
+			return nil, errors.New(fmt.Sprintf("Unsupported Arrow metadata version V%v (expected V4 or later)", version+1))
+		}
+		header, ok := msg.table(2)
+		if !ok {
+			panic(fbError("message without a header"))
+		}
+		switch msg.uint8(1, 0) {
+		case arrowSchema:
+			if fields != nil {
+				return nil, errors.New("Invalid Arrow file (more than one schema)")
+			}
+			if fields, metadata, err = readArrowSchema(header); err != nil {
+				return nil, err
+			}
+			columns = make([]*arrowData, len(fields))
+			for k := range columns {
+				columns[k] = new(arrowData)
+			}
+		case arrowDictionaryBatch:
+			id := header.int64(0, 0)
+			var field *arrowField
+			for _, fld := range fields {
+				if fld.dict == id {
+					field = fld
+				}
+			}
+			batch, ok := header.table(1)
+			if field == nil || !ok {
+				return nil, errors.New(fmt.Sprintf("Invalid Arrow file (unexpected dictionary %v)", id))
+			}
+			values := *field
+			values.dict = -1
+			decoded, _, err := readArrowBatch(batch, body, []*arrowField{&values}, nil)
+			if err != nil {
+				return nil, err
+			}
+			if header.uint8(2, 0) != 0 && dictionaries[id] != nil {
+				dictionaries[id].append(decoded[0]) // A delta
+			} else {
+				dictionaries[id] = decoded[0]
+			}
+		case arrowRecordBatch:
+			if fields == nil {
+				return nil, errors.New("Invalid Arrow file (record batch before the schema)")
+			}
+			decoded, n, err := readArrowBatch(header, body, fields, dictionaries)
+			if err != nil {
+				return nil, err
+			}
+			for k, col := range decoded {
+				columns[k].append(col)
+			}
+			length += n
+		default:
+			return nil, errors.New("Unsupported Arrow message (only schemas, dictionaries and record batches can be read)")
+		}
+	}
+	if fields == nil {
+		return nil, errors.New("Not an Arrow file (no schema found)")
+	}
+
+	// The metadata written by WriteArrow
+	cef := new(Cef)
+	cef.Headers = make([]Header, 0)
+	cef.RowAttributes = make([]Attribute, 0)
+	cef.ColumnAttributes = make([]Attribute, 0)
+	var headers [][2]string
+	var rowNames, colNames []string
+	var rowKeys, colKeys [][]string
+	named := metadata["cef.row_attributes"] != "" && metadata["cef.column_attributes"] != ""
+	for key, v := range map[string]interface{}{"cef.headers": &headers, "cef.row_attributes": &rowNames, "cef.column_attributes": &colNames, "cef.row_keys": &rowKeys, "cef.column_keys": &colKeys} {
+		if metadata[key] != "" {
+			if err := json.Unmarshal([]byte(metadata[key]), v); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid Arrow schema metadata '%v': %v", key, err))
+			}
+		}
+	}
+	for _, hdr := range headers {
+		cef.Headers = append(cef.Headers, Header{hdr[0], hdr[1]})
+	}
+	numbers := func(k int) ([]float64, error) {
+		if columns[k].numbers == nil && length > 0 {
+			return nil, errors.New(fmt.Sprintf("The Arrow field '%v' is not numeric (so it cannot hold values of the main matrix)", fields[k].name))
+		}
+		return columns[k].numbers, nil
+	}
+
+	switch metadata["cef.layout"] {
+	case "", "wide":
+		var matrix []int // The fields that make up the main matrix
+		if named {
+			if len(rowNames) > len(fields) {
+				return nil, errors.New("Invalid Arrow schema metadata (more row attributes than fields)")
+			}
+			for k := 0; k < len(fields); k++ {
+				if k < len(rowNames) {
+					cef.RowAttributes = append(cef.RowAttributes, Attribute{fields[k].name, columns[k].text(fields[k])})
+				} else {
+					matrix = append(matrix, k)
+				}
+			}
+			for _, name := range colNames {
+				attr := Attribute{name, make([]string, len(matrix))}
+				for j, k := range matrix {
+					attr.Values[j] = fields[k].metadata[name]
+				}
+				cef.ColumnAttributes = append(cef.ColumnAttributes, attr)
+			}
+		} else {
+			names := Attribute{"Name", make([]string, 0)}
+			for k := 0; k < len(fields); k++ {
+				if !fields[k].numeric() {
+					cef.RowAttributes = append(cef.RowAttributes, Attribute{fields[k].name, columns[k].text(fields[k])})
+				} else {
+					matrix = append(matrix, k)
+					names.Values = append(names.Values, fields[k].name)
+				}
+			}
+			cef.ColumnAttributes = []Attribute{names}
+		}
+		cef.Rows = length
+		cef.Columns = len(matrix)
+		cef.Matrix = make([]float32, cef.Rows*cef.Columns)
+		for j, k := range matrix {
+			values, err := numbers(k)
+			if err != nil {
+				return nil, err
+			}
+			for i, v := range values {
+				cef.Matrix[i*cef.Columns+j] = float32(v)
+			}
+		}
+		if SparseThreshold > 0 && cef.Density() <= SparseThreshold {
+			cef.ToSparse()
+		}
+	case "long":
+		n := len(rowNames) + len(colNames) + 1 // The attributes and the values
+		positioned := named && len(fields) == n+2 && fields[n].name == "cef.row_index" && fields[n+1].name == "cef.column_index"
+		if !named || (len(fields) != n && !positioned) {
+			return nil, errors.New("Invalid Arrow schema metadata (the long layout needs a field for each row and column attribute, then the values)")
+		}
+		values, err := numbers(n - 1)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := newArrowKeys(fields[:len(rowNames)], columns[:len(rowNames)], rowKeys)
+		if err != nil {
+			return nil, err
+		}
+		cols, err := newArrowKeys(fields[len(rowNames):n-1], columns[len(rowNames):n-1], colKeys)
+		if err != nil {
+			return nil, err
+		}
+		if positioned {
+			if rowKeys == nil || colKeys == nil {
+				return nil, errors.New("Invalid Arrow schema metadata (the positions of the long layout need 'cef.row_keys' and 'cef.column_keys')")
+			}
+			if err := rows.place(fields[n], columns[n]); err != nil {
+				return nil, err
+			}
+			if err := cols.place(fields[n+1], columns[n+1]); err != nil {
+				return nil, err
+			}
+		}
+		entries := make([][]int, rows.n) // The entries of each row
+		for e := 0; e < length; e++ {
+			var i int
+			if positioned {
+				i = rows.indexes[e]
+			} else {
+				i = rows.index(e)
+				cols.index(e)
+			}
+			for len(entries) <= i {
+				entries = append(entries, make([]int, 0))
+			}
+			if values[e] != 0 {
+				entries[i] = append(entries[i], e)
+			}
+		}
+		cef.RowAttributes = rows.attrs
+		cef.ColumnAttributes = cols.attrs
+		cef.Rows = len(entries)
+		cef.Columns = cols.n
+		b := newMatrixBuilder(cef.Rows, cef.Columns, true, false)
+		for _, row := range entries {
+			sort.SliceStable(row, func(a, b int) bool { return cols.indexes[row[a]] < cols.indexes[row[b]] })
+			js := make([]int32, 0, len(row))
+			vals := make([]float32, 0, len(row))
+			for _, e := range row {
+				j := int32(cols.indexes[e])
+				if len(js) > 0 && js[len(js)-1] == j {
+					vals[len(vals)-1] = float32(values[e]) // A repeated entry replaces the earlier one
+					continue
+				}
+				js = append(js, j)
+				vals = append(vals, float32(values[e]))
+			}
+			b.appendSparseRow(js, vals)
+		}
+		b.finish(cef)
+	default:
+		return nil, errors.New("Unknown layout in the Arrow schema metadata: " + metadata["cef.layout"])
+	}
+
+	if transposed {
+		cef = cef.Transpose()
+	}
+	return cef, nil
+}
+
+// arrowKeys numbers the distinct combinations of attribute values in the long layout, in
+// the order given by the metadata (if any) and then in order of first appearance, and
+// collects their attributes
+type arrowKeys struct {
+	values  [][]string
+	keys    map[string]int
+	indexes []int // The number of each entry, once indexed
+	attrs   []Attribute
+	n       int
+}
+
+// newArrowKeys prepares to number the entries, starting with the given values of each
+// attribute (from 'cef.row_keys' or 'cef.column_keys'), if any
+func newArrowKeys(fields []*arrowField, columns []*arrowData, seed [][]string) (*arrowKeys, error) {
+	k := &arrowKeys{keys: make(map[string]int), attrs: make([]Attribute, len(fields))}
+	for f, field := range fields {
+		k.values = append(k.values, columns[f].text(field))
+		k.attrs[f] = Attribute{field.name, make([]string, 0)}
+	}
+	if seed == nil {
+		return k, nil
+	}
+	if len(seed) != len(fields) {
+		return nil, errors.New("Invalid Arrow schema metadata (the keys do not match the attributes)")
+	}
+	n := 0
+	for f := range seed {
+		if f == 0 {
+			n = len(seed[f])
+		} else if len(seed[f]) != n {
+			return nil, errors.New("Invalid Arrow schema metadata (the keys do not match the attributes)")
+		}
+	}
+	parts := make([]string, len(fields))
+	for ix := 0; ix < n; ix++ {
+		for f := range seed {
+			parts[f] = seed[f][ix]
+		}
+		k.add(parts)
+	}
+	return k, nil
+}
+
+// add numbers a row or column with the given attribute values. If they are not unique,
+// entries placed by index belong to the first one.
+func (k *arrowKeys) add(parts []string) int {
+	ix := k.n
+	k.n++
+	for f := range k.attrs {
+		k.attrs[f].Values = append(k.attrs[f].Values, parts[f])
+	}
+	key := strings.Join(parts, "\x00")
+	if _, ok := k.keys[key]; !ok {
+		k.keys[key] = ix
+	}
+	return ix
+}
+
+// place numbers the entries by the given positions, instead of by their attribute values
+func (k *arrowKeys) place(field *arrowField, column *arrowData) error {
+	if field.typ != arrowInt {
+		return errors.New(fmt.Sprintf("The Arrow field '%v' is not an integer (so it cannot hold positions)", field.name))
+	}
+	k.indexes = make([]int, len(column.numbers))
+	for e, v := range column.numbers {
+		if v != v || v < 0 || v >= float64(k.n) {
+			return errors.New(fmt.Sprintf("Invalid Arrow field '%v' (position out of range)", field.name))
+		}
+		k.indexes[e] = int(v)
+	}
+	return nil
+}
+
+// index returns the number of the given entry
+func (k *arrowKeys) index(e int) int {
+	parts := make([]string, len(k.values))
+	for f, values := range k.values {
+		parts[f] = values[e]
+	}
+	ix, ok := k.keys[strings.Join(parts, "\x00")]
+	if !ok {
+		ix = k.add(parts)
+	}
+	k.indexes = append(k.indexes, ix)
+	return ix
+}
+
+// readArrowMessage returns the metadata and body of the encapsulated message at pos, and the
+// position of the next message, or nil metadata at the end of the stream
+func readArrowMessage(data []byte, pos int, end int) ([]byte, []byte, int) {
+	if end-pos < 4 {
+		return nil, nil, end
+	}
+	size := int(int32(binary.LittleEndian.Uint32(data[pos:])))
+	pos += 4
+	if size == -1 {
+		// The continuation marker, followed by the size (older files have the size only)
+		size = int(int32(binary.LittleEndian.Uint32(data[fbIndex(data, pos, 4):])))
+		pos += 4
+	}
+	if size == 0 {
+		return nil, nil, end
+	}
+	meta := data[fbIndex(data, pos, size) : pos+size]
+	pos += size
+	bodyLength := int(fbRoot(meta).int64(3, 0))
+	body := data[fbIndex(data, pos, bodyLength) : pos+bodyLength]
+	return meta, body, pos + bodyLength
+}
+
+// readArrowSchema reads the fields and the metadata of a schema
+func readArrowSchema(schema fbTable) ([]*arrowField, map[string]string, error) {
+	if schema.uint16(0, 0) != 0 {
+		return nil, nil, errors.New("Unsupported Arrow file (big-endian data)")
+	}
+	fields := make([]*arrowField, 0)
+	for _, t := range schema.tables(1) {
+		field := &arrowField{name: t.string(0), typ: t.uint8(2, 0), dict: -1, metadata: readArrowMetadata(t, 6)}
+		unsupported := errors.New(fmt.Sprintf("Unsupported type of Arrow field '%v' (only strings, integers, floating point numbers and booleans can be read)", field.name))
+		typ, ok := t.table(3)
+		if !ok {
+			panic(fbError("field without a type"))
+		}
+		if _, n := t.vector(5); n > 0 {
+			return nil, nil, unsupported
+		}
+		switch field.typ {
+		case arrowInt:
+			field.bits = int(typ.uint32(0, 0))
+			field.signed = typ.uint8(1, 0) != 0
+		case arrowFloat:
+			field.bits = map[uint16]int{1: 32, 2: 64}[typ.uint16(0, 0)]
+		case arrowUtf8, arrowBinary, arrowLargeUtf8, arrowLargeBinary, arrowBool:
+		default:
+			return nil, nil, unsupported
+		}
+		if (field.typ == arrowInt || field.typ == arrowFloat) && field.bits == 0 {
+			return nil, nil, unsupported
+		}
+		if field.typ == arrowInt && field.bits != 8 && field.bits != 16 && field.bits != 32 && field.bits != 64 {
+			return nil, nil, unsupported
+		}
+		if encoding, ok := t.table(4); ok {
+			field.dict = encoding.int64(0, 0)
+			field.index = 32
+			if index, ok := encoding.table(1); ok {
+				field.index = int(index.uint32(0, 0))
+				field.unsigned = index.uint8(1, 0) == 0
+			}
+			if field.index != 8 && field.index != 16 && field.index != 32 && field.index != 64 {
+				return nil, nil, unsupported
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields, readArrowMetadata(schema, 2), nil
+}
+
+func readArrowMetadata(t fbTable, field int) map[string]string {
+	result := make(map[string]string)
+	for _, kv := range t.tables(field) {
+		result[kv.string(0)] = kv.string(1)
+	}
+	return result
+}
+
+// arrowBatch reads the nodes and buffers of a record batch, in order
+type arrowBatch struct {
+	body    []byte
+	nodes   [][]int64
+	buffers [][]int64
+	codec   int // The compression codec, or -1 if not compressed
+}
+
+// readArrowBatch reads the fields of a record batch, and returns them with the number of rows
+func readArrowBatch(header fbTable, body []byte, fields []*arrowField, dictionaries map[int64]*arrowData) ([]*arrowData, int, error) {
+	batch := &arrowBatch{body: body, nodes: header.structs(1, 16), buffers: header.structs(2, 16), codec: -1}
+	if compression, ok := header.table(3); ok {
+		batch.codec = int(compression.uint8(0, 0))
+		if batch.codec != arrowLz4 && batch.codec != arrowZstd {
+			return nil, 0, errors.New(fmt.Sprintf("Unsupported Arrow compression codec %v (expected LZ4 or zstd)", batch.codec))
+		}
+	}
+	length := int(header.int64(0, 0))
+	result := make([]*arrowData, len(fields))
+	for k, field := range fields {
+		data, err := batch.read(field, dictionaries)
+		if err != nil {
+			return nil, 0, errors.New(fmt.Sprintf("Invalid Arrow field '%v': %v", field.name, err))
+		}
+		if len(data.strings)+len(data.numbers) != length {
+			panic(fbError("field length does not match the record batch"))
+		}
+		result[k] = data
+	}
+	return result, length, nil
+}
+
+// buffer returns the next buffer, decompressed
+func (batch *arrowBatch) buffer() ([]byte, error) {
+	if len(batch.buffers) == 0 {
+		panic(fbError("too few buffers"))
+	}
+	offset, n := int(batch.buffers[0][0]), int(batch.buffers[0][1])
+	batch.buffers = batch.buffers[1:]
+	data := batch.body[fbIndex(batch.body, offset, n) : offset+n]
+	if batch.codec < 0 || n == 0 {
+		return data, nil
+	}
+	size := int(int64(binary.LittleEndian.Uint64(data[fbIndex(data, 0, 8):])))
+	data = data[8:]
+	if size == -1 {
+		return data, nil // Left uncompressed
+	}
+	var result []byte
+	var err error
+	if batch.codec == arrowLz4 {
+		result, err = lz4Decompress(make([]byte, 0, max(size, 0)), data)
+	} else {
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1)); err != nil {
+			return nil, err
+		}
+		result, err = io.ReadAll(zr)
+		zr.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(result) != size {
+		return nil, errors.New("Invalid compressed buffer (wrong length)")
+	}
+	return result, nil
+}
+
+// read reads the node and the buffers of a field
+func (batch *arrowBatch) read(field *arrowField, dictionaries map[int64]*arrowData) (*arrowData, error) {
+	if len(batch.nodes) == 0 {
+		panic(fbError("too few field nodes"))
+	}
+	length, nulls := int(batch.nodes[0][0]), int(batch.nodes[0][1])
+	batch.nodes = batch.nodes[1:]
+	if length < 0 {
+		panic(fbError("negative length"))
+	}
+	validity, err := batch.buffer()
+	if err != nil {
+		return nil, err
+	}
+	if nulls > 0 && len(validity) > 0 {
+		fbIndex(validity, 0, (length+7)/8)
+	} else {
+		validity = nil
+	}
+	valid := func(i int) bool {
+		return validity == nil || validity[i/8]&(1<<(i%8)) != 0
+	}
+
+	typ, bits, signed := field.typ, field.bits, field.signed
+	if field.dict >= 0 {
+		typ, bits, signed = arrowInt, field.index, !field.unsigned
+	}
+	result := new(arrowData)
+	switch typ {
+	case arrowUtf8, arrowBinary, arrowLargeUtf8, arrowLargeBinary:
+		offsets, err := batch.buffer()
+		if err != nil {
+			return nil, err
+		}
+		data, err := batch.buffer()
+		if err != nil {
+			return nil, err
+		}
+		width := 4
+		if typ == arrowLargeUtf8 || typ == arrowLargeBinary {
+			width = 8
+		}
+		fbIndex(offsets, 0, (length+1)*width)
+		offset := func(i int) int {
+			if width == 4 {
+				return int(int32(binary.LittleEndian.Uint32(offsets[i*4:])))
+			}
+			return int(int64(binary.LittleEndian.Uint64(offsets[i*8:])))
+		}
+		result.strings = make([]string, length)
+		for i := 0; i < length; i++ {
+			if valid(i) {
+				start, end := offset(i), offset(i+1)
+				result.strings[i] = string(data[fbIndex(data, start, end-start):end])
+			}
+		}
+	default:
+		values, err := batch.buffer()
+		if err != nil {
+			return nil, err
+		}
+		if typ == arrowBool {
+			fbIndex(values, 0, (length+7)/8)
+		} else {
+			fbIndex(values, 0, length*bits/8)
+		}
+		result.numbers = make([]float64, length)
+		for i := 0; i < length; i++ {
+			if !valid(i) {
+				result.numbers[i] = math.NaN()
+				continue
+			}
+			var v float64
+			switch {
+			case typ == arrowBool:
+				v = float64((values[i/8] >> (i % 8)) & 1)
+			case typ == arrowFloat && bits == 32:
+				v = float64(math.Float32frombits(binary.LittleEndian.Uint32(values[i*4:])))
+			case typ == arrowFloat:
+				v = math.Float64frombits(binary.LittleEndian.Uint64(values[i*8:]))
+			case bits == 8 && signed:
+				v = float64(int8(values[i]))
+			case bits == 8:
+				v = float64(values[i])
+			case bits == 16 && signed:
+				v = float64(int16(binary.LittleEndian.Uint16(values[i*2:])))
+			case bits == 16:
+				v = float64(binary.LittleEndian.Uint16(values[i*2:]))
+			case bits == 32 && signed:
+				v = float64(int32(binary.LittleEndian.Uint32(values[i*4:])))
+			case bits == 32:
+				v = float64(binary.LittleEndian.Uint32(values[i*4:]))
+			case signed:
+				v = float64(int64(binary.LittleEndian.Uint64(values[i*8:])))
+			default:
+				v = float64(binary.LittleEndian.Uint64(values[i*8:]))
+			}
+			result.numbers[i] = v
+		}
+	}
+	if field.dict < 0 {
+		return result, nil
+	}
+
+	// Look up the indexes in the dictionary
+	dict := dictionaries[field.dict]
+	if dict == nil {
+		return nil, errors.New(fmt.Sprintf("dictionary %v not found", field.dict))
+	}
+	indexes := result.numbers
+	result = new(arrowData)
+	if dict.strings != nil {
+		result.strings = make([]string, length)
+	} else {
+		result.numbers = make([]float64, length)
+	}
+	for i, ix := range indexes {
+		if ix != ix {
+			if result.numbers != nil {
+				result.numbers[i] = math.NaN()
+			}
+			continue
+		}
+		if ix < 0 || int(ix) >= len(dict.strings)+len(dict.numbers) {
+			return nil, errors.New("dictionary index out of range")
+		}
+		if result.strings != nil {
+			result.strings[i] = dict.strings[int(ix)]
+		} else {
+			result.numbers[i] = dict.numbers[int(ix)]
+		}
+	}
+	return result, nil
+}
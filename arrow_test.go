@@ -0,0 +1,205 @@
+package ceftools
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testCef returns a small file with headers, a duplicate row key, a row of zeros and a
+// missing value
+func testCef() *Cef {
+	return &Cef{
+		Rows:    4,
+		Columns: 3,
+		Headers: []Header{{"Tissue", "cortex"}, {"Species", "mouse"}},
+		RowAttributes: []Attribute{
+			{"Gene", []string{"Actb", "Actb", "Gapdh", "Xist"}},
+			{"Chromosome", []string{"5", "5", "6", "X"}},
+		},
+		ColumnAttributes: []Attribute{
+			{"CellID", []string{"c1", "c2", "c3"}},
+			{"Age", []string{"10", "12", "10"}},
+		},
+		Matrix: []float32{
+			1, 2, 0,
+			3, 4, float32(math.NaN()),
+			0, 0, 0,
+			0.5, 0, 7,
+		},
+	}
+}
+
+// checkSameCef fails the test unless the two files hold the same data (with missing values
+// equal to each other)
+func checkSameCef(t *testing.T, want *Cef, got *Cef) {
+	t.Helper()
+	if got.Rows != want.Rows || got.Columns != want.Columns {
+		t.Fatalf("shape %vx%v, expected %vx%v", got.Rows, got.Columns, want.Rows, want.Columns)
+	}
+	if !reflect.DeepEqual(got.Headers, want.Headers) {
+		t.Errorf("headers %v, expected %v", got.Headers, want.Headers)
+	}
+	if !sameAttributes(got.RowAttributes, want.RowAttributes) {
+		t.Errorf("row attributes %v, expected %v", got.RowAttributes, want.RowAttributes)
+	}
+	if !sameAttributes(got.ColumnAttributes, want.ColumnAttributes) {
+		t.Errorf("column attributes %v, expected %v", got.ColumnAttributes, want.ColumnAttributes)
+	}
+	for i := 0; i < want.Rows; i++ {
+		for j := 0; j < want.Columns; j++ {
+			w, g := want.Get(i, j), got.Get(i, j)
+			if w != g && (w == w || g == g) {
+				t.Errorf("value at (%v, %v) is %v, expected %v", i, j, g, w)
+			}
+		}
+	}
+}
+
+func sameAttributes(a []Attribute, b []Attribute) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || len(a[i].Values) != len(b[i].Values) {
+			return false
+		}
+		for j := range a[i].Values {
+			if a[i].Values[j] != b[i].Values[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func roundTripArrow(t *testing.T, cef *Cef, long bool) *Cef {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteArrow(cef, &buf, long, false); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ReadArrow(&buf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestArrowRoundTripWide(t *testing.T) {
+	cef := testCef()
+	checkSameCef(t, cef, roundTripArrow(t, cef, false))
+}
+
+func TestArrowRoundTripLong(t *testing.T) {
+	cef := testCef()
+	checkSameCef(t, cef, roundTripArrow(t, cef, true))
+}
+
+func TestArrowRoundTripTransposed(t *testing.T) {
+	cef := testCef()
+	var buf bytes.Buffer
+	if err := WriteArrow(cef, &buf, true, true); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ReadArrow(&buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameCef(t, cef, result)
+}
+
+func TestArrowRoundTripEmpty(t *testing.T) {
+	cef := testCef()
+	cef.Rows = 0
+	cef.Matrix = []float32{}
+	for i := range cef.RowAttributes {
+		cef.RowAttributes[i].Values = []string{}
+	}
+	checkSameCef(t, cef, roundTripArrow(t, cef, false))
+	checkSameCef(t, cef, roundTripArrow(t, cef, true))
+}
+
+func TestArrowLongNeedsAttributes(t *testing.T) {
+	cef := testCef()
+	cef.ColumnAttributes = []Attribute{}
+	if err := WriteArrow(cef, new(bytes.Buffer), true, false); err == nil {
+		t.Error("expected an error for the long layout without column attributes")
+	}
+}
+
+func TestReadArrowTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteArrow(testCef(), &buf, false, false); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for _, n := range []int{0, 6, 12, len(data) / 3, len(data) / 2} {
+		if _, err := ReadArrow(bytes.NewReader(data[:n]), false); err == nil {
+			t.Errorf("expected an error for a file truncated to %v bytes", n)
+		}
+	}
+}
+
+// The fixtures were written by the Arrow Go implementation (github.com/apache/arrow/go),
+// without the metadata written by WriteArrow, with 40 rows of the string field 'Gene'
+// ('Gene0' to 'Gene9', repeated), the int64 field 'cell1' (the row number modulo 4), the
+// nullable float64 field 'cell2' (the row number divided by 4, or null for every 7th row
+// from row 3) and the boolean field 'cell3' (true for every 3rd row)
+func TestReadArrowFixtures(t *testing.T) {
+	for _, name := range []string{"testdata/genes_lz4.feather", "testdata/genes_zstd.feather"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cef, err := ReadArrow(f, false)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if cef.Rows != 40 || cef.Columns != 3 {
+			t.Fatalf("%v: shape %vx%v, expected 40x3", name, cef.Rows, cef.Columns)
+		}
+		if want := []Attribute{{"Name", []string{"cell1", "cell2", "cell3"}}}; !reflect.DeepEqual(cef.ColumnAttributes, want) {
+			t.Errorf("%v: column attributes %v, expected %v", name, cef.ColumnAttributes, want)
+		}
+		if len(cef.RowAttributes) != 1 || cef.RowAttributes[0].Name != "Gene" {
+			t.Fatalf("%v: row attributes %v, expected Gene", name, cef.RowAttributes)
+		}
+		for i := 0; i < 40; i++ {
+			if gene := cef.RowAttributes[0].Values[i]; gene != "Gene"+string(rune('0'+i%10)) {
+				t.Errorf("%v: Gene of row %v is %v", name, i, gene)
+			}
+			if v := cef.Get(i, 0); v != float32(i%4) {
+				t.Errorf("%v: cell1 of row %v is %v", name, i, v)
+			}
+			if v := cef.Get(i, 1); (i%7 == 3 && v == v) || (i%7 != 3 && v != float32(i)/4) {
+				t.Errorf("%v: cell2 of row %v is %v", name, i, v)
+			}
+			if v, want := cef.Get(i, 2), i%3 == 0; (v == 1) != want {
+				t.Errorf("%v: cell3 of row %v is %v", name, i, v)
+			}
+		}
+	}
+}
+
+func TestLz4Decompress(t *testing.T) {
+	// Written by 'lz4 -9', with a content checksum, literals and overlapping matches
+	frame, _ := hex.DecodeString("04224d186440a7190000006c47656e6531090600123206002f206101000b506120656e64000000001f49ab5d")
+	want := "Gene1\tGene1\tGene1\tGene2\tGene2 aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa end"
+	got, err := lz4Decompress(nil, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("decompressed %q, expected %q", got, want)
+	}
+	for _, n := range []int{4, 10, len(frame) - 12} {
+		if _, err := lz4Decompress(nil, frame[:n]); err == nil {
+			t.Errorf("expected an error for a frame truncated to %v bytes", n)
+		}
+	}
+}
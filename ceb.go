@@ -0,0 +1,319 @@
+package ceftools
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// BinaryOutput makes Write emit the binary CEB format instead of text CEF
+var BinaryOutput = false
+
+// The matrix section of a CEB file starts at a multiple of this many bytes
+const cebAlignment = 8
+
+// Strings, attributes and rows are read in steps of at most this many bytes (or values),
+// so that a corrupt count or length cannot exhaust memory before the input runs out
+const cebChunk = 1 << 16
+
+type cebWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+	buf [8]byte
+}
+
+func (cw *cebWriter) write(p []byte) {
+	if cw.err != nil {
+		return
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+}
+
+func (cw *cebWriter) writeInt(v int) {
+	binary.LittleEndian.PutUint64(cw.buf[:], uint64(v))
+	cw.write(cw.buf[:8])
+}
+
+func (cw *cebWriter) writeString(s string) {
+	binary.LittleEndian.PutUint32(cw.buf[:], uint32(len(s)))
+	cw.write(cw.buf[:4])
+	cw.write([]byte(s))
+}
+
+func (cw *cebWriter) writeAttribute(attr Attribute) {
+	cw.writeString(attr.Name)
+	for _, v := range attr.Values {
+		cw.writeString(v)
+	}
+}
+
+func (cw *cebWriter) writeFloats(row []float32, buf []byte) {
+	for i, v := range row {
+		binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(v))
+	}
+	cw.write(buf[:len(row)*4])
+}
+
+func (cw *cebWriter) pad() {
+	if rem := cw.n % cebAlignment; rem != 0 {
+		cw.write(make([]byte, cebAlignment-rem))
+	}
+}
+
+// WriteCeb writes the Cef in the binary CEB format. The layout mirrors the text format:
+// the magic number, six counts (headers, row attributes, column attributes, rows, columns
+// and flags), the headers, the column attributes, the row attributes and finally the
+// main matrix, row by row, aligned to an 8-byte boundary. Counts are little-endian int64,
+// strings are a little-endian uint32 byte length followed by UTF-8 bytes, and values are
+// little-endian IEEE-754 float32.
+func WriteCeb(cef *Cef, f io.Writer, transposed bool) error {
+	cw := &cebWriter{w: bufio.NewWriter(f)}
+
+	// The main matrix is written as it is stored, and the Transposed flag tells which way
+	flags := storedFlags(cef, transposed)
+	cef = cef.storage()
+	cw.writePreamble(withHistory(withChecksum(cef.Headers, storedChecksum(cef, flags, false))), cef.RowAttributes, cef.ColumnAttributes, cef.Rows, cef.Columns, flags)
+
+	// Write the main matrix
+	buf := make([]byte, cef.Columns*4)
+	for i := 0; i < cef.Rows; i++ {
+		cw.writeFloats(cef.GetRow(i), buf)
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+	return cw.w.Flush()
+}
+
+// writePreamble writes everything that precedes the main matrix, including the padding
+func (cw *cebWriter) writePreamble(headers []Header, rowAttrs []Attribute, colAttrs []Attribute, nRows int, nColumns int, flags int) {
+	binary.LittleEndian.PutUint32(cw.buf[:], MagicCEB)
+	cw.write(cw.buf[:4])
+	cw.writeInt(len(headers))
+	cw.writeInt(len(rowAttrs))
+	cw.writeInt(len(colAttrs))
+	cw.writeInt(nRows)
+	cw.writeInt(nColumns)
+	cw.writeInt(flags)
+
+	// Write the headers
+	for _, hdr := range headers {
+		cw.writeString(hdr.Name)
+		cw.writeString(hdr.Value)
+	}
+
+	// Write the attributes
+	for _, attr := range colAttrs {
+		cw.writeAttribute(attr)
+	}
+	for _, attr := range rowAttrs {
+		cw.writeAttribute(attr)
+	}
+	cw.pad()
+}
+
+type cebReader struct {
+	r          *bufio.Reader
+	n          int64
+	buf        [8]byte
+	checksumAt int64 // The offset of the 'Checksum' header value, if any
+}
+
+func (cr *cebReader) read(p []byte) error {
+	n, err := io.ReadFull(cr.r, p)
+	cr.n += int64(n)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (cr *cebReader) readInt() (int, error) {
+	if err := cr.read(cr.buf[:8]); err != nil {
+		return 0, err
+	}
+	return int(int64(binary.LittleEndian.Uint64(cr.buf[:]))), nil
+}
+
+// readBytes reads n bytes into buf (reusing its storage), growing it in steps
+func (cr *cebReader) readBytes(n int, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	for len(buf) < n {
+		start := len(buf)
+		buf = append(buf, make([]byte, min(n-start, max(cebChunk, cap(buf)-start)))...)
+		if err := cr.read(buf[start:]); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (cr *cebReader) readString() (string, error) {
+	if err := cr.read(cr.buf[:4]); err != nil {
+		return "", err
+	}
+	temp, err := cr.readBytes(int(binary.LittleEndian.Uint32(cr.buf[:])), nil)
+	if err != nil {
+		return "", err
+	}
+	return string(temp), nil
+}
+
+func (cr *cebReader) readAttribute(n int) (Attribute, error) {
+	name, err := cr.readString()
+	if err != nil {
+		return Attribute{}, err
+	}
+	attr := Attribute{name, make([]string, 0, min(n, cebChunk))}
+	for i := 0; i < n; i++ {
+		value, err := cr.readString()
+		if err != nil {
+			return Attribute{}, err
+		}
+		attr.Values = append(attr.Values, value)
+	}
+	return attr, nil
+}
+
+// readFloats reads n values into row (reusing its storage, or allocating it once the values
+// have been read), using buf for the bytes, and returns both
+func (cr *cebReader) readFloats(row []float32, n int, buf []byte) ([]float32, []byte, error) {
+	buf, err := cr.readBytes(n*4, buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cap(row) < n {
+		row = make([]float32, n)
+	}
+	row = row[:n]
+	for i := range row {
+		row[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[i*4:]))
+	}
+	return row, buf, nil
+}
+
+func (cr *cebReader) skipPadding() error {
+	if rem := cr.n % cebAlignment; rem != 0 {
+		return cr.read(make([]byte, cebAlignment-rem))
+	}
+	return nil
+}
+
+// readCeb reads a binary CEB file (see WriteCeb for the layout)
+func readCeb(r *bufio.Reader) (*Cef, error) {
+	cr := &cebReader{r: r}
+	cef, err := cr.readPreamble()
+	if err != nil {
+		return nil, err
+	}
+	return cr.readMatrix(cef)
+}
+
+// readMatrix reads the main matrix, following the preamble, and returns the whole file
+// (see orient)
+func (cr *cebReader) readMatrix(cef *Cef) (*Cef, error) {
+	// A corrupt row count must not allocate the whole matrix up front, so larger matrices
+	// grow as their rows are read
+	rows := cef.Rows
+	if rows*cef.Columns > cebChunk*cebChunk {
+		rows = -1
+	}
+	b := newMatrixBuilder(rows, cef.Columns, true, false)
+	var row []float32
+	var buf []byte
+	for i := 0; i < cef.Rows; i++ {
+		var err error
+		if row, buf, err = cr.readFloats(row, cef.Columns, buf); err != nil {
+			return nil, errors.New(fmt.Sprintf("Truncated CEB file (in row %v of the main matrix)", i+1))
+		}
+		b.appendRow(row)
+	}
+	b.finish(cef)
+	cef.orient()
+	if err := cef.verify(); err != nil {
+		return nil, err
+	}
+	return cef, nil
+}
+
+// readPreamble reads everything that precedes the main matrix, including the padding
+func (cr *cebReader) readPreamble() (*Cef, error) {
+	if err := cr.read(cr.buf[:4]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(cr.buf[:]) != MagicCEB {
+		return nil, errors.New("Unknown file format")
+	}
+
+	// Read the counts
+	counts := make([]int, 6)
+	for i := 0; i < len(counts); i++ {
+		val, err := cr.readInt()
+		if err != nil {
+			return nil, errors.New("Truncated CEB file (incomplete preamble)")
+		}
+		if val < 0 && i < 5 {
+			return nil, errors.New(fmt.Sprintf("Invalid CEB file (negative count in preamble field %v)", i+1))
+		}
+		counts[i] = val
+	}
+	nHeaders, nRowAttrs, nColumnAttrs := counts[0], counts[1], counts[2]
+	cef := new(Cef)
+	cef.Rows = counts[3]
+	cef.Columns = counts[4]
+	cef.Flags = counts[5]
+	if cef.Columns > 0 && cef.Rows > math.MaxInt/4/cef.Columns {
+		return nil, errors.New(fmt.Sprintf("Invalid CEB file (a main matrix of %v rows and %v columns is too large)", cef.Rows, cef.Columns))
+	}
+
+	// Read the headers (the counts are not trusted to allocate anything up front)
+	cef.Headers = make([]Header, 0, min(nHeaders, cebChunk))
+	for i := 0; i < nHeaders; i++ {
+		var hdr Header
+		var err error
+		if hdr.Name, err = cr.readString(); err != nil {
+			return nil, errors.New(fmt.Sprintf("Truncated CEB file (in header %v)", i+1))
+		}
+		if hdr.Name == checksumHeader && cr.checksumAt == 0 {
+			cr.checksumAt = cr.n + 4
+		}
+		if hdr.Value, err = cr.readString(); err != nil {
+			return nil, errors.New(fmt.Sprintf("Truncated CEB file (in header %v)", i+1))
+		}
+		cef.Headers = append(cef.Headers, hdr)
+	}
+
+	// Read the column and row attributes
+	cef.ColumnAttributes = make([]Attribute, 0, min(nColumnAttrs, cebChunk))
+	for i := 0; i < nColumnAttrs; i++ {
+		attr, err := cr.readAttribute(cef.Columns)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Truncated CEB file (in column attribute %v)", i+1))
+		}
+		cef.ColumnAttributes = append(cef.ColumnAttributes, attr)
+	}
+	cef.RowAttributes = make([]Attribute, 0, min(nRowAttrs, cebChunk))
+	for i := 0; i < nRowAttrs; i++ {
+		attr, err := cr.readAttribute(cef.Rows)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Truncated CEB file (in row attribute %v)", i+1))
+		}
+		cef.RowAttributes = append(cef.RowAttributes, attr)
+	}
+	if err := cr.skipPadding(); err != nil {
+		return nil, errors.New("Truncated CEB file (before main matrix)")
+	}
+
+	// Without columns, the rows take up no space in the main matrix, so only the row
+	// attribute values (which were all read above) can vouch for the row count
+	if cef.Columns == 0 && nRowAttrs == 0 && cef.Rows > 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid CEB file (%v rows without columns or row attributes)", cef.Rows))
+	}
+	return cef, nil
+}
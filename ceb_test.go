@@ -0,0 +1,110 @@
+package ceftools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func writeTestCeb(t *testing.T, cef *Cef) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteCeb(cef, &buf, false); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCebRoundTrip(t *testing.T) {
+	cef := testCef()
+	result, err := readCeb(bufio.NewReader(bytes.NewReader(writeTestCeb(t, cef))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameCef(t, cef, result)
+}
+
+func TestCebRoundTripTransposed(t *testing.T) {
+	cef := testCef().Transpose()
+	result, err := readCeb(bufio.NewReader(bytes.NewReader(writeTestCeb(t, cef))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Flags&Transposed == 0 {
+		t.Error("the Transposed flag was not kept")
+	}
+	checkSameCef(t, cef, result)
+}
+
+func TestCebStreamed(t *testing.T) {
+	cef := testCef()
+	r, err := NewReader(bytes.NewReader(writeTestCeb(t, cef)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < cef.Rows; i++ {
+		attrs, values, err := r.ReadRow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs[0] != cef.RowAttributes[0].Values[i] || len(values) != cef.Columns {
+			t.Errorf("row %v is %v %v", i, attrs, values)
+		}
+	}
+}
+
+func TestCebTruncated(t *testing.T) {
+	data := writeTestCeb(t, testCef())
+	for n := 0; n < len(data); n++ {
+		if _, err := readCeb(bufio.NewReader(bytes.NewReader(data[:n]))); err == nil {
+			t.Errorf("expected an error for a file truncated to %v bytes", n)
+		}
+	}
+}
+
+func TestCebCorruptCounts(t *testing.T) {
+	data := writeTestCeb(t, testCef())
+	for field := 0; field < 5; field++ {
+		corrupt := append([]byte{}, data...)
+		binary.LittleEndian.PutUint64(corrupt[4+8*field:], 1<<61)
+		if _, err := readCeb(bufio.NewReader(bytes.NewReader(corrupt))); err == nil {
+			t.Errorf("expected an error for a corrupt count in preamble field %v", field+1)
+		}
+		if _, err := NewReader(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("expected an error from NewReader for a corrupt count in preamble field %v", field+1)
+		}
+	}
+
+	// A corrupt string length
+	corrupt := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(corrupt[4+8*6:], 0xFFFFFFFF)
+	if _, err := readCeb(bufio.NewReader(bytes.NewReader(corrupt))); err == nil || !strings.HasPrefix(err.Error(), "Truncated CEB file") {
+		t.Errorf("expected a truncated file for a corrupt string length, got %v", err)
+	}
+}
+
+func TestCebCorruptRowsWithoutColumns(t *testing.T) {
+	// With row attributes, the file runs out before the rows do
+	cef := &Cef{Rows: 2, Columns: 0, Headers: []Header{}, RowAttributes: []Attribute{{"Gene", []string{"Actb", "Xist"}}}, ColumnAttributes: []Attribute{}, Matrix: []float32{}}
+	for _, c := range []struct {
+		cef *Cef
+		err string
+	}{
+		{cef, "Truncated CEB file (in row attribute 1)"},
+		{&Cef{Headers: []Header{}, RowAttributes: []Attribute{}, ColumnAttributes: []Attribute{}, Matrix: []float32{}}, "Invalid CEB file (2305843009213693952 rows without columns or row attributes)"},
+	} {
+		data := writeTestCeb(t, c.cef)
+		if _, err := readCeb(bufio.NewReader(bytes.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+		binary.LittleEndian.PutUint64(data[4+8*3:], 1<<61)
+		if _, err := readCeb(bufio.NewReader(bytes.NewReader(data))); err == nil || err.Error() != c.err {
+			t.Errorf("got error %v, expected %v", err, c.err)
+		}
+		if _, err := NewReader(bytes.NewReader(data)); err == nil || err.Error() != c.err {
+			t.Errorf("got error %v from NewReader, expected %v", err, c.err)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"github.com/alecthomas/kingpin"
 	"github.com/linnarsson-lab/ceftools"
+	"io"
 	"os"
 	"runtime/pprof"
 	"strconv"
@@ -24,12 +25,54 @@ func main() {
 	var app = kingpin.New("cef", versionString)
 	var app_bycol = app.Flag("bycol", "Apply command by columns instead of by rows").Short('c').Bool()
 	var app_profile = app.Flag("profile", "Run with CPU profiling, output to the given file").String()
+	var app_ceb = app.Flag("ceb", "Write output in the binary CEB format").Bool()
+	var app_compress = app.Flag("compress", "Compress the output ('gzip' or 'zstd')").Enum("gzip", "zstd")
+	var app_precision = app.Flag("precision", "Write values with this many significant digits (like '4'), or decimals (like '2f')").String()
+	var app_integer = app.Flag("integer", "Write values rounded to the nearest integer").Bool()
+	var app_legacy = app.Flag("legacy-quoting", "Read text input written by older versions, which quoted fields instead of escaping them").Bool()
+	var app_no_history = app.Flag("no-history", "Do not record the command in a 'History' header of the output (for byte-identical output)").Bool()
+	var app_checksum = app.Flag("checksum", "Record a checksum of the attributes and main matrix in a 'Checksum' header of the output (holding back streamed output until the end)").Bool()
+	var app_strict_checksum = app.Flag("strict-checksum", "Fail, instead of warning, if the checksum of the input does not match").Bool()
+	var app_threads = app.Flag("threads", "Number of cores used to parse text input and format text output (0 for all cores)").Default("1").Int()
 
 	var info = app.Command("info", "Show a summary of the file contents")
+	var history = app.Command("history", "Show the processing steps recorded in the file")
+	var verify = app.Command("verify", "Recompute the checksum of the file and compare it to the recorded one")
 	var test = app.Command("test", "Perform an internal test")
 	var transpose = app.Command("transpose", "Transpose rows and columns")
+	var validate = app.Command("validate", "Check that the file follows the CEF specification")
+	var validate_limit = validate.Flag("limit", "Show at most this many problems (0 for all)").Default("100").Int()
+	var validate_strict = validate.Flag("strict", "Fail also on warnings (deviations tolerated by readers)").Bool()
 	var cmdimport = app.Command("import", "Import from a legacy format")
-	var import_format = cmdimport.Flag("format", "The file format to expect ('strt')").Required().Short('f').String()
+	var import_format = cmdimport.Flag("format", "The file format to expect ('mtx', '10x', 'zarr', 'table' or any format listed by 'cef convert --list', like 'strt')").Required().Short('f').String()
+	var import_delimiter = cmdimport.Flag("delimiter", "The field delimiter: a single character, or 'tab', 'comma', 'semicolon' or 'space' (table only)").Default("tab").String()
+	var import_rowattrs = cmdimport.Flag("rowattrs", "The number of leading columns that hold row attributes (table only)").Default("0").Int()
+	var import_colattrs = cmdimport.Flag("colattrs", "The number of leading lines that hold column attributes (table only)").Default("0").Int()
+	var import_names = cmdimport.Flag("names", "A line naming the row attributes follows the column attributes (table only)").Bool()
+	var import_comment = cmdimport.Flag("comment", "Skip lines starting with this prefix (can be repeated; table only)").Strings()
+	var import_quotes = cmdimport.Flag("quotes", "Allow fields enclosed in double quotes (use --no-quotes to disable; table only)").Default("true").Bool()
+	var import_dir = cmdimport.Arg("dir", "The directory to import (10x and zarr only)").String()
+	var import_split = cmdimport.Flag("split", "Write each feature type to a separate file, named by this prefix and the feature type (10x only)").String()
+	var import_rows = cmdimport.Flag("rows", "Tab-delimited file of row attributes, with names on the first line (mtx only)").String()
+	var import_columns = cmdimport.Flag("columns", "Tab-delimited file of column attributes, with names on the first line (mtx only)").String()
+	var cmdexport = app.Command("export", "Export to another format")
+	var export_format = cmdexport.Flag("format", "The file format to write ('mtx', 'tsv', 'csv', 'cls', 'zarr' or any format listed by 'cef convert --list')").Required().Short('f').String()
+	var export_attrs = cmdexport.Flag("attrs", "Row attribute(s) to write (comma-separated; default all; tsv/csv only)").Short('a').String()
+	var export_colattrs = cmdexport.Flag("colattrs", "Column attribute(s) to write (comma-separated; wide default is the first, long default is all; tsv/csv only)").String()
+	var export_long = cmdexport.Flag("long", "Write one line (or record) per non-zero value instead of a matrix (tsv/csv/arrow only)").Bool()
+	var export_rows = cmdexport.Flag("rows", "Write the row attributes to this tab-delimited file (mtx only)").String()
+	var export_columns = cmdexport.Flag("columns", "Write the column attributes to this tab-delimited file (mtx only)").String()
+	var export_dir = cmdexport.Arg("dir", "The directory to write (zarr only)").String()
+	var export_class = cmdexport.Flag("class", "The column attribute that gives the phenotype labels (cls only)").Default("Class").String()
+	var export_maxrows = cmdexport.Flag("max-rows", "The maximum number of rows of the matrix sheet, including the column attributes (xlsx only)").Default(strconv.Itoa(ceftools.XlsxMaxRows)).Int()
+	var export_maxcolumns = cmdexport.Flag("max-columns", "The maximum number of columns of the matrix sheet, including the row attributes (xlsx only)").Default(strconv.Itoa(ceftools.XlsxMaxColumns)).Int()
+
+	var convert = app.Command("convert", "Convert between any two registered formats")
+	var convert_from = convert.Flag("from", "The input format (default: detected from the content or file name)").String()
+	var convert_to = convert.Flag("to", "The output format (default: detected from the file name, or else CEF or CEB)").String()
+	var convert_list = convert.Flag("list", "List the registered formats").Bool()
+	var convert_in = convert.Arg("input", "Read this file instead of standard input").String()
+	var convert_out = convert.Arg("output", "Write this file instead of standard output").String()
 
 	var rename = app.Command("rename", "Rename attribute")
 	var rename_attr = rename.Flag("attr", "The attribute to rename ('old=new')").Required().Short('c').String()
@@ -47,14 +90,21 @@ func main() {
 	var select_range = cmdselect.Flag("range", "Select a range of rows (like '10:90')").String()
 	var select_where = cmdselect.Flag("where", "Select rows with specific value for attribute ('attr=value')").String()
 	var select_except = cmdselect.Flag("except", "Invert selection").Bool()
+	var select_file = cmdselect.Arg("file", "Read this file instead of standard input, using its index if up to date").String()
+
+	var index = app.Command("index", "Index a file for fast selection of rows")
+	var index_file = index.Arg("file", "The (uncompressed) CEF file to index").Required().String()
+	var index_attr = index.Flag("attr", "Row attribute to index for 'select --where'").Short('a').String()
 
 	var rescale = app.Command("rescale", "Rescale values by rows")
 	var rescale_method = rescale.Flag("method", "Method to use (log, tpm or rpkm)").Short('m').Required().Enum("log", "tpm", "rpkm")
 	var rescale_length = rescale.Flag("length", "Indicate the name of the attribute that gives gene length (for RPKM)").String()
+	var rescale_inplace = rescale.Flag("inplace", "Rescale this (uncompressed CEB) file in place, instead of standard input").String()
 
 	var join = app.Command("join", "Join two files based on given attributes")
 	var join_other = join.Flag("with", "The file to which the input should be joined").Required().String()
 	var join_on = join.Flag("on", "The attributes on which to join, of form 'attr1=attr2'").Required().String()
+	var join_mode = join.Flag("mode", "Keep only matching rows ('inner'), or also rows without a match in the other file ('left', 'right' or 'outer'), with missing values").Default("inner").Enum("inner", "left", "right", "outer")
 
 	var sort = app.Command("sort", "Sort by row attribute or by specific column")
 	var sort_by = sort.Flag("by", "The attribute or column ('column=value') to sort by").String()
@@ -69,9 +119,11 @@ func main() {
 	var aggregate_stdev = aggregate.Flag("stdev", "Calculate standard deviation").Bool()
 	var aggregate_max = aggregate.Flag("max", "Calculate max value").Bool()
 	var aggregate_min = aggregate.Flag("min", "Calculate min value").Bool()
-	var aggregate_noise = aggregate.Flag("noise", "Calculate noise (CV-vs-mean offset)").Required().Enum("std", "bands")
+	var aggregate_missing = aggregate.Flag("missing", "Count missing values").Bool()
+	var aggregate_noise = aggregate.Flag("noise", "Calculate noise (CV-vs-mean offset)").Enum("std", "bands")
 
 	var view = app.Command("view", "View the file content interactively")
+	var view_file = view.Arg("file", "View this file instead of standard input (CEB files are memory-mapped)").String()
 
 	// Parse the command line
 	var parsed, err = app.Parse(os.Args[1:])
@@ -79,6 +131,23 @@ func main() {
 		app.Usage(os.Stderr)
 		return
 	}
+	ceftools.BinaryOutput = *app_ceb
+	ceftools.WriteChecksum = *app_checksum
+	ceftools.StrictChecksum = *app_strict_checksum
+	ceftools.Compression = *app_compress
+	ceftools.Threads = *app_threads
+	ceftools.LegacyQuoting = *app_legacy
+	if *app_precision != "" {
+		if *app_integer {
+			fmt.Fprintln(os.Stderr, "Use either --precision or --integer, not both")
+			return
+		}
+		if ceftools.OutputPrecision, err = ceftools.ParsePrecision(*app_precision); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+	ceftools.OutputPrecision.Integer = *app_integer
 
 	if *app_profile != "" {
 		f, err := os.Create(*app_profile)
@@ -90,54 +159,158 @@ func main() {
 
 	}
 
+	// Record the command in a 'History' header of the output, with a content hash of the input
+	// (see HashInput; from standard input, it is computed as the command reads the input)
+	var stdin io.Reader = os.Stdin
+	if !*app_no_history {
+		var input *ceftools.InputHash
+		switch parsed {
+		case aggregate.FullCommand(), rename.FullCommand(), add.FullCommand(), sort.FullCommand(), join.FullCommand(), cmdimport.FullCommand(), cmdselect.FullCommand(), transpose.FullCommand(), drop.FullCommand(), rescale.FullCommand(), convert.FullCommand():
+			if (parsed == cmdimport.FullCommand() && (*import_format == "10x" || *import_format == "zarr")) || *rescale_inplace != "" || *convert_list {
+				break
+			}
+			path := ""
+			if parsed == cmdselect.FullCommand() {
+				path = *select_file
+			} else if parsed == convert.FullCommand() {
+				path = *convert_in
+			}
+			if path != "" {
+				f, err := os.Open(path)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return
+				}
+				input = ceftools.HashInput(f)
+				input.Sum()
+				f.Close()
+				break
+			}
+			input = ceftools.HashInput(os.Stdin)
+			stdin = input
+		}
+		ceftools.History = ceftools.HistoryStep(os.Args, input)
+	}
+
 	// Handle the sub-commands
 	switch kingpin.MustParse(parsed, nil) {
 	case view.FullCommand():
-		if err = ceftools.Viewer(*app_bycol); err != nil {
+		if *view_file != "" {
+			err = ceftools.ViewFile(*view_file, *app_bycol)
+		} else {
+			err = ceftools.Viewer(stdin, *app_bycol)
+		}
+		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 		return
 	case aggregate.FullCommand():
-		if err = ceftools.CmdAggregate(*aggregate_mean, *aggregate_cv, *aggregate_stdev, *aggregate_max, *aggregate_min, *aggregate_noise, *app_bycol); err != nil {
+		if err = ceftools.CmdAggregate(stdin, os.Stdout, *aggregate_mean, *aggregate_cv, *aggregate_stdev, *aggregate_max, *aggregate_min, *aggregate_missing, *aggregate_noise, *app_bycol); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 		return
 	case rename.FullCommand():
-		if err = ceftools.CmdRename(*rename_attr, *app_bycol); err != nil {
+		if err = ceftools.CmdRename(stdin, os.Stdout, *rename_attr, *app_bycol); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 		return
 	case add.FullCommand():
-		if err = ceftools.CmdAdd(*add_attr, *add_header, *app_bycol); err != nil {
+		if err = ceftools.CmdAdd(stdin, os.Stdout, *add_attr, *add_header, *app_bycol); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 		return
 	case sort.FullCommand():
 		if *sort_spin {
-			if err = ceftools.CmdSPIN(*sort_corrfile, *app_bycol); err != nil {
+			if err = ceftools.CmdSPIN(stdin, os.Stdout, *sort_corrfile, *app_bycol); err != nil {
 				fmt.Fprintln(os.Stderr, err)
 			}
 		} else {
-			if err = ceftools.CmdSort(*sort_by, *sort_numerical, *sort_reverse, *app_bycol); err != nil {
+			if err = ceftools.CmdSort(stdin, os.Stdout, *sort_by, *sort_numerical, *sort_reverse, *app_bycol); err != nil {
 				fmt.Fprintln(os.Stderr, err)
 			}
 		}
 		return
 	case join.FullCommand():
-		if err = ceftools.CmdJoin(*join_other, *join_on, *app_bycol); err != nil {
+		if err = ceftools.CmdJoin(stdin, os.Stdout, *join_other, *join_on, *join_mode, *app_bycol); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 		return
 	case cmdimport.FullCommand():
-		if *import_format == "strt" {
-			if err = ceftools.CmdImportStrt(); err != nil {
-				fmt.Fprintln(os.Stderr, err)
+		switch *import_format {
+		case "mtx":
+			err = ceftools.CmdImportMtx(stdin, os.Stdout, *import_rows, *import_columns)
+		case "10x":
+			if *import_dir == "" {
+				fmt.Fprintln(os.Stderr, "The directory to import must be given (like 'cef import --format 10x filtered_feature_bc_matrix')")
+				return
+			}
+			err = ceftools.CmdImportTenx(os.Stdout, *import_dir, *import_split)
+		case "zarr":
+			if *import_dir == "" {
+				fmt.Fprintln(os.Stderr, "The directory to import must be given (like 'cef import --format zarr data.zarr')")
+				return
+			}
+			err = ceftools.CmdImportZarr(os.Stdout, *import_dir)
+		case "table":
+			err = ceftools.CmdImportTable(stdin, os.Stdout, *import_delimiter, *import_rowattrs, *import_colattrs, *import_names, *import_comment, *import_quotes)
+		default:
+			err = ceftools.CmdConvert(stdin, os.Stdout, *import_format, "", "", "", false)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	case cmdexport.FullCommand():
+		switch *export_format {
+		case "mtx":
+			err = ceftools.CmdExportMtx(stdin, os.Stdout, *export_rows, *export_columns, *app_bycol)
+		case "zarr":
+			if *export_dir == "" {
+				fmt.Fprintln(os.Stderr, "The directory to write must be given (like 'cef export --format zarr data.zarr')")
+				return
 			}
+			err = ceftools.CmdExportZarr(stdin, *export_dir, *app_bycol)
+		case "arrow":
+			err = ceftools.CmdExportArrow(stdin, os.Stdout, *export_long, *app_bycol)
+		case "xlsx":
+			err = ceftools.CmdExportXlsx(stdin, os.Stdout, *export_maxrows, *export_maxcolumns, *app_bycol)
+		case "cls":
+			err = ceftools.CmdExportCls(stdin, os.Stdout, *export_class, *app_bycol)
+		case "tsv", "csv":
+			err = ceftools.CmdExportTable(stdin, os.Stdout, *export_format, *export_attrs, *export_colattrs, *export_long, *app_bycol)
+		default:
+			err = ceftools.CmdConvert(stdin, os.Stdout, "", *export_format, "", "", *app_bycol)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	case convert.FullCommand():
+		if *convert_list {
+			err = ceftools.CmdFormats(os.Stdout)
 		} else {
-			fmt.Fprintln(os.Stderr, "Unknown format (only valid format is 'strt')")
+			err = convertFiles(stdin, *convert_in, *convert_out, *convert_from, *convert_to, *app_bycol)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	case index.FullCommand():
+		if err = ceftools.CmdIndex(*index_file, *index_attr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 		}
 		return
 	case cmdselect.FullCommand():
+		in := stdin
+		if *select_file != "" {
+			f, err := os.Open(*select_file)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			defer f.Close()
+			in = f
+		}
 		if *select_range != "" {
 			if *select_where != "" {
 				fmt.Fprintln(os.Stderr, "Cannot select using --range and --where simultaneously (use a pipe)")
@@ -164,36 +337,34 @@ func main() {
 					return
 				}
 			}
-			if err := ceftools.CmdSelectRange(from, to, *app_bycol, *select_except); err != nil {
+			if err := ceftools.CmdSelectRange(in, os.Stdout, from, to, *app_bycol, *select_except); err != nil {
 				fmt.Fprintln(os.Stderr, err.Error())
 			}
 			return
 		}
 		if *select_where != "" {
-			if err := ceftools.CmdSelect(*select_where, *app_bycol, *select_except); err != nil {
+			if err := ceftools.CmdSelect(in, os.Stdout, *select_where, *app_bycol, *select_except); err != nil {
 				fmt.Fprintln(os.Stderr, err.Error())
 			}
 			return
 		}
 	case transpose.FullCommand():
-		// Read the input
-		var cef, err = ceftools.Read(os.Stdin, true)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			return
-		}
-		// Write the CEF file
-		if err := ceftools.Write(cef, os.Stdout, false); err != nil {
+		if err = ceftools.CmdTranspose(stdin, os.Stdout); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 		return
 	case drop.FullCommand():
-		if err = ceftools.CmdDrop(*drop_attrs, *drop_headers, *drop_except, *app_bycol); err != nil {
+		if err = ceftools.CmdDrop(stdin, os.Stdout, *drop_attrs, *drop_headers, *drop_except, *app_bycol); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 		return
 	case rescale.FullCommand():
-		if err = ceftools.CmdRescale(*rescale_method, *rescale_length, *app_bycol); err != nil {
+		if *rescale_inplace != "" {
+			err = ceftools.CmdRescaleInPlace(*rescale_inplace, *rescale_method, *rescale_length, *app_bycol)
+		} else {
+			err = ceftools.CmdRescale(stdin, os.Stdout, *rescale_method, *rescale_length, *app_bycol)
+		}
+		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 		return
@@ -238,8 +409,25 @@ func main() {
 		return
 
 	// Show info
+	case validate.FullCommand():
+		if err = ceftools.CmdValidate(stdin, os.Stdout, *validate_limit, *validate_strict); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	case history.FullCommand():
+		if err = ceftools.CmdHistory(stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	case verify.FullCommand():
+		if err = ceftools.CmdVerify(stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	case info.FullCommand():
-		var cef, err = ceftools.Read(os.Stdin, *app_bycol)
+		var cef, err = ceftools.Read(stdin, *app_bycol)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return
@@ -277,3 +465,29 @@ func main() {
 		kingpin.Usage()
 	}
 }
+
+// convertFiles converts the input file (or the given standard input) to the output file (or standard
+// output), removing the output file if the conversion fails
+func convertFiles(in io.Reader, inPath string, outPath string, from string, to string, bycol bool) error {
+	if inPath != "" {
+		f, err := os.Open(inPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if outPath == "" {
+		return ceftools.CmdConvert(in, os.Stdout, from, to, inPath, "", bycol)
+	}
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	if err := ceftools.CmdConvert(in, out, from, to, inPath, outPath, bycol); err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return err
+	}
+	return out.Close()
+}
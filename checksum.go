@@ -0,0 +1,193 @@
+package ceftools
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+// The name of the header that records the checksum of the attributes and the main matrix
+const checksumHeader = "Checksum"
+
+// WriteChecksum makes writers record a checksum of the attributes and the main matrix in a
+// 'Checksum' header, which readers verify. Headers are not covered, so that they can be
+// edited without invalidating it. If not set, a checksum is still recorded if the input has
+// one (see keepChecksum). Since the header precedes the rows, streamed text output with a
+// checksum is kept in a temporary file until the last row has been written.
+var WriteChecksum = false
+
+// StrictChecksum makes readers fail if the checksum does not match, instead of warning
+var StrictChecksum = false
+
+// The prefix of checksums, which are CRC-32C (Castagnoli) written as 8 hex digits
+const checksumPrefix = "crc32c:"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum computes the checksum of a file as it is stored, row by row. It covers the column
+// attributes, the row attribute names, the row attribute values and main matrix values of
+// each row, and finally the row count, column count and flags. Counts are hashed as
+// little-endian int64, strings as a little-endian uint32 byte length followed by the bytes,
+// and values as little-endian float32 (with a single NaN for all missing values), as in CEB
+// files. Values are hashed as readers read them back, so for text files (if rounded is set)
+// they are first rounded to the output precision.
+type checksum struct {
+	crc     uint32
+	rows    int
+	columns int
+	flags   int
+	rounded bool
+	buf     []byte
+}
+
+func newChecksum(rows int, columns int, flags int, rowAttrs []Attribute, colAttrs []Attribute, rounded bool) *checksum {
+	c := &checksum{rows: rows, columns: columns, flags: flags, rounded: rounded && (OutputPrecision.Integer || OutputPrecision.Digits >= 0)}
+	for _, attr := range colAttrs {
+		c.writeString(attr.Name)
+		for _, val := range attr.Values {
+			c.writeString(val)
+		}
+	}
+	for _, attr := range rowAttrs {
+		c.writeString(attr.Name)
+	}
+	return c
+}
+
+func (c *checksum) write(p []byte) {
+	c.crc = crc32.Update(c.crc, castagnoli, p)
+}
+
+func (c *checksum) writeString(s string) {
+	c.buf = binary.LittleEndian.AppendUint32(c.buf[:0], uint32(len(s)))
+	c.write(c.buf)
+	c.write(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// writeRow adds the row attribute values and main matrix values of the next row
+func (c *checksum) writeRow(attrs []string, values []float32) {
+	for _, val := range attrs {
+		c.writeString(val)
+	}
+	var text []byte
+	c.buf = c.buf[:0]
+	for _, v := range values {
+		if c.rounded && v == v {
+			// Read back the value as written (see appendValue)
+			text = appendValue(text[:0], v)
+			v, _ = parseValue(unsafe.String(unsafe.SliceData(text), len(text)))
+		}
+		bits := math.Float32bits(v)
+		if v != v {
+			bits = 0x7fc00000
+		}
+		c.buf = binary.LittleEndian.AppendUint32(c.buf, bits)
+	}
+	c.write(c.buf)
+}
+
+// String returns the checksum, as recorded in the 'Checksum' header
+func (c *checksum) String() string {
+	var buf [24]byte
+	binary.LittleEndian.PutUint64(buf[0:], uint64(c.rows))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(c.columns))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(c.flags))
+	return fmt.Sprintf("%v%08x", checksumPrefix, crc32.Update(c.crc, castagnoli, buf[:]))
+}
+
+// checksumOf computes the checksum of the rows of a Cef as stored in a file with the given flags
+func checksumOf(stored *Cef, flags int, rounded bool) string {
+	c := newChecksum(stored.Rows, stored.Columns, flags, stored.RowAttributes, stored.ColumnAttributes, rounded)
+	attrs := make([]string, len(stored.RowAttributes))
+	for i := 0; i < stored.Rows; i++ {
+		for j := 0; j < len(attrs); j++ {
+			attrs[j] = stored.RowAttributes[j].Values[i]
+		}
+		c.writeRow(attrs, stored.GetRow(i))
+	}
+	return c.String()
+}
+
+// keepChecksum reports whether to record a checksum in output with the given headers: if
+// WriteChecksum is set, or if the headers hold the checksum of the input, which is then
+// recomputed so that it stays valid (also after a header-only edit)
+func keepChecksum(headers []Header) bool {
+	return WriteChecksum || strings.HasPrefix(checksumValue(headers), checksumPrefix)
+}
+
+// storedChecksum returns the checksum to record for the rows of a Cef as stored in a file
+// with the given flags, or "" if none is to be recorded (see keepChecksum)
+func storedChecksum(stored *Cef, flags int, rounded bool) string {
+	if !keepChecksum(stored.Headers) {
+		return ""
+	}
+	return checksumOf(stored, flags, rounded)
+}
+
+// checksumValue returns the value of the 'Checksum' header, or "" if there is none
+func checksumValue(headers []Header) string {
+	for _, hdr := range headers {
+		if hdr.Name == checksumHeader {
+			return hdr.Value
+		}
+	}
+	return ""
+}
+
+// withChecksum returns the headers, with the 'Checksum' header set to the given value (or
+// removed, if it is empty)
+func withChecksum(headers []Header, value string) []Header {
+	result := make([]Header, 0, len(headers)+1)
+	for _, hdr := range headers {
+		if hdr.Name != checksumHeader {
+			result = append(result, hdr)
+		} else if value != "" {
+			result = append(result, Header{checksumHeader, value})
+			value = ""
+		}
+	}
+	if value != "" {
+		result = append(result, Header{checksumHeader, value})
+	}
+	return result
+}
+
+// matchChecksum compares a checksum with the one recorded in the file
+func matchChecksum(expected string, found string) error {
+	if !strings.HasPrefix(expected, checksumPrefix) {
+		return errors.New("Unknown checksum format: " + expected)
+	}
+	if expected != found {
+		return errors.New(fmt.Sprintf("Checksum mismatch (the file may be truncated or corrupted): expected %v, found %v", expected, found))
+	}
+	return nil
+}
+
+// checkChecksum checks a checksum computed while reading against the one recorded in the
+// file (if any, and in a known format), and warns about a mismatch, or returns an error if
+// StrictChecksum is set
+func checkChecksum(expected string, found string) error {
+	if !strings.HasPrefix(expected, checksumPrefix) {
+		return nil
+	}
+	err := matchChecksum(expected, found)
+	if err == nil || StrictChecksum {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Warning: "+err.Error())
+	return nil
+}
+
+// verify checks the checksum of a Cef that has been read from a file (see orient), if it has one
+func (cef *Cef) verify() error {
+	expected := checksumValue(cef.Headers)
+	if !strings.HasPrefix(expected, checksumPrefix) {
+		return nil
+	}
+	return checkChecksum(expected, checksumOf(cef.storage(), cef.Flags, false))
+}
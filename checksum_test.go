@@ -0,0 +1,74 @@
+package ceftools
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// checksummed returns testCef written with a checksum
+func checksummed(t *testing.T) []byte {
+	t.Helper()
+	WriteChecksum = true
+	defer func() { WriteChecksum = false }()
+	var buf bytes.Buffer
+	if err := Write(testCef(), &buf, false); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestChecksumKept(t *testing.T) {
+	input := checksummed(t)
+	StrictChecksum = true
+	defer func() { StrictChecksum = false }()
+	cases := []struct {
+		name string
+		cmd  func(in io.Reader, out io.Writer) error
+		same bool // The attributes and the main matrix are unchanged
+	}{
+		{"add --header", func(in io.Reader, out io.Writer) error { return CmdAdd(in, out, "", "Lab=Linnarsson", false) }, true},
+		{"drop --headers", func(in io.Reader, out io.Writer) error { return CmdDrop(in, out, "", "Tissue", false, false) }, true},
+		{"add --attr", func(in io.Reader, out io.Writer) error { return CmdAdd(in, out, "Source=mouse", "", false) }, false},
+		{"drop --attrs", func(in io.Reader, out io.Writer) error { return CmdDrop(in, out, "Chromosome", "", false, false) }, false},
+		{"transpose", func(in io.Reader, out io.Writer) error { return CmdTranspose(in, out) }, false},
+	}
+	r, err := NewReader(bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := checksumValue(r.Cef.Headers)
+	if expected == "" {
+		t.Fatal("no checksum written")
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		if err := c.cmd(bytes.NewReader(input), &out); err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		r, err := NewReader(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := checksumValue(r.Cef.Headers)
+		if c.same && found != expected {
+			t.Errorf("%v: checksum %q, expected %q as in the input", c.name, found, expected)
+		}
+		if !c.same && (found == "" || found == expected) {
+			t.Errorf("%v: checksum %q, expected a new one", c.name, found)
+		}
+		if err := CmdVerify(bytes.NewReader(out.Bytes()), io.Discard); err != nil {
+			t.Errorf("%v: %v", c.name, err)
+		}
+	}
+
+	// Without a checksum in the input, none is added
+	var out bytes.Buffer
+	if err := CmdAdd(strings.NewReader(testText), &out, "", "Lab=Linnarsson", false); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), checksumHeader) {
+		t.Errorf("a checksum was added to %q", out.String())
+	}
+}
@@ -3,235 +3,334 @@ package ceftools
 import (
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"strconv"
 	"strings"
 )
 
-func CmdAggregate(mean bool, cv bool, stdev bool, maxValue bool, minValue bool, noise string, bycol bool) error {
-	// Read the input
-	cef, err := Read(os.Stdin, bycol)
+func CmdAggregate(in io.Reader, out io.Writer, mean bool, cv bool, stdev bool, maxValue bool, minValue bool, missing bool, noise string, bycol bool) error {
+	// Read the input (the noise fit needs all the rows at once)
+	var r *Reader
+	var noiseValues []string
+	if noise != "" {
+		cef, err := Read(in, bycol)
+		if err != nil {
+			return err
+		}
+		noiseValues = calculateNoise(cef, noise)
+		r = newMemoryReader(cef)
+	} else {
+		var err error
+		r, err = readRows(in, bycol)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Add the new attributes
+	template := withoutRowValues(r.Cef)
+	names := []string{}
+	if mean {
+		names = append(names, "Mean")
+	}
+	if cv {
+		names = append(names, "CV")
+	}
+	if noiseValues != nil {
+		names = append(names, "Noise")
+	}
+	if stdev {
+		names = append(names, "Stdev")
+	}
+	if maxValue {
+		names = append(names, "Max")
+	}
+	if minValue {
+		names = append(names, "Min")
+	}
+	if missing {
+		names = append(names, "Missing")
+	}
+	for _, name := range names {
+		template.RowAttributes = append(template.RowAttributes, Attribute{name, nil})
+	}
+	w, err := writeRows(out, template, r, bycol)
 	if err != nil {
 		return err
 	}
+	defer w.Abort()
 
-	if mean {
-		meanAttr := Attribute{"Mean", make([]string, cef.Rows)}
-		cef.RowAttributes = append(cef.RowAttributes, meanAttr)
-		for i := 0; i < cef.Rows; i++ {
-			row := cef.GetRow(i)
-			sum := 0.0
-			for j := 0; j < len(row); j++ {
-				sum = sum + float64(row[j])
+	for i := 0; ; i++ {
+		attrs, row, err := r.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		mu := rowMean(row)
+		if mean {
+			attrs = append(attrs, formatStatistic(mu))
+		}
+		if cv {
+			divisor := mu
+			if divisor == 0 {
+				divisor = 1
 			}
-			sum = sum / float64(len(row))
-			meanAttr.Values[i] = strconv.FormatFloat(sum, 'f', -1, 64)
+			attrs = append(attrs, formatStatistic(rowStdev(row, mu)/divisor))
 		}
-	}
-
-	if cv {
-		cvAttr := Attribute{"CV", make([]string, cef.Rows)}
-		cef.RowAttributes = append(cef.RowAttributes, cvAttr)
-		for i := 0; i < cef.Rows; i++ {
-			row := cef.GetRow(i)
-			mean := 0.0
+		if noiseValues != nil {
+			attrs = append(attrs, noiseValues[i])
+		}
+		if stdev {
+			attrs = append(attrs, formatStatistic(rowStdev(row, mu)))
+		}
+		if maxValue {
+			max := math.NaN()
 			for j := 0; j < len(row); j++ {
-				mean = mean + float64(row[j])
+				if row[j] == row[j] && (max != max || float64(row[j]) > max) {
+					max = float64(row[j])
+				}
 			}
-			mean = mean / float64(len(row))
-
-			stdev := 0.0
+			attrs = append(attrs, formatStatistic(max))
+		}
+		if minValue {
+			min := math.NaN()
 			for j := 0; j < len(row); j++ {
-				stdev += (float64(row[j]) - mean) * (float64(row[j]) - mean)
+				if row[j] == row[j] && (min != min || float64(row[j]) < min) {
+					min = float64(row[j])
+				}
 			}
-			if mean == 0 {
-				mean = 1
+			attrs = append(attrs, formatStatistic(min))
+		}
+		if missing {
+			n := 0
+			for j := 0; j < len(row); j++ {
+				if row[j] != row[j] {
+					n++
+				}
 			}
-			cvAttr.Values[i] = strconv.FormatFloat(math.Sqrt(stdev/float64(len(row)))/mean, 'f', -1, 64)
+			attrs = append(attrs, strconv.Itoa(n))
+		}
+		if err := w.WriteRow(attrs, row); err != nil {
+			return err
 		}
 	}
 
-	if noise != "" {
-		// Calculate means and CVs
-		log2_m := make([]float64, cef.Rows)
-		log2_cv := make([]float64, cef.Rows)
-		for i := 0; i < cef.Rows; i++ {
-			row := cef.GetRow(i)
-			mu := 0.0
-			for j := 0; j < len(row); j++ {
-				mu = mu + float64(row[j])
-			}
-			mu = mu / float64(cef.Columns)
-			log2_m[i] = math.Log2(mu)
+	// Write the result
+	return w.Close()
+}
 
-			sd := 0.0
-			for j := 0; j < len(row); j++ {
-				sd += (float64(row[j]) - mu) * (float64(row[j]) - mu)
-			}
-			if mu > 0.0 {
-				log2_cv[i] = math.Log2(math.Sqrt(sd/float64(cef.Columns)) / mu)
-			} else {
-				log2_cv[i] = 0.0
-			}
+// formatStatistic formats an aggregate statistic, writing NaN as an empty (missing) value
+func formatStatistic(val float64) string {
+	if math.IsNaN(val) {
+		return ""
+	}
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+// rowMean computes the mean of the row, skipping missing values (NaN if all are missing)
+func rowMean(row []float32) float64 {
+	sum := 0.0
+	n := 0
+	for j := 0; j < len(row); j++ {
+		if row[j] == row[j] {
+			sum = sum + float64(row[j])
+			n++
 		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	return sum / float64(n)
+}
 
-		// Least squares fit to the CV-vs-mean curve; below is the Python code from Gioele
-
-		// fun = lambda x, log2_m, log2_cv: sum(abs( log2( (2.**log2_m)**(-x[0])+x[1]) - log2_cv ))
-		// #Fit using Nelder-Mead algorythm
-		// optimization =  minimize(fun, x0, args=(log2_m,log2_cv), method='Nelder-Mead')
-		// params = optimization.x
-		// #The fitted function
-		// fitted_fun = lambda log_mu: log2( (2.**log_mu)**(-params[0]) + params[1])
-		// # Score is the relative position with respect of the fitted curve
-		// score = log2(cv) - fitted_fun(log2(mu))
-
-		// Two-parameter model, least absolute error
-		if noise == "std" {
-			f := func(x []float64) float64 {
-				sum := 0.0
-				for ix := 0; ix < len(log2_m); ix++ {
-					if log2_cv[ix] == 0.0 {
-						continue
-					}
-					sum += math.Abs(math.Log2(math.Pow(math.Pow(2, log2_m[ix]), -x[0])+x[1]) - log2_cv[ix])
-				}
-				return sum
-			}
+// rowStdev computes the (population) standard deviation of the row, given its mean,
+// skipping missing values
+func rowStdev(row []float32, mean float64) float64 {
+	stdev := 0.0
+	n := 0
+	for j := 0; j < len(row); j++ {
+		if row[j] == row[j] {
+			stdev += (float64(row[j]) - mean) * (float64(row[j]) - mean)
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	return math.Sqrt(stdev / float64(n))
+}
 
-			// Minimize the error
-			r, _, _ := Minimize(f, [][]float64{[]float64{0.5, 0.2}, []float64{0.6, 0.2}, []float64{0.55, 0.75}}, nil)
+// calculateNoise fits the CV-vs-mean curve using the given method ("std" or "bands") and
+// returns the offset of each row from the fit, or nil if the method is unknown
+func calculateNoise(cef *Cef, noise string) []string {
+	// Calculate means and CVs
+	log2_m := make([]float64, cef.Rows)
+	log2_cv := make([]float64, cef.Rows)
+	for i := 0; i < cef.Rows; i++ {
+		row := cef.GetRow(i)
+		mu := rowMean(row)
+		log2_m[i] = math.Log2(mu)
+		if mu > 0.0 {
+			log2_cv[i] = math.Log2(rowStdev(row, mu) / mu)
+		} else {
+			log2_cv[i] = 0.0
+		}
+	}
 
-			// Calculate offset from the fit
-			f2 := func(log_mu float64) float64 {
-				return math.Log2(math.Pow(math.Pow(2, log_mu), -r[0]) + r[1])
-			}
-			fmt.Fprintf(os.Stderr, "log2(CV) = log2(mean^-%.2f) + %.2f\n", r[0], r[1])
+	// Least squares fit to the CV-vs-mean curve; below is the Python code from Gioele
 
-			noiseAttr := Attribute{"Noise", make([]string, cef.Rows)}
-			for i := 0; i < cef.Rows; i++ {
-				noiseAttr.Values[i] = strconv.FormatFloat(log2_cv[i]-f2(log2_m[i]), 'f', -1, 64)
-			}
-			cef.RowAttributes = append(cef.RowAttributes, noiseAttr)
-		} else if noise == "bands" {
-			// One-parameter model, minimum band ratio
-			const SLOPE = 0.54
-			f := func(x []float64) float64 {
-				sum := 0.0
-				count := 0.0
-				for ix := 0; ix < len(log2_m); ix++ {
-					if log2_m[ix] == 0.0 || log2_cv[ix] == 0.0 {
-						continue
-					}
-					dist := math.Log2(math.Pow(math.Pow(2, log2_m[ix]), -SLOPE)+x[0]) - log2_cv[ix]
-					if dist > 0 {
-						sum++
-					}
-					count++
+	// fun = lambda x, log2_m, log2_cv: sum(abs( log2( (2.**log2_m)**(-x[0])+x[1]) - log2_cv ))
+	// #Fit using Nelder-Mead algorythm
+	// optimization =  minimize(fun, x0, args=(log2_m,log2_cv), method='Nelder-Mead')
+	// params = optimization.x
+	// #The fitted function
+	// fitted_fun = lambda log_mu: log2( (2.**log_mu)**(-params[0]) + params[1])
+	// # Score is the relative position with respect of the fitted curve
+	// score = log2(cv) - fitted_fun(log2(mu))
+
+	// Two-parameter model, least absolute error
+	if noise == "std" {
+		f := func(x []float64) float64 {
+			sum := 0.0
+			for ix := 0; ix < len(log2_m); ix++ {
+				if log2_cv[ix] == 0.0 {
+					continue
 				}
-				//				fmt.Fprintf(os.Stderr, "f(%v) = %v\n", x[0], innersum/outersum)
-				return math.Abs(sum - count/2)
+				sum += math.Abs(math.Log2(math.Pow(math.Pow(2, log2_m[ix]), -x[0])+x[1]) - log2_cv[ix])
 			}
+			return sum
+		}
 
-			// Minimize the error
-			r, _, _ := Minimize(f, [][]float64{[]float64{0.4}, []float64{0.6}}, nil)
-
-			// Calculate offset from the fit
-			f2 := func(log_mu float64) float64 {
-				return math.Log2(math.Pow(math.Pow(2, log_mu), -SLOPE) + r[0])
-			}
-			fmt.Fprintf(os.Stderr, "log2(CV) = log2(mean^-%.2f) + %.2f\n", SLOPE, r[0])
+		// Minimize the error
+		r, _, _ := Minimize(f, [][]float64{[]float64{0.5, 0.2}, []float64{0.6, 0.2}, []float64{0.55, 0.75}}, nil)
 
-			noiseAttr := Attribute{"Noise", make([]string, cef.Rows)}
-			for i := 0; i < cef.Rows; i++ {
-				//			noiseAttr.Values[i] = strconv.FormatFloat(log2_cv[i]-f2(log2_m[i]), 'f', -1, 64)
-				noiseAttr.Values[i] = strconv.FormatFloat(log2_cv[i]-f2(log2_m[i]), 'f', -1, 64)
-			}
-			cef.RowAttributes = append(cef.RowAttributes, noiseAttr)
+		// Calculate offset from the fit
+		f2 := func(log_mu float64) float64 {
+			return math.Log2(math.Pow(math.Pow(2, log_mu), -r[0]) + r[1])
 		}
-	}
+		fmt.Fprintf(os.Stderr, "log2(CV) = log2(mean^-%.2f) + %.2f\n", r[0], r[1])
 
-	if stdev {
-		stdevAttr := Attribute{"Stdev", make([]string, cef.Rows)}
-		cef.RowAttributes = append(cef.RowAttributes, stdevAttr)
+		noiseValues := make([]string, cef.Rows)
 		for i := 0; i < cef.Rows; i++ {
-			row := cef.GetRow(i)
-			mean := 0.0
-			for j := 0; j < len(row); j++ {
-				mean = mean + float64(row[j])
-			}
-			mean = mean / float64(len(row))
-
-			stdev := 0.0
-			for j := 0; j < len(row); j++ {
-				stdev += (float64(row[j]) - mean) * (float64(row[j]) - mean)
+			noiseValues[i] = formatStatistic(log2_cv[i] - f2(log2_m[i]))
+		}
+		return noiseValues
+	} else if noise == "bands" {
+		// One-parameter model, minimum band ratio
+		const SLOPE = 0.54
+		f := func(x []float64) float64 {
+			sum := 0.0
+			count := 0.0
+			for ix := 0; ix < len(log2_m); ix++ {
+				if log2_m[ix] == 0.0 || log2_cv[ix] == 0.0 {
+					continue
+				}
+				dist := math.Log2(math.Pow(math.Pow(2, log2_m[ix]), -SLOPE)+x[0]) - log2_cv[ix]
+				if dist > 0 {
+					sum++
+				}
+				count++
 			}
-			stdevAttr.Values[i] = strconv.FormatFloat(math.Sqrt(stdev/float64(len(row))), 'f', -1, 64)
+			//				fmt.Fprintf(os.Stderr, "f(%v) = %v\n", x[0], innersum/outersum)
+			return math.Abs(sum - count/2)
 		}
-	}
 
-	if maxValue {
-		maxAttr := Attribute{"Max", make([]string, cef.Rows)}
-		cef.RowAttributes = append(cef.RowAttributes, maxAttr)
-		for i := 0; i < cef.Rows; i++ {
-			row := cef.GetRow(i)
-			max := float64(row[0])
-			for j := 0; j < len(row); j++ {
-				max = math.Max(max, float64(row[j]))
-			}
-			maxAttr.Values[i] = strconv.FormatFloat(max, 'f', -1, 64)
+		// Minimize the error
+		r, _, _ := Minimize(f, [][]float64{[]float64{0.4}, []float64{0.6}}, nil)
+
+		// Calculate offset from the fit
+		f2 := func(log_mu float64) float64 {
+			return math.Log2(math.Pow(math.Pow(2, log_mu), -SLOPE) + r[0])
 		}
-	}
-	if minValue {
-		minAttr := Attribute{"Min", make([]string, cef.Rows)}
-		cef.RowAttributes = append(cef.RowAttributes, minAttr)
+		fmt.Fprintf(os.Stderr, "log2(CV) = log2(mean^-%.2f) + %.2f\n", SLOPE, r[0])
+
+		noiseValues := make([]string, cef.Rows)
 		for i := 0; i < cef.Rows; i++ {
-			row := cef.GetRow(i)
-			min := float64(row[0])
-			for j := 0; j < len(row); j++ {
-				min = math.Min(min, float64(row[j]))
-			}
-			minAttr.Values[i] = strconv.FormatFloat(min, 'f', -1, 64)
+			noiseValues[i] = formatStatistic(log2_cv[i] - f2(log2_m[i]))
 		}
-	}
-	// Write the CEB file
-	if err := Write(cef, os.Stdout, bycol); err != nil {
-		return err
+		return noiseValues
 	}
 	return nil
 }
 
-func CmdRename(attr string, bycol bool) error {
+func CmdRename(in io.Reader, out io.Writer, attr string, bycol bool) error {
 	temp := strings.Split(attr, "=")
 	if len(temp) != 2 {
 		return errors.New("Invalid rename (should be --attr old=new)")
 	}
 
 	// Read the input
-	cef, err := Read(os.Stdin, bycol)
+	r, err := readRows(in, bycol)
 	if err != nil {
 		return err
 	}
 
 	// Rename
-	for i := 0; i < len(cef.RowAttributes); i++ {
-		if cef.RowAttributes[i].Name == temp[0] {
-			cef.RowAttributes[i].Name = temp[1]
+	template := withoutRowValues(r.Cef)
+	for i := 0; i < len(template.RowAttributes); i++ {
+		if template.RowAttributes[i].Name == temp[0] {
+			template.RowAttributes[i].Name = temp[1]
 			break // Rename only the first instance if there are multiple with same name
 		}
 	}
 
-	// Write the CEB file
-	if err := Write(cef, os.Stdout, bycol); err != nil {
+	// Write the result
+	w, err := writeRows(out, template, r, bycol)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer w.Abort()
+	for {
+		attrs, values, err := r.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.WriteRow(attrs, values); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// CmdTranspose exchanges rows and columns by flipping the Transposed flag, so the main
+// matrix is copied as it is stored, one row at a time
+func CmdTranspose(in io.Reader, out io.Writer) error {
+	r, err := NewReader(in)
+	if err != nil {
+		return err
+	}
+	template := withoutRowValues(r.Cef)
+	template.Flags ^= Transposed
+	w, err := NewWriter(out, template)
+	if err != nil {
+		return err
+	}
+	defer w.Abort()
+	for {
+		attrs, values, err := r.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.WriteRow(attrs, values); err != nil {
+			return err
+		}
+	}
+	return w.Close()
 }
 
-func CmdSort(sort_by string, sort_numerical bool, reverse bool, bycol bool) error {
+func CmdSort(in io.Reader, out io.Writer, sort_by string, sort_numerical bool, reverse bool, bycol bool) error {
 	// Read the input
-	cef, err := Read(os.Stdin, bycol)
+	cef, err := Read(in, bycol)
 	if err != nil {
 		return err
 	}
@@ -245,15 +344,15 @@ func CmdSort(sort_by string, sort_numerical bool, reverse bool, bycol bool) erro
 		return err
 	}
 	// Write the CEB file
-	if err := Write(result, os.Stdout, bycol); err != nil {
+	if err := Write(result, out, bycol); err != nil {
 		return err
 	}
 	return nil
 }
 
-func CmdSPIN(corrfile string, bycol bool) error {
+func CmdSPIN(in io.Reader, out io.Writer, corrfile string, bycol bool) error {
 	// Read the input
-	cef, err := Read(os.Stdin, bycol)
+	cef, err := Read(in, bycol)
 	if err != nil {
 		return err
 	}
@@ -261,19 +360,13 @@ func CmdSPIN(corrfile string, bycol bool) error {
 	cef.SPIN(10, int(math.Log2(float64(cef.Rows))+1), 2*float64(cef.Rows), 0.5, corrfile)
 
 	// Write the CEF file
-	if err := Write(cef, os.Stdout, bycol); err != nil {
+	if err := Write(cef, out, bycol); err != nil {
 		return err
 	}
 	return nil
 }
 
-func CmdSelect(selector string, bycol bool, except bool) error {
-	// Read the input
-	cef, err := Read(os.Stdin, bycol)
-	if err != nil {
-		return err
-	}
-
+func CmdSelect(in io.Reader, out io.Writer, selector string, bycol bool, except bool) error {
 	// Parse the selector
 	av := strings.Split(selector, "=")
 	if len(av) != 2 {
@@ -282,13 +375,28 @@ func CmdSelect(selector string, bycol bool, except bool) error {
 	attr := av[0]
 	value := av[1]
 
-	// Make empty slices reusing the existing storage
-	tempMatrix := cef.Matrix[:0]
-	tempRowAttrValues := make([]Attribute, len(cef.RowAttributes))
+	// Look up the rows directly if the input is a file with an up-to-date index on the attribute
+	if !bycol {
+		if ir := indexFor(in); ir != nil {
+			defer ir.Close()
+			if ir.Key() == attr {
+				rows, err := ir.Find(value)
+				if err != nil {
+					return err
+				}
+				return ir.writeRows(out, rows)
+			}
+		}
+	}
+
+	// Read the input
+	r, err := readRows(in, bycol)
+	if err != nil {
+		return err
+	}
 	attrIndex := -1
-	for i := 0; i < len(tempRowAttrValues); i++ {
-		tempRowAttrValues[i] = Attribute{cef.RowAttributes[i].Name, cef.RowAttributes[i].Values[:0]}
-		if cef.RowAttributes[i].Name == attr {
+	for i := 0; i < len(r.Cef.RowAttributes); i++ {
+		if r.Cef.RowAttributes[i].Name == attr {
 			attrIndex = i
 		}
 	}
@@ -296,40 +404,54 @@ func CmdSelect(selector string, bycol bool, except bool) error {
 		return errors.New("Attribute not found when attempting to select")
 	}
 
-	// Scan all rows for matches and append them
-	nSelected := 0
-	for i := 0; i < cef.Rows; i++ {
-		if cef.RowAttributes[attrIndex].Values[i] == value {
-			nSelected++
-			tempMatrix = append(tempMatrix, cef.GetRow(i)...)
-			for j := 0; j < len(cef.RowAttributes); j++ {
-				tempRowAttrValues[j].Values = append(tempRowAttrValues[j].Values, cef.RowAttributes[j].Values[i])
-			}
-		}
-	}
-
-	// Replace the orginals with the filtered copies
-	cef.Matrix = tempMatrix
-	for i := 0; i < len(cef.RowAttributes); i++ {
-		cef.RowAttributes[i] = tempRowAttrValues[i]
+	// The number of selected rows is not known until all rows have been scanned
+	template := withoutRowValues(r.Cef)
+	template.Rows = -1
+	w, err := writeRows(out, template, r, bycol)
+	if err != nil {
+		return err
 	}
-	cef.Rows = nSelected
+	defer w.Abort()
 
-	// Write the CEB file
-	if err := Write(cef, os.Stdout, bycol); err != nil {
-		return err
+	// Scan all rows for matches and write them
+	for {
+		attrs, values, err := r.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if attrs[attrIndex] == value {
+			if err := w.WriteRow(attrs, values); err != nil {
+				return err
+			}
+		}
 	}
-	return nil
+	return w.Close()
 }
 
-func CmdSelectRange(from int, to int, bycol bool, except bool) error {
-	// Read the input
-	cef, err := Read(os.Stdin, bycol)
-	if err != nil {
-		return err
+func CmdSelectRange(in io.Reader, out io.Writer, from int, to int, bycol bool, except bool) error {
+	// Read the input, or just the selected rows if the input is a file with an up-to-date index
+	var ir *IndexedReader
+	if !bycol && !except {
+		ir = indexFor(in)
+	}
+	var r *Reader
+	var nRows int
+	if ir != nil {
+		defer ir.Close()
+		nRows = ir.Cef.Rows
+	} else {
+		var err error
+		r, err = readRows(in, bycol)
+		if err != nil {
+			return err
+		}
+		nRows = r.Cef.Rows
 	}
 	if to == -1 {
-		to = cef.Rows
+		to = nRows
 	}
 	if to < from {
 		temp := to
@@ -339,61 +461,69 @@ func CmdSelectRange(from int, to int, bycol bool, except bool) error {
 	if from < 1 {
 		from = 1
 	}
-	if from > cef.Rows {
-		from = cef.Rows
+	if from > nRows {
+		from = nRows
 	}
 	if to < 1 {
 		to = 1
 	}
-	if to > cef.Rows {
-		to = cef.Rows
+	if to > nRows {
+		to = nRows
 	}
 
-	// Truncate the matrix
-	if except {
-		// Set the matrix to the first segment
-		temp := cef.Matrix[:(from-1)*cef.Columns]
-		// Add the remaining segment
-		for i := to; i < cef.Rows; i++ {
-			temp = append(temp, cef.GetRow(i)...)
-		}
-		cef.Matrix = temp
-
-		// And same for row attributes
-		for i := 0; i < len(cef.RowAttributes); i++ {
-			temp2 := cef.RowAttributes[i].Values[:(from - 1)]
-			temp2 = append(temp2, cef.RowAttributes[i].Values[to:]...)
-			cef.RowAttributes[i].Values = temp2
+	// Count the selected rows (numbered from 1)
+	nSelected := 0
+	if from >= 1 && to >= from {
+		nSelected = to - from + 1
+	}
+	if ir != nil {
+		rows := make([]int, nSelected)
+		for i := 0; i < nSelected; i++ {
+			rows[i] = from - 1 + i
 		}
-		cef.Rows = cef.Rows - (to - from + 1)
+		return ir.writeRows(out, rows)
+	}
+	template := withoutRowValues(r.Cef)
+	if except {
+		template.Rows = nRows - nSelected
 	} else {
-		cef.Rows = to - from + 1
-		cef.Matrix = cef.Matrix[(from-1)*cef.Columns : to*cef.Columns]
-		for i := 0; i < len(cef.RowAttributes); i++ {
-			cef.RowAttributes[i].Values = cef.RowAttributes[i].Values[from-1 : to]
-		}
+		template.Rows = nSelected
 	}
-
-	// Write the CEB file
-	if err := Write(cef, os.Stdout, bycol); err != nil {
+	w, err := writeRows(out, template, r, bycol)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer w.Abort()
+
+	// Write the rows inside (or outside) the range
+	for i := 1; ; i++ {
+		if !except && i > to {
+			break
+		}
+		attrs, values, err := r.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if (i >= from && i <= to) != except {
+			if err := w.WriteRow(attrs, values); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Close()
 }
 
-func CmdJoin(other string, on string, bycol bool) error {
+func CmdJoin(in io.Reader, out io.Writer, other string, on string, mode string, bycol bool) error {
 	// Read the input
-	left, err := Read(os.Stdin, bycol)
+	left, err := Read(in, bycol)
 	if err != nil {
 		return err
 	}
 	// Read the right (to be joined)
-	f, err := os.Open(other)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	right, err := Read(f, bycol)
+	right, err := ReadFile(other, bycol)
 	if err != nil {
 		return err
 	}
@@ -402,84 +532,133 @@ func CmdJoin(other string, on string, bycol bool) error {
 	if len(attrs) != 2 {
 		return errors.New("--on 'attr1=attr2' was incorrectly specified")
 	}
-	cef, err := left.Join(right, attrs[0], attrs[1])
+	keepLeft := mode == "left" || mode == "outer"
+	keepRight := mode == "right" || mode == "outer"
+	if mode != "inner" && !keepLeft && !keepRight {
+		return errors.New("Unknown join mode: " + mode)
+	}
+	cef, err := left.JoinOuter(right, attrs[0], attrs[1], keepLeft, keepRight)
 	if err != nil {
 		return err
 	}
 	// Write the CEB file
-	if err := Write(cef, os.Stdout, bycol); err != nil {
+	if err := Write(cef, out, bycol); err != nil {
 		return err
 	}
 	return nil
 }
 
-func CmdAdd(attr string, header string, bycol bool) error {
+func CmdAdd(in io.Reader, out io.Writer, attr string, header string, bycol bool) error {
 	// Read the input
-	var cef, err = Read(os.Stdin, bycol)
+	r, err := readRows(in, bycol)
 	if err != nil {
 		return err
 	}
 
+	template := withoutRowValues(r.Cef)
+	var nv []string
 	if attr != "" {
-		nv := strings.Split(attr, "=")
+		nv = strings.Split(attr, "=")
 		if len(nv) != 2 {
 			return errors.New("Invalid 'Name=value' string when attempting to add attribute")
 		}
-		newAttr := Attribute{nv[0], make([]string, cef.Rows)}
-		for i := 0; i < cef.Rows; i++ {
-			if nv[1] == "(row)" {
-				newAttr.Values[i] = strconv.Itoa(int(i + 1))
-			} else {
-				newAttr.Values[i] = nv[1]
-			}
-		}
-		cef.RowAttributes = append(cef.RowAttributes, newAttr)
+		template.RowAttributes = append(template.RowAttributes, Attribute{nv[0], nil})
 	}
 	if header != "" {
-		nv := strings.Split(header, "=")
-		if len(nv) != 2 {
+		hv := strings.Split(header, "=")
+		if len(hv) != 2 {
 			return errors.New("Invalid 'Name=value' string when attempting to add header")
 		}
-		newHdr := Header{nv[0], nv[1]}
-		cef.Headers = append(cef.Headers, newHdr)
+		newHdr := Header{hv[0], hv[1]}
+		template.Headers = append(template.Headers, newHdr)
 	}
 
 	// Write the result
-	if err := Write(cef, os.Stdout, bycol); err != nil {
+	w, err := writeRows(out, template, r, bycol)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer w.Abort()
+	for i := 0; ; i++ {
+		attrs, values, err := r.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if nv != nil {
+			if nv[1] == "(row)" {
+				attrs = append(attrs, strconv.Itoa(int(i+1)))
+			} else {
+				attrs = append(attrs, nv[1])
+			}
+		}
+		if err := w.WriteRow(attrs, values); err != nil {
+			return err
+		}
+	}
+	return w.Close()
 }
-func CmdDrop(attrs string, headers string, except bool, bycol bool) error {
+func CmdDrop(in io.Reader, out io.Writer, attrs string, headers string, except bool, bycol bool) error {
 	// Read the input
-	var cef, err = Read(os.Stdin, bycol)
+	r, err := readRows(in, bycol)
 	if err != nil {
 		return err
 	}
+	template := withoutRowValues(r.Cef)
+	var keep []int
 	if attrs != "" {
-		dropAttrs(cef, attrs, except)
+		keep = keptAttrs(template, attrs, except)
+		temp := make([]Attribute, 0, len(keep))
+		for _, ix := range keep {
+			temp = append(temp, template.RowAttributes[ix])
+		}
+		template.RowAttributes = temp
 	}
 	if headers != "" {
-		dropHeaders(cef, headers, except)
+		dropHeaders(template, headers, except)
 	}
 
 	// Write the result
-	if err := Write(cef, os.Stdout, bycol); err != nil {
+	w, err := writeRows(out, template, r, bycol)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer w.Abort()
+	for {
+		values, row, err := r.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if keep != nil {
+			temp := make([]string, 0, len(keep))
+			for _, ix := range keep {
+				temp = append(temp, values[ix])
+			}
+			values = temp
+		}
+		if err := w.WriteRow(values, row); err != nil {
+			return err
+		}
+	}
+	return w.Close()
 }
 
-func dropAttrs(cef *Cef, attrs string, except bool) {
-	// Drop the attributes
+// keptAttrs returns the indexes of the row attributes that remain after dropping the
+// given (comma-separated) attributes
+func keptAttrs(cef *Cef, attrs string, except bool) []int {
 	todrop := strings.Split(attrs, ",")
-	temp := cef.RowAttributes[:0]
-	for _, att := range cef.RowAttributes {
+	keep := make([]int, 0)
+	for i, att := range cef.RowAttributes {
 		if contains(todrop, att.Name) == except {
-			temp = append(temp, att)
+			keep = append(keep, i)
 		}
 	}
-	cef.RowAttributes = temp
+	return keep
 }
 
 func dropHeaders(cef *Cef, headers string, except bool) {
@@ -504,22 +683,21 @@ func contains(s []string, e string) bool {
 	return false
 }
 
-func CmdRescale(method string, length_attr string, bycol bool) error {
-	// Read the input
-	var cef, err = Read(os.Stdin, bycol)
-	if err != nil {
-		return err
-	}
-
+// rescaler returns a function that rescales a row in place by the given method, using
+// the row attribute lengthIndex (-1 if not given) as the gene length for rpkm
+func rescaler(method string, lengthIndex int) func(attrs []string, row []float32) error {
 	log_rescale := func(vals []float32) {
 		for i := 0; i < len(vals); i++ {
 			vals[i] = float32(math.Log10(float64(vals[i] + 1)))
 		}
 	}
+	// Missing values are left out of the sums, and stay missing
 	tpm_rescale := func(vals []float32) {
 		sum := float32(0)
 		for i := 0; i < len(vals); i++ {
-			sum += vals[i]
+			if vals[i] == vals[i] {
+				sum += vals[i]
+			}
 		}
 		if sum != 0 {
 			for i := 0; i < len(vals); i++ {
@@ -530,7 +708,9 @@ func CmdRescale(method string, length_attr string, bycol bool) error {
 	rpkm_rescale := func(vals []float32, length float32) {
 		sum := float32(0)
 		for i := 0; i < len(vals); i++ {
-			sum += vals[i]
+			if vals[i] == vals[i] {
+				sum += vals[i]
+			}
 		}
 		if length == 0 {
 			length = 1
@@ -541,49 +721,439 @@ func CmdRescale(method string, length_attr string, bycol bool) error {
 			}
 		}
 	}
-	var length []string
-	if length_attr != "" {
-		for i := 0; i < len(cef.RowAttributes); i++ {
-			if cef.RowAttributes[i].Name == length_attr {
-				length = cef.RowAttributes[i].Values
-			}
-		}
-		if length == nil {
-			return errors.New("Length attribute not found when attempting to rescale by rpkm")
-		}
-	}
-	for i := 0; i < cef.Rows; i++ {
+	return func(attrs []string, row []float32) error {
 		switch method {
 		case "log":
-			log_rescale(cef.GetRow(i))
+			log_rescale(row)
 			break
 		case "tpm":
-			tpm_rescale(cef.GetRow(i))
+			tpm_rescale(row)
 		case "rpkm":
-			bp, err := strconv.Atoi(length[i])
+			if lengthIndex == -1 {
+				return errors.New("Length attribute must be given when attempting to rescale by rpkm")
+			}
+			bp, err := strconv.Atoi(attrs[lengthIndex])
 			if err != nil {
 				return errors.New("Length attribute was not a valid integer (when attempting to rescale by rpkm)")
 			}
-			rpkm_rescale(cef.GetRow(i), float32(bp)/1000)
+			rpkm_rescale(row, float32(bp)/1000)
+		}
+		return nil
+	}
+}
+
+// findLengthAttr returns the index of the gene length attribute (-1 if not given)
+func findLengthAttr(cef *Cef, length_attr string) (int, error) {
+	lengthIndex := -1
+	if length_attr != "" {
+		for i := 0; i < len(cef.RowAttributes); i++ {
+			if cef.RowAttributes[i].Name == length_attr {
+				lengthIndex = i
+			}
+		}
+		if lengthIndex == -1 {
+			return -1, errors.New("Length attribute not found when attempting to rescale by rpkm")
+		}
+	}
+	return lengthIndex, nil
+}
+
+func CmdRescale(in io.Reader, out io.Writer, method string, length_attr string, bycol bool) error {
+	// Read the input
+	r, err := readRows(in, bycol)
+	if err != nil {
+		return err
+	}
+	lengthIndex, err := findLengthAttr(r.Cef, length_attr)
+	if err != nil {
+		return err
+	}
+	rescale := rescaler(method, lengthIndex)
+	w, err := writeRows(out, withoutRowValues(r.Cef), r, bycol)
+	if err != nil {
+		return err
+	}
+	defer w.Abort()
+	for {
+		attrs, row, err := r.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := rescale(attrs, row); err != nil {
+			return err
+		}
+		if err := w.WriteRow(attrs, row); err != nil {
+			return err
 		}
 	}
 
 	// Write the result
-	if err := Write(cef, os.Stdout, bycol); err != nil {
+	return w.Close()
+}
+
+// CmdRescaleInPlace rescales the rows (or columns) of an uncompressed CEB file in place, by
+// memory-mapping it. This is fastest when they are stored contiguously (see the Transposed flag).
+func CmdRescaleInPlace(path string, method string, length_attr string, bycol bool) error {
+	cef, err := ReadMapped(path, true)
+	if err != nil {
+		return err
+	}
+	defer cef.Close()
+	if old := checksumValue(cef.Headers); cef.checksumAt != 0 && (!strings.HasPrefix(old, checksumPrefix) || len(old) != len(checksumPrefix)+8) {
+		return errors.New("Cannot update a checksum of unknown format in place: " + old)
+	}
+	data := cef
+	if bycol {
+		data = cef.Transpose()
+	}
+	lengthIndex, err := findLengthAttr(data, length_attr)
+	if err != nil {
+		return err
+	}
+	rescale := rescaler(method, lengthIndex)
+	attrs := make([]string, len(data.RowAttributes))
+	for i := 0; i < data.Rows; i++ {
+		for j := 0; j < len(attrs); j++ {
+			attrs[j] = data.RowAttributes[j].Values[i]
+		}
+
+		// Rows stored contiguously are rescaled directly in the file; others are copied back
+		row := data.GetRow(i)
+		if err := rescale(attrs, row); err != nil {
+			return err
+		}
+		if data.Flags&Transposed != 0 {
+			for j, v := range row {
+				data.Set(i, j, v)
+			}
+		}
+	}
+	if err := cef.updateChecksum(); err != nil {
+		return err
+	}
+	return cef.Close()
+}
+
+func CmdImportMtx(in io.Reader, out io.Writer, rowsFile string, columnsFile string) error {
+	var rowAttrs, colAttrs io.Reader
+	if rowsFile != "" {
+		f, err := os.Open(rowsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rowAttrs = f
+	}
+	if columnsFile != "" {
+		f, err := os.Open(columnsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		colAttrs = f
+	}
+	cef, err := ReadMtx(in, rowAttrs, colAttrs, false)
+	if err != nil {
+		return err
+	}
+	return Write(cef, out, false)
+}
+
+func CmdExportMtx(in io.Reader, out io.Writer, rowsFile string, columnsFile string, bycol bool) error {
+	cef, err := Read(in, false)
+	if err != nil {
+		return err
+	}
+	var rowAttrs, colAttrs io.Writer
+	if rowsFile != "" {
+		f, err := os.Create(rowsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rowAttrs = f
+	}
+	if columnsFile != "" {
+		f, err := os.Create(columnsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		colAttrs = f
+	}
+	w, err := compress(out)
+	if err != nil {
+		return err
+	}
+	if err := WriteMtx(cef, w, rowAttrs, colAttrs, bycol); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func CmdImportTenx(out io.Writer, dir string, split string) error {
+	cef, err := ReadTenx(dir, false)
+	if err != nil {
+		return err
+	}
+	if split == "" {
+		return Write(cef, out, false)
+	}
+
+	// Write each feature type to a separate file
+	featureTypes, parts, err := cef.splitRows("FeatureType")
+	if err != nil {
+		return err
+	}
+	ext := ".cef"
+	if BinaryOutput {
+		ext = ".ceb"
+	}
+	// Feature types come from the input, so they must not name a file elsewhere
+	safe := strings.NewReplacer(" ", "_", "/", "_", "\\", "_")
+	names := make([]string, len(featureTypes))
+	written := make(map[string]string)
+	for i, featureType := range featureTypes {
+		if strings.TrimSpace(featureType) == "" {
+			return errors.New("Cannot split by an empty feature type")
+		}
+		names[i] = split + safe.Replace(featureType) + ext
+		if other, ok := written[names[i]]; ok {
+			return errors.New(fmt.Sprintf("The feature types '%v' and '%v' would both be written to %v", other, featureType, names[i]))
+		}
+		written[names[i]] = featureType
+	}
+	for i := range featureTypes {
+		if err := WriteFile(parts[i], names[i], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func CmdImportTable(in io.Reader, out io.Writer, delimiter string, rowAttrs int, colAttrs int, names bool, comments []string, quotes bool) error {
+	sep, err := ParseDelimiter(delimiter)
+	if err != nil {
+		return err
+	}
+	cef, err := ReadTable(in, sep, rowAttrs, colAttrs, names, comments, quotes, false)
+	if err != nil {
+		return err
+	}
+	return Write(cef, out, false)
+}
+
+func CmdExportTable(in io.Reader, out io.Writer, format string, attrs string, colAttrs string, long bool, bycol bool) error {
+	delimiter := '\t'
+	if format == "csv" {
+		delimiter = ','
+	}
+	r, err := readRows(in, bycol)
+	if err != nil {
+		return err
+	}
+	var rowNames, colNames []string
+	if attrs != "" {
+		rowNames = strings.Split(attrs, ",")
+	}
+	if colAttrs != "" {
+		colNames = strings.Split(colAttrs, ",")
+	}
+	return WriteTable(r, out, delimiter, rowNames, colNames, long)
+}
+
+// CmdImportZarr imports a Zarr v2 directory store (see ReadZarr)
+func CmdImportZarr(out io.Writer, dir string) error {
+	cef, err := ReadZarr(dir, false)
+	if err != nil {
+		return err
+	}
+	return Write(cef, out, false)
+}
+
+// CmdExportZarr writes the input as a Zarr v2 directory store (see WriteZarr)
+func CmdExportZarr(in io.Reader, dir string, bycol bool) error {
+	cef, err := Read(in, bycol)
+	if err != nil {
+		return err
+	}
+	return WriteZarr(cef, dir, false)
+}
+
+// CmdExportArrow writes the input as an Arrow IPC file, in the wide or long layout (see
+// WriteArrow). Like other containers, it is never compressed.
+func CmdExportArrow(in io.Reader, out io.Writer, long bool, bycol bool) error {
+	cef, err := Read(in, bycol)
+	if err != nil {
+		return err
+	}
+	return WriteArrow(cef, out, long, false)
+}
+
+// CmdExportXlsx writes the input as an Excel workbook (see WriteXlsx), which is never compressed
+func CmdExportXlsx(in io.Reader, out io.Writer, maxRows int, maxColumns int, bycol bool) error {
+	cef, err := Read(in, bycol)
+	if err != nil {
+		return err
+	}
+	return WriteXlsx(cef, out, maxRows, maxColumns, false)
+}
+
+// CmdExportCls writes the phenotype labels of the columns (or rows) as a CLS file. Only the
+// column attributes are needed, so the main matrix is not read unless it must be transposed.
+func CmdExportCls(in io.Reader, out io.Writer, class string, bycol bool) error {
+	r, err := readRows(in, bycol)
+	if err != nil {
+		return err
+	}
+	w, err := compress(out)
+	if err != nil {
+		return err
+	}
+	if err := WriteCls(r.Cef, w, class, false); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// CmdConvert converts the input from one registered format to another (see RegisterFormat).
+// If from is empty, the input format is detected from its content or, failing that, the
+// input file name. If to is empty, the output format is detected from the output file
+// name, and is otherwise CEF (or CEB, if BinaryOutput is set).
+func CmdConvert(in io.Reader, out io.Writer, from string, to string, inPath string, outPath string, bycol bool) error {
+	r, err := decompress(in)
+	if err != nil {
+		return err
+	}
+	var reader *Format
+	if from != "" {
+		if reader, err = findFormat(from, false); err != nil {
+			return err
+		}
+	} else {
+		magic, _ := r.Peek(sniffLength)
+		if reader = DetectFormat(magic, inPath); reader == nil || reader.Read == nil {
+			return errors.New(fmt.Sprintf("Unknown input format (use --from to give one of %v)", formatNames(false)))
+		}
+	}
+	var writer *Format
+	if to != "" {
+		if writer, err = findFormat(to, true); err != nil {
+			return err
+		}
+	} else if writer = DetectFormat(nil, outPath); writer == nil {
+		writer = LookupFormat("cef")
+		if BinaryOutput {
+			writer = LookupFormat("ceb")
+		}
+	} else if writer.Write == nil {
+		return errors.New(fmt.Sprintf("Format '%v' cannot be written (use --to to give one of %v)", writer.Name, formatNames(true)))
+	}
+
+	cef, err := reader.Read(r, bycol)
+	if err != nil {
 		return err
 	}
+	if writer.Container {
+		return writer.Write(cef, out, false)
+	}
+	w, err := compress(out)
+	if err != nil {
+		return err
+	}
+	if err := writer.Write(cef, w, false); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// CmdFormats lists the registered formats
+func CmdFormats(out io.Writer) error {
+	for _, format := range Formats() {
+		modes := ""
+		if format.Read != nil {
+			modes += "r"
+		}
+		if format.Write != nil {
+			modes += "w"
+		}
+		if _, err := fmt.Fprintf(out, "%-8v %-3v %-16v %v\n", format.Name, modes, strings.Join(format.Extensions, " "), format.Description); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func CmdImportStrt() error {
-	cef, err := ReadStrt(os.Stdin, false)
+// CmdValidate reports the problems found in the input (at most limit of them, if limit is
+// positive), and returns an error if there are errors (or, if strict, warnings)
+func CmdValidate(in io.Reader, out io.Writer, limit int, strict bool) error {
+	reported := 0
+	nErrors, nWarnings, err := Validate(in, func(p Problem) {
+		if limit <= 0 || reported < limit {
+			fmt.Fprintln(out, p)
+		}
+		reported++
+	})
 	if err != nil {
 		return err
 	}
+	if limit > 0 && reported > limit {
+		fmt.Fprintf(out, "(%v more problems not shown)\n", reported-limit)
+	}
+	fmt.Fprintf(out, "%v errors, %v warnings\n", nErrors, nWarnings)
+	if nErrors > 0 || (strict && nWarnings > 0) {
+		return errors.New("Validation failed")
+	}
+	return nil
+}
 
-	// Write the CEB file
-	if err := Write(cef, os.Stdout, false); err != nil {
+// CmdHistory writes the processing steps recorded in the input, in order
+func CmdHistory(in io.Reader, out io.Writer) error {
+	r, err := NewReader(in)
+	if err != nil {
 		return err
 	}
+	return WriteHistory(r.Cef, out)
+}
+
+// CmdVerify recomputes the checksum of the input, and returns an error if it does not
+// match the one recorded in the file (or there is none)
+func CmdVerify(in io.Reader, out io.Writer) error {
+	r, err := NewReader(in)
+	if err != nil {
+		return err
+	}
+	expected := checksumValue(r.Cef.Headers)
+	if expected == "" {
+		return errors.New("The file has no checksum")
+	}
+	if r.sum == nil {
+		return matchChecksum(expected, "")
+	}
+	r.expected = "" // Compared below instead
+	for {
+		_, _, err := r.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	found := r.sum.String()
+	if err := matchChecksum(expected, found); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Checksum OK (%v)\n", found)
 	return nil
 }
+
+func CmdIndex(path string, key string) error {
+	return WriteIndexFile(path, key)
+}
@@ -0,0 +1,67 @@
+package ceftools
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"io"
+	"runtime"
+)
+
+// Compression selects the compression applied to the output of Write ("", "gzip" or "zstd")
+var Compression = ""
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompress returns a buffered reader over the input, transparently decompressing
+// it if it starts with the gzip or zstd magic bytes
+func decompress(f io.Reader) (*bufio.Reader, error) {
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(4)
+	if bytes.HasPrefix(magic, gzipMagic) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return bufio.NewReader(gz), nil
+	}
+	if bytes.HasPrefix(magic, zstdMagic) {
+		// A single-threaded decoder runs synchronously and needs no explicit Close
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return bufio.NewReader(zr), nil
+	}
+	return r, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compress wraps the output in a compressor as selected by Compression. The
+// compressors use all available cores. Closing the result does not close f.
+func compress(f io.Writer) (io.WriteCloser, error) {
+	switch Compression {
+	case "":
+		return nopWriteCloser{f}, nil
+	case "gzip":
+		gz := pgzip.NewWriter(f)
+		if err := gz.SetConcurrency(1<<20, runtime.NumCPU()); err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case "zstd":
+		return zstd.NewWriter(f, zstd.WithEncoderConcurrency(runtime.NumCPU()))
+	}
+	return nil, errors.New("Unknown compression (should be 'gzip' or 'zstd'): " + Compression)
+}
@@ -2,6 +2,7 @@ package ceftools
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/csv"
 	"errors"
 	"fmt"
@@ -11,105 +12,100 @@ import (
 	"strconv"
 )
 
-func Write(cef *Cef, f *os.File, transposed bool) error {
-	w := csv.NewWriter(f)
-	w.Comma = '\t'
-	write := func(row []string) {
-		w.Write(row)
-		for i := 0; i < len(row); i++ {
-			row[i] = ""
-		}
+func Write(cef *Cef, f io.Writer, transposed bool) error {
+	out, err := compress(f)
+	if err != nil {
+		return err
 	}
-
-	// Make a vector to hold each line (we'll reuse it)
-	var row []string
-	if transposed {
-		row = make([]string, int(math.Max(7, float64(cef.Rows+len(cef.ColumnAttributes)+1))))
+	if BinaryOutput {
+		err = WriteCeb(cef, out, transposed)
 	} else {
-		row = make([]string, int(math.Max(7, float64(cef.Columns+len(cef.RowAttributes)+1))))
+		err = writeCef(cef, out, transposed)
 	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
 
-	// Write the header line
-	row[0] = "CEF"
-	row[1] = strconv.Itoa(len(cef.Headers))
-	row[2] = strconv.Itoa(len(cef.RowAttributes))
-	row[3] = strconv.Itoa(len(cef.ColumnAttributes))
-	row[4] = strconv.Itoa(cef.Rows)
-	row[5] = strconv.Itoa(cef.Columns)
-	row[6] = strconv.Itoa(cef.Flags)
+// The rows of the main matrix are formatted in parallel in batches of this many rows
+const writeBatchRows = 256
+
+// storedFlags returns the flags to write for the Cef, or for its transpose if requested
+func storedFlags(cef *Cef, transposed bool) int {
 	if transposed {
-		row[2] = strconv.Itoa(len(cef.ColumnAttributes))
-		row[3] = strconv.Itoa(len(cef.RowAttributes))
-		row[4] = strconv.Itoa(cef.Columns)
-		row[5] = strconv.Itoa(cef.Rows)
+		return cef.Flags ^ Transposed
 	}
-	write(row)
+	return cef.Flags
+}
 
-	// Write the headers
-	for i := 0; i < len(cef.Headers); i++ {
-		row[0] = cef.Headers[i].Name
-		row[1] = cef.Headers[i].Value
-		write(row)
-	}
+func writeCef(cef *Cef, f io.Writer, transposed bool) error {
+	w := bufio.NewWriterSize(f, 1<<16)
 
-	ralen := len(cef.RowAttributes)
-	calen := len(cef.ColumnAttributes)
+	// The main matrix is written as it is stored, and the Transposed flag tells which way
+	flags := storedFlags(cef, transposed)
+	cef = cef.storage()
+	rowAttrs := cef.RowAttributes
+	nRows := cef.Rows
+	getRow := cef.GetRow
+	width := lineWidth(cef.Columns, len(rowAttrs))
 
-	if transposed {
-		// Write the column attributes (from row attrs)
-		for i := 0; i < ralen; i++ {
-			row[calen] = cef.RowAttributes[i].Name
-			for j := 0; j < cef.Rows; j++ {
-				row[j+calen+1] = cef.RowAttributes[i].Values[j]
-			}
-			write(row)
-		}
+	// Write the header line, headers and attributes
+	if _, err := w.Write(appendPreamble(nil, withHistory(withChecksum(withPrecision(cef.Headers), storedChecksum(cef, flags, true))), rowAttrs, cef.ColumnAttributes, nRows, cef.Columns, flags, width)); err != nil {
+		return err
+	}
 
-		// Write the row attributes and matrix
-		for i := 0; i < calen; i++ {
-			row[i] = cef.ColumnAttributes[i].Name
-		}
-		write(row)
-		for i := 0; i < cef.Columns; i++ {
-			for j := 0; j < calen; j++ {
-				row[j] = cef.ColumnAttributes[j].Values[i]
-				for k := 0; k < cef.Rows; k++ {
-					row[k+calen+1] = strconv.FormatFloat(float64(cef.Get(k, i)), 'f', -1, 64)
-				}
+	// Write the rows, formatting batches of rows in parallel if enabled
+	format := func(buf []byte, from int, to int) []byte {
+		attrs := make([]string, len(rowAttrs))
+		for i := from; i < to; i++ {
+			for j := 0; j < len(attrs); j++ {
+				attrs[j] = rowAttrs[j].Values[i]
 			}
-			write(row)
+			buf = appendRow(buf, attrs, getRow(i), width)
 		}
-	} else {
-		// Write the column attributes
-		for i := 0; i < calen; i++ {
-			row[ralen] = cef.ColumnAttributes[i].Name
-			for j := 0; j < cef.Columns; j++ {
-				row[j+ralen+1] = cef.ColumnAttributes[i].Values[j]
+		return buf
+	}
+	nThreads := threads()
+	if nThreads == 1 {
+		var buf []byte
+		for i := 0; i < nRows; i++ {
+			buf = format(buf[:0], i, i+1)
+			if _, err := w.Write(buf); err != nil {
+				return err
 			}
-			write(row)
-		}
-
-		// Write the row attributes and matrix
-		for i := 0; i < ralen; i++ {
-			row[i] = cef.RowAttributes[i].Name
 		}
-		write(row)
-		for i := 0; i < cef.Rows; i++ {
-			for j := 0; j < ralen; j++ {
-				row[j] = cef.RowAttributes[j].Values[i]
-				for k := 0; k < cef.Columns; k++ {
-					row[k+ralen+1] = strconv.FormatFloat(float64(cef.Get(i, k)), 'f', -1, 64)
-				}
+		return w.Flush()
+	}
+	bufs := make([][]byte, nThreads*chunksPerThread)
+	for start := 0; start < nRows; start += len(bufs) * writeBatchRows {
+		parallelFor(len(bufs), nThreads, func(k int) {
+			from := start + k*writeBatchRows
+			to := from + writeBatchRows
+			if to > nRows {
+				to = nRows
+			}
+			bufs[k] = bufs[k][:0]
+			if from < to {
+				bufs[k] = format(bufs[k], from, to)
+			}
+		})
+		for k := 0; k < len(bufs); k++ {
+			if _, err := w.Write(bufs[k]); err != nil {
+				return err
 			}
-			write(row)
 		}
 	}
-	w.Flush()
-	return nil
+	return w.Flush()
 }
 
-func ReadStrt(f *os.File, transposed bool) (*Cef, error) {
-	var r = csv.NewReader(f)
+func ReadStrt(f io.Reader, transposed bool) (*Cef, error) {
+	in, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	var r = csv.NewReader(in)
 	r.Comma = '\t'
 	r.FieldsPerRecord = -1
 
@@ -187,18 +183,18 @@ func ReadStrt(f *os.File, transposed bool) (*Cef, error) {
 		}
 		values := make([]float32, cef.Columns)
 		for i := 0; i < cef.Columns; i++ {
-			value, err := strconv.ParseFloat(row[i+nRowAttrs], 32)
+			value, err := parseValue(row[i+nRowAttrs])
 			if err != nil {
 				return nil, errors.New(fmt.Sprintf("Error parsing value in row %v, column %v", nRows, i+1))
 			}
-			values[i] = float32(value)
+			values[i] = value
 		}
 		cef.Matrix = append(cef.Matrix, values...)
 	}
 	return cef, nil
 }
 
-func Read_old(f *os.File, transposed bool) (*Cef, error) {
+func Read_old(f io.Reader, transposed bool) (*Cef, error) {
 	var r = csv.NewReader(f)
 	r.Comma = '\t'
 	r.FieldsPerRecord = -1
@@ -324,47 +320,103 @@ func Read_old(f *os.File, transposed bool) (*Cef, error) {
 	return cef, nil
 }
 
-func nextString(f *bufio.Reader) string {
+// nextString reads the next field of a line, unescaping it (see appendField), or unquoting
+// it if LegacyQuoting is set
+func nextString(f *bufio.Reader) (string, error) {
+	s, _, err := readField(f)
+	return s, err
+}
+
+// readField reads the next field of a line as nextString does, and reports whether the line
+// continues after it (that is, whether the field ends with a tab)
+func readField(f *bufio.Reader) (string, bool, error) {
 	result := make([]rune, 0, 10)
+	start := true
+	quoted := false
 	for {
 		r, _, err := f.ReadRune()
 		if err != nil {
-			panic(err.Error())
+			// A missing newline at the end of the file is tolerated, and truncated
+			// files are reported by the caller when fields turn out to be missing
+			if err == io.EOF {
+				return string(result), false, nil
+			}
+			return "", false, err
+		}
+		if quoted {
+			// Inside quotes, a doubled quote stands for a quote and anything else is literal
+			if r == '"' {
+				if next, _, err := f.ReadRune(); err == nil && next == '"' {
+					result = append(result, '"')
+					continue
+				} else if err == nil {
+					f.UnreadRune()
+				}
+				quoted = false
+				continue
+			}
+			result = append(result, r)
+			continue
+		}
+		if r == '"' && start && LegacyQuoting {
+			quoted = true
+			start = false
+			continue
+		}
+		start = false
+		if r == '\\' && !LegacyQuoting {
+			next, _, err := f.ReadRune()
+			if err == nil && next < 128 && unescape(byte(next)) != 0 {
+				result = append(result, rune(unescape(byte(next))))
+				continue
+			}
+			if err == nil {
+				f.UnreadRune()
+			}
 		}
 		if r == '\t' {
-			return string(result)
+			return string(result), true, nil
 		}
 		if r == '\r' || r == '\n' {
 			f.UnreadRune()
-			return string(result)
+			return string(result), false, nil
 		}
 		result = append(result, r)
 	}
 }
 
-func readStrings(f *bufio.Reader, n int) []string {
+func readStrings(f *bufio.Reader, n int) ([]string, error) {
 	result := make([]string, n)
 	for i := 0; i < n; i++ {
-		result[i] = nextString(f)
+		s, err := nextString(f)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = s
 	}
-	return result
+	return result, nil
 }
 
-func skipFields(f *bufio.Reader, n int) {
+func skipFields(f *bufio.Reader, n int) error {
 	for i := 0; i < n; i++ {
-		nextString(f)
+		if _, err := nextString(f); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func nextLine(f *bufio.Reader) {
+// nextLine skips to the start of the next non-empty line, and returns the number of
+// line breaks skipped ('\r\n' counts as one)
+func nextLine(f *bufio.Reader) (int, error) {
 	// Consume whitespace
 	for {
 		r, _, err := f.ReadRune()
 		if err != nil {
 			if err == io.EOF {
-				return
+				return 0, nil
 			}
-			panic(err.Error())
+			return 0, err
 		}
 		if r != ' ' && r != '\t' {
 			f.UnreadRune()
@@ -372,55 +424,164 @@ func nextLine(f *bufio.Reader) {
 		}
 	}
 	// Consume any number of endline runes
+	lines := 0
+	prev := rune(0)
 	for {
 		r, _, err := f.ReadRune()
 		if err != nil {
 			if err == io.EOF {
-				return
+				return lines, nil
 			}
-			panic(err.Error())
+			return lines, err
 		}
 		if r != '\r' && r != '\n' {
 			f.UnreadRune()
-			return
+			return lines, nil
+		}
+		if r == '\r' || prev != '\r' {
+			lines++
+		}
+		prev = r
+	}
+}
+
+// truncated reports a compressed file that ends in the middle of the data, as an
+// unexpected end of file
+func truncated(err error, where string) error {
+	if err == io.ErrUnexpectedEOF {
+		return errors.New(fmt.Sprintf("Unexpected end of file (%v)", where))
+	}
+	return err
+}
+
+func Read(f io.Reader, transposed bool) (*Cef, error) {
+	r, err := NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	cef, err := r.readAll()
+	if err != nil {
+		return nil, err
+	}
+	if transposed {
+		return cef.Transpose(), nil
+	}
+	return cef, nil
+}
+
+// readCefMatrix reads the rows of the main matrix of a text CEF file, following the preamble
+// (which ends on the given line), and returns the whole file (see orient)
+func readCefMatrix(r *bufio.Reader, cef *Cef, line int) (*Cef, error) {
+	nRowAttrs := len(cef.RowAttributes)
+	for i := 0; i < nRowAttrs; i++ {
+		cef.RowAttributes[i].Values = make([]string, cef.Rows)
+	}
+
+	// Read the rows, with row attribute values (in parallel, if enabled)
+	parsed := false
+	if threads() > 1 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, truncated(err, "in the main matrix")
+		}
+		parsed = parseRowsParallel(data, cef)
+		if !parsed {
+			// Parse again one row at a time, to report any error exactly
+			r = bufio.NewReader(bytes.NewReader(data))
+		}
+	}
+	if !parsed {
+		if err := readMatrix(r, cef, line); err != nil {
+			return nil, err
+		}
+	}
+	cef.orient()
+	if parsed && SparseThreshold > 0 && cef.Density() <= SparseThreshold {
+		cef.ToSparse()
+	}
+	if err := cef.verify(); err != nil {
+		return nil, err
+	}
+	return cef, nil
+}
+
+// readMatrix reads the rows of the main matrix one by one, with the row attribute values,
+// starting on the given line
+func readMatrix(r *bufio.Reader, cef *Cef, line int) error {
+	nRowAttrs := len(cef.RowAttributes)
+	b := newMatrixBuilder(cef.Rows, cef.Columns, true, false)
+	attrs := make([]string, nRowAttrs)
+	row := make([]float32, cef.Columns)
+	for i := 0; i < cef.Rows; i++ {
+		var err error
+		if line, err = readRow(r, i, line, attrs, row); err != nil {
+			return err
+		}
+		for j := 0; j < nRowAttrs; j++ {
+			cef.RowAttributes[j].Values[i] = attrs[j]
 		}
+		b.appendRow(row)
 	}
+	b.finish(cef)
+	return nil
 }
 
-func Read(f *os.File, transposed bool) (*Cef, error) {
-	var r = bufio.NewReader(f)
+// readPreamble reads everything that precedes the first row of the main matrix: the
+// header line, the headers, the column attributes and the row attribute names. The
+// row attributes are returned without values, with the line of the first row.
+func readPreamble(r *bufio.Reader) (*Cef, int, error) {
 	cef := new(Cef)
 
-	if nextString(r) != "CEF" {
-		return nil, errors.New("Unknown file format")
+	// Compressed files that are cut short are reported here; other missing fields are empty
+	line := 1
+	eof := func(err error) error {
+		return truncated(err, fmt.Sprintf("on line %v, before the first row of the main matrix", line))
+	}
+	skip := func() error {
+		n, err := nextLine(r)
+		line += n
+		return err
+	}
+	format, err := nextString(r)
+	if err != nil {
+		return nil, 0, eof(err)
+	}
+	if format != "CEF" {
+		return nil, 0, errors.New("Unknown file format")
 	}
 
 	// Parse the header line (the first field, 'CEF' has already been consumed)
-	nHeaders, err := strconv.Atoi(nextString(r))
+	fields, err := readStrings(r, 6)
 	if err != nil {
-		return nil, errors.New("Header count (row 1, column 2) is not a valid integer")
+		return nil, 0, eof(err)
 	}
-	nRowAttrs, err := strconv.Atoi(nextString(r))
+	nHeaders, err := strconv.Atoi(fields[0])
 	if err != nil {
-		return nil, errors.New("Row attribute count (row 1, column 6) is not a valid integer")
+		return nil, 0, errors.New("Header count (line 1, column 2) is not a valid integer")
 	}
-	nColumnAttrs, err := strconv.Atoi(nextString(r))
+	nRowAttrs, err := strconv.Atoi(fields[1])
 	if err != nil {
-		return nil, errors.New("Column attribute count (row 1, column 5) is not a valid integer")
+		return nil, 0, errors.New("Row attribute count (line 1, column 3) is not a valid integer")
 	}
-	nRows, err := strconv.Atoi(nextString(r))
+	nColumnAttrs, err := strconv.Atoi(fields[2])
 	if err != nil {
-		return nil, errors.New("Row count (row 1, column 4) is not a valid integer")
+		return nil, 0, errors.New("Column attribute count (line 1, column 4) is not a valid integer")
 	}
-	nColumns, err := strconv.Atoi(nextString(r))
+	nRows, err := strconv.Atoi(fields[3])
 	if err != nil {
-		return nil, errors.New("Column count (row 1, column 3) is not a valid integer")
+		return nil, 0, errors.New("Row count (line 1, column 5) is not a valid integer")
 	}
-	flags, err := strconv.Atoi(nextString(r))
+	nColumns, err := strconv.Atoi(fields[4])
 	if err != nil {
-		return nil, errors.New("Flags value (row 1, column 7) is not a valid integer")
+		return nil, 0, errors.New("Column count (line 1, column 6) is not a valid integer")
+	}
+	flags, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return nil, 0, errors.New("Flags value (line 1, column 7) is not a valid integer")
+	}
+	if err := skip(); err != nil {
+		return nil, 0, eof(err)
 	}
-	nextLine(r)
 	cef.Rows = nRows
 	cef.Columns = nColumns
 	cef.Flags = flags
@@ -428,59 +589,137 @@ func Read(f *os.File, transposed bool) (*Cef, error) {
 	// Read the headers
 	cef.Headers = make([]Header, nHeaders)
 	for i := 0; i < len(cef.Headers); i++ {
-		cef.Headers[i].Name = nextString(r)
-		cef.Headers[i].Value = nextString(r)
-		nextLine(r)
+		header, err := readStrings(r, 2)
+		if err != nil {
+			return nil, 0, eof(err)
+		}
+		cef.Headers[i] = Header{header[0], header[1]}
+		if err := skip(); err != nil {
+			return nil, 0, eof(err)
+		}
 	}
 
 	// Read the column attributes
 	cef.ColumnAttributes = make([]Attribute, nColumnAttrs)
 	for i := 0; i < nColumnAttrs; i++ {
-		skipFields(r, nRowAttrs)
-		cef.ColumnAttributes[i] = Attribute{nextString(r), readStrings(r, nColumns)}
-		nextLine(r)
+		err := skipFields(r, nRowAttrs)
+		var name string
+		if err == nil {
+			name, err = nextString(r)
+		}
+		var values []string
+		if err == nil {
+			values, err = readStrings(r, nColumns)
+		}
+		if err != nil {
+			return nil, 0, eof(err)
+		}
+		cef.ColumnAttributes[i] = Attribute{name, values}
+		if err := skip(); err != nil {
+			return nil, 0, eof(err)
+		}
 	}
 
 	// Read the row attribute names and create row attributes
+	names, err := readStrings(r, nRowAttrs)
+	if err != nil {
+		return nil, 0, eof(err)
+	}
 	cef.RowAttributes = make([]Attribute, nRowAttrs)
 	for i := 0; i < nRowAttrs; i++ {
-		ra := nextString(r)
-		if ra == "" {
-			return nil, errors.New(fmt.Sprintf("Row attribute name cannot be empty (name missing in column %v)", i+1))
+		if names[i] == "" {
+			return nil, 0, errors.New(fmt.Sprintf("Row attribute name cannot be empty (name missing on line %v, column %v)", line, i+1))
 		}
-		cef.RowAttributes[i] = Attribute{ra, make([]string, cef.Rows)}
+		cef.RowAttributes[i] = Attribute{names[i], nil}
+	}
+	if err := skip(); err != nil {
+		return nil, 0, eof(err)
 	}
-	nextLine(r)
+	return cef, line, nil
+}
 
-	// Read the rows, with row attribute values
-	cef.Matrix = make([]float32, cef.Columns*cef.Rows)
-	for i := 0; i < cef.Rows; i++ {
-		for j := 0; j < nRowAttrs; j++ {
-			cef.RowAttributes[j].Values[i] = nextString(r)
+// parseValue parses a value of the main matrix; empty and 'NA' fields are missing values (NaN)
+func parseValue(s string) (float32, error) {
+	if s == "" || s == "NA" {
+		return float32(math.NaN()), nil
+	}
+	val, err := strconv.ParseFloat(s, 32)
+	return float32(val), err
+}
+
+// readRow reads the row attribute values and main matrix values of row i (zero-based), which
+// starts on the given line (zero if not known), and returns the line of the next row
+func readRow(r *bufio.Reader, i int, line int, attrs []string, values []float32) (int, error) {
+	where := fmt.Sprintf("in row %v of the main matrix", i+1)
+	if line > 0 {
+		where = fmt.Sprintf("on line %v, %v", line, where)
+	}
+	if _, err := r.Peek(1); err == io.EOF {
+		return line, errors.New(fmt.Sprintf("Unexpected end of file (%v)", where))
+	} else if err != nil {
+		return line, truncated(err, where)
+	}
+
+	// Only empty fields are missing values; a row with fewer fields than the header line
+	// declares is an error (it is usually a file that was cut short)
+	found := 0
+	more := true
+	next := func() (string, error) {
+		if !more {
+			return "", errors.New(fmt.Sprintf("Too few fields %v (found %v, expected %v)", where, found, len(attrs)+1+len(values)))
 		}
-		skipFields(r, 1)
-		for j := 0; j < int(cef.Columns); j++ {
-			val, err := strconv.ParseFloat(nextString(r), 32)
-			if err != nil {
-				return nil, errors.New(fmt.Sprintf("Invalid float32 value in column %v, row %v of the main matrix", j+1, i+1))
-			}
-			if transposed {
-				cef.Matrix[j*cef.Rows+i] = float32(val)
-			} else {
-				cef.Matrix[j+i*cef.Columns] = float32(val)
-			}
+		field, m, err := readField(r)
+		if err != nil {
+			return "", truncated(err, where)
+		}
+		found++
+		more = m
+		return field, nil
+	}
+	for j := 0; j < len(attrs); j++ {
+		attr, err := next()
+		if err != nil {
+			return line, err
 		}
-		nextLine(r)
+		attrs[j] = attr
+	}
+	if _, err := next(); err != nil {
+		return line, err
 	}
+	for j := 0; j < len(values); j++ {
+		field, err := next()
+		if err != nil {
+			return line, err
+		}
+		val, err := parseValue(field)
+		if err != nil {
+			return line, errors.New(fmt.Sprintf("Invalid float32 value in column %v, row %v of the main matrix", j+1, i+1))
+		}
+		values[j] = val
+	}
+	n, err := nextLine(r)
+	return line + n, truncated(err, where)
+}
 
-	// Exchange the rows and columns
-	if transposed {
-		temp1 := cef.Rows
-		cef.Rows = cef.Columns
-		cef.Columns = temp1
-		temp2 := cef.RowAttributes
-		cef.RowAttributes = cef.ColumnAttributes
-		cef.ColumnAttributes = temp2
+// ReadFile reads a CEF or CEB file (optionally compressed) from the given path
+func ReadFile(path string, transposed bool) (*Cef, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
-	return cef, nil
+	defer f.Close()
+	return Read(f, transposed)
+}
+
+// WriteFile writes the Cef to the given path, replacing any existing file
+func WriteFile(cef *Cef, path string, transposed bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := Write(cef, f, transposed); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
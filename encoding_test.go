@@ -0,0 +1,186 @@
+package ceftools
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testText is testCef written as a CEF file (row by row, with one missing value)
+const testText = "CEF\t2\t2\t2\t4\t3\t0\n" +
+	"Tissue\tcortex\t\t\t\t\t\n" +
+	"Species\tmouse\t\t\t\t\t\n" +
+	"\t\tCellID\tc1\tc2\tc3\t\n" +
+	"\t\tAge\t10\t12\t10\t\n" +
+	"Gene\tChromosome\t\t\t\t\t\n" +
+	"Actb\t5\t\t1\t2\t0\t\n" +
+	"Actb\t5\t\t3\t4\t\t\n" +
+	"Gapdh\t6\t\t0\t0\t0\t\n" +
+	"Xist\tX\t\t0.5\t0\t7\t\n"
+
+func TestReadText(t *testing.T) {
+	for _, threads := range []int{1, 2} {
+		Threads = threads
+		cef, err := Read(strings.NewReader(testText), false)
+		Threads = 1
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSameCef(t, testCef(), cef)
+	}
+
+	// 'NA' is also a missing value, and the last newline can be left out
+	text := strings.Replace(strings.TrimSuffix(testText, "\n"), "\t\t3\t4\t\t", "\t\t3\t4\tNA\t", 1)
+	cef, err := Read(strings.NewReader(text), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameCef(t, testCef(), cef)
+}
+
+func TestReadTextTruncated(t *testing.T) {
+	cases := []struct {
+		text string
+		err  string
+	}{
+		// Cut short in the middle of the last row, after the first value and after the second
+		{testText[:len(testText)-7], "Too few fields on line 10, in row 4 of the main matrix (found 4, expected 6)"},
+		{testText[:len(testText)-4], "Too few fields on line 10, in row 4 of the main matrix (found 5, expected 6)"},
+		// Cut short in the row attributes
+		{testText[:len(testText)-14], "Too few fields on line 10, in row 4 of the main matrix (found 1, expected 6)"},
+		// Cut short at the end of a row
+		{testText[:len(testText)-len("Xist\tX\t\t0.5\t0\t7\t\n")], "Unexpected end of file (on line 10, in row 4 of the main matrix)"},
+	}
+	for _, c := range cases {
+		for _, threads := range []int{1, 2} {
+			Threads = threads
+			_, err := Read(strings.NewReader(c.text), false)
+			Threads = 1
+			if err == nil || err.Error() != c.err {
+				t.Errorf("reading %q with %v threads: got error %v, expected %v", c.text[len(c.text)-20:], threads, err, c.err)
+			}
+		}
+
+		// The rows before are read as usual when streaming
+		r, err := NewReader(strings.NewReader(c.text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, _, err := r.ReadRow(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := r.ReadRow(); err == nil || err.Error() != c.err {
+			t.Errorf("streaming: got error %v, expected %v", err, c.err)
+		}
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(testCef(), &buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != testText {
+		t.Errorf("wrote %q, expected %q", buf.String(), testText)
+	}
+}
+
+// writeCsv writes a file as the writer did when it used encoding/csv (for files without
+// missing values, or characters that need escaping)
+func writeCsv(cef *Cef) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = '\t'
+	ralen := len(cef.RowAttributes)
+	width := lineWidth(cef.Columns, ralen)
+	line := func(fields map[int]string) {
+		row := make([]string, width)
+		for i, field := range fields {
+			row[i] = field
+		}
+		w.Write(row)
+	}
+	line(map[int]string{0: "CEF", 1: strconv.Itoa(len(cef.Headers)), 2: strconv.Itoa(ralen), 3: strconv.Itoa(len(cef.ColumnAttributes)), 4: strconv.Itoa(cef.Rows), 5: strconv.Itoa(cef.Columns), 6: strconv.Itoa(cef.Flags)})
+	for _, h := range cef.Headers {
+		line(map[int]string{0: h.Name, 1: h.Value})
+	}
+	for _, attr := range cef.ColumnAttributes {
+		fields := map[int]string{ralen: attr.Name}
+		for j, v := range attr.Values {
+			fields[ralen+1+j] = v
+		}
+		line(fields)
+	}
+	names := map[int]string{}
+	for i, attr := range cef.RowAttributes {
+		names[i] = attr.Name
+	}
+	line(names)
+	for i := 0; i < cef.Rows; i++ {
+		fields := map[int]string{}
+		for j, attr := range cef.RowAttributes {
+			fields[j] = attr.Values[i]
+		}
+		for k, v := range cef.GetRow(i) {
+			fields[ralen+1+k] = strconv.FormatFloat(float64(v), 'f', -1, 64)
+		}
+		line(fields)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func TestWriteSameAsCsv(t *testing.T) {
+	// Values of every magnitude, integers around the largest that are formatted directly,
+	// and random bit patterns
+	values := []float32{0, float32(math.Copysign(0, -1)), 1, -1, 0.1, -2.5, 1e-45, 1.17549435e-38, math.MaxFloat32, -math.MaxFloat32,
+		16777216, 16777217, 1 << 52, 1<<53 - 1, 1 << 53, 1<<53 + 2, -(1 << 53), 1e20, 123456.789, float32(math.Inf(1)), float32(math.Inf(-1))}
+	random := rand.New(rand.NewSource(1))
+	for len(values) < 3000 {
+		if v := math.Float32frombits(random.Uint32()); v == v {
+			values = append(values, v)
+		}
+	}
+	for _, columns := range []int{3, 30} {
+		cef := &Cef{
+			Rows:             len(values) / columns,
+			Columns:          columns,
+			Headers:          []Header{{"Tissue", "cortex"}, {"Citation", "Doe et al. (2015), 'Cells'"}},
+			RowAttributes:    []Attribute{{"Gene", make([]string, len(values)/columns)}, {"Chromosome", make([]string, len(values)/columns)}},
+			ColumnAttributes: []Attribute{{"CellID", make([]string, columns)}},
+			Matrix:           values[:len(values)/columns*columns],
+		}
+		for i := 0; i < cef.Rows; i++ {
+			cef.RowAttributes[0].Values[i] = fmt.Sprintf("g%v", i)
+			cef.RowAttributes[1].Values[i] = strconv.Itoa(i % 23)
+		}
+		for j := 0; j < columns; j++ {
+			cef.ColumnAttributes[0].Values[j] = fmt.Sprintf("c%v", j)
+		}
+		expected := writeCsv(cef)
+		for _, threads := range []int{1, 4} {
+			Threads = threads
+			var buf bytes.Buffer
+			err := Write(cef, &buf, false)
+			Threads = 1
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != expected {
+				got, want := strings.SplitAfter(buf.String(), "\n"), strings.SplitAfter(expected, "\n")
+				i := 0
+				for i < len(got)-1 && i < len(want)-1 && got[i] == want[i] {
+					i++
+				}
+				t.Errorf("%v columns, %v threads: line %v is %q, expected %q", columns, threads, i+1, got[i], want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package ceftools
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A minimal FlatBuffers builder and reader, enough for the metadata of Arrow IPC files (see
+// arrow.go). Like the official implementation, the builder works back to front, so objects
+// are referred to by their offset from the end of the buffer, and children must be built
+// before their parents.
+type fbBuilder struct {
+	buf      []byte // The data built so far is buf[head:]
+	head     int
+	minAlign int
+	vtable   []int // The offsets of the fields of the table being built (0 if absent)
+	start    int   // The offset at which the table being built started
+}
+
+func newFbBuilder() *fbBuilder {
+	return &fbBuilder{buf: make([]byte, 1024), head: 1024, minAlign: 1}
+}
+
+// offset returns the offset of the next object from the end of the buffer
+func (b *fbBuilder) offset() int {
+	return len(b.buf) - b.head
+}
+
+// space makes room for n more bytes at the front, and returns the slice to fill
+func (b *fbBuilder) space(n int) []byte {
+	if b.head < n {
+		size := len(b.buf) - b.head
+		grown := make([]byte, 2*len(b.buf)+n)
+		copy(grown[len(grown)-size:], b.buf[b.head:])
+		b.head = len(grown) - size
+		b.buf = grown
+	}
+	b.head -= n
+	return b.buf[b.head : b.head+n]
+}
+
+// prep pads the buffer so that after writing 'additional' bytes, the offset is aligned to size
+func (b *fbBuilder) prep(size int, additional int) {
+	if size > b.minAlign {
+		b.minAlign = size
+	}
+	clear(b.space((-(b.offset() + additional)) & (size - 1)))
+}
+
+func (b *fbBuilder) putUint8(v uint8)   { b.space(1)[0] = v }
+func (b *fbBuilder) putUint16(v uint16) { binary.LittleEndian.PutUint16(b.space(2), v) }
+func (b *fbBuilder) putUint32(v uint32) { binary.LittleEndian.PutUint32(b.space(4), v) }
+func (b *fbBuilder) putUint64(v uint64) { binary.LittleEndian.PutUint64(b.space(8), v) }
+
+// putOffset writes a reference to an object built earlier
+func (b *fbBuilder) putOffset(ref int) {
+	b.prep(4, 0)
+	b.putUint32(uint32(b.offset() - ref + 4))
+}
+
+// createString writes a string (zero-terminated, after its length) and returns its offset
+func (b *fbBuilder) createString(s string) int {
+	b.prep(4, len(s)+1)
+	b.putUint8(0)
+	copy(b.space(len(s)), s)
+	b.putUint32(uint32(len(s)))
+	return b.offset()
+}
+
+// createOffsets writes a vector of references to objects built earlier, and returns its offset
+func (b *fbBuilder) createOffsets(refs []int) int {
+	b.prep(4, 4*len(refs))
+	for i := len(refs) - 1; i >= 0; i-- {
+		b.putOffset(refs[i])
+	}
+	b.putUint32(uint32(len(refs)))
+	return b.offset()
+}
+
+// createStructs writes a vector of structs made of 64-bit fields (the Arrow Block, Buffer and
+// FieldNode structs), and returns its offset. A 32-bit field followed by 4 bytes of padding
+// (as in Block) is written as a 64-bit field.
+func (b *fbBuilder) createStructs(structs [][]int64, size int) int {
+	b.prep(4, size*len(structs))
+	b.prep(8, size*len(structs))
+	for i := len(structs) - 1; i >= 0; i-- {
+		for k := len(structs[i]) - 1; k >= 0; k-- {
+			b.putUint64(uint64(structs[i][k]))
+		}
+	}
+	b.putUint32(uint32(len(structs)))
+	return b.offset()
+}
+
+// startTable starts a table with the given number of fields, which are then added in any order
+func (b *fbBuilder) startTable(fields int) {
+	b.vtable = make([]int, fields)
+	b.start = b.offset()
+}
+
+func (b *fbBuilder) addUint8(field int, v uint8) {
+	b.prep(1, 0)
+	b.putUint8(v)
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addUint16(field int, v uint16) {
+	b.prep(2, 0)
+	b.putUint16(v)
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addUint32(field int, v uint32) {
+	b.prep(4, 0)
+	b.putUint32(v)
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addUint64(field int, v uint64) {
+	b.prep(8, 0)
+	b.putUint64(v)
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addOffset(field int, ref int) {
+	b.putOffset(ref)
+	b.vtable[field] = b.offset()
+}
+
+// endTable writes the table's vtable just before it, and returns the offset of the table
+func (b *fbBuilder) endTable() int {
+	b.prep(4, 0)
+	b.putUint32(0) // The offset of the vtable, filled in below
+	table := b.offset()
+	n := len(b.vtable)
+	for n > 0 && b.vtable[n-1] == 0 {
+		n--
+	}
+	for i := n - 1; i >= 0; i-- {
+		off := 0
+		if b.vtable[i] != 0 {
+			off = table - b.vtable[i]
+		}
+		b.putUint16(uint16(off))
+	}
+	b.putUint16(uint16(table - b.start))
+	b.putUint16(uint16((n + 2) * 2))
+	binary.LittleEndian.PutUint32(b.buf[len(b.buf)-table:], uint32(b.offset()-table))
+	return table
+}
+
+// finish writes the reference to the root table, and returns the finished buffer
+func (b *fbBuilder) finish(root int) []byte {
+	b.prep(b.minAlign, 4)
+	b.putOffset(root)
+	return b.buf[b.head:]
+}
+
+// fbTable is a table in a FlatBuffers buffer. Malformed buffers make the accessors panic
+// with a fbError, which readers recover from (see recoverFb).
+type fbTable struct {
+	buf []byte
+	pos int
+}
+
+type fbError string
+
+// fbRoot returns the root table of a buffer
+func fbRoot(buf []byte) fbTable {
+	return fbTable{buf, fbIndex(buf, 0, 4) + int(binary.LittleEndian.Uint32(buf))}
+}
+
+// fbIndex checks that n bytes can be read at pos
+func fbIndex(buf []byte, pos int, n int) int {
+	if pos < 0 || n < 0 || pos > len(buf)-n {
+		panic(fbError("invalid offset"))
+	}
+	return pos
+}
+
+// recoverFb turns a panic due to a malformed buffer into an error
+func recoverFb(err *error, what string) {
+	if r := recover(); r != nil {
+		msg, ok := r.(fbError)
+		if !ok {
+			panic(r)
+		}
+		*err = errors.New(fmt.Sprintf("Invalid %v (%v)", what, msg))
+	}
+}
+
+// field returns the position of a field, or 0 if it is absent
+func (t fbTable) field(field int) int {
+	vt := t.pos - int(int32(binary.LittleEndian.Uint32(t.buf[fbIndex(t.buf, t.pos, 4):])))
+	size := int(binary.LittleEndian.Uint16(t.buf[fbIndex(t.buf, vt, 2):]))
+	if 4+2*field+2 > size {
+		return 0
+	}
+	off := int(binary.LittleEndian.Uint16(t.buf[fbIndex(t.buf, vt+4+2*field, 2):]))
+	if off == 0 {
+		return 0
+	}
+	return t.pos + off
+}
+
+func (t fbTable) uint8(field int, def uint8) uint8 {
+	if p := t.field(field); p != 0 {
+		return t.buf[fbIndex(t.buf, p, 1)]
+	}
+	return def
+}
+
+func (t fbTable) uint16(field int, def uint16) uint16 {
+	if p := t.field(field); p != 0 {
+		return binary.LittleEndian.Uint16(t.buf[fbIndex(t.buf, p, 2):])
+	}
+	return def
+}
+
+func (t fbTable) uint32(field int, def uint32) uint32 {
+	if p := t.field(field); p != 0 {
+		return binary.LittleEndian.Uint32(t.buf[fbIndex(t.buf, p, 4):])
+	}
+	return def
+}
+
+func (t fbTable) int64(field int, def int64) int64 {
+	if p := t.field(field); p != 0 {
+		return int64(binary.LittleEndian.Uint64(t.buf[fbIndex(t.buf, p, 8):]))
+	}
+	return def
+}
+
+// deref follows the reference at pos
+func (t fbTable) deref(pos int) int {
+	return pos + int(binary.LittleEndian.Uint32(t.buf[fbIndex(t.buf, pos, 4):]))
+}
+
+// table returns a child table, and whether it is present
+func (t fbTable) table(field int) (fbTable, bool) {
+	if p := t.field(field); p != 0 {
+		return fbTable{t.buf, t.deref(p)}, true
+	}
+	return fbTable{}, false
+}
+
+// vector returns the position of the first element of a vector, and its length
+func (t fbTable) vector(field int) (int, int) {
+	p := t.field(field)
+	if p == 0 {
+		return 0, 0
+	}
+	v := t.deref(p)
+	n := int(binary.LittleEndian.Uint32(t.buf[fbIndex(t.buf, v, 4):]))
+	return v + 4, n
+}
+
+// tables returns the tables in a vector of tables
+func (t fbTable) tables(field int) []fbTable {
+	pos, n := t.vector(field)
+	fbIndex(t.buf, pos, 4*n)
+	result := make([]fbTable, n)
+	for i := 0; i < n; i++ {
+		result[i] = fbTable{t.buf, t.deref(pos + 4*i)}
+	}
+	return result
+}
+
+// structs returns the 64-bit fields of the structs in a vector of structs of the given size
+func (t fbTable) structs(field int, size int) [][]int64 {
+	pos, n := t.vector(field)
+	fbIndex(t.buf, pos, size*n)
+	result := make([][]int64, n)
+	for i := 0; i < n; i++ {
+		result[i] = make([]int64, size/8)
+		for k := 0; k < size/8; k++ {
+			result[i][k] = int64(binary.LittleEndian.Uint64(t.buf[pos+i*size+k*8:]))
+		}
+	}
+	return result
+}
+
+func (t fbTable) string(field int) string {
+	pos, n := t.vector(field)
+	return string(t.buf[fbIndex(t.buf, pos, n) : pos+n])
+}
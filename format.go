@@ -0,0 +1,324 @@
+package ceftools
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Precision sets how the values of the main matrix are written to text CEF files
+type Precision struct {
+	Digits  int  // Significant digits (or decimals, if Fixed), or -1 to write values in full
+	Fixed   bool // Digits gives the number of decimals
+	Integer bool // Round values to the nearest integer
+}
+
+// OutputPrecision is the precision used by Write. Unless values are written in full, it is
+// recorded in the 'Precision' header.
+var OutputPrecision = Precision{Digits: -1}
+
+// The name of the header that records the precision of the values
+const precisionHeader = "Precision"
+
+// ParsePrecision interprets a precision given on the command line, which is either a number
+// of significant digits (like '4') or a number of decimals (like '2f')
+func ParsePrecision(s string) (Precision, error) {
+	fixed := strings.HasSuffix(s, "f")
+	digits, err := strconv.Atoi(strings.TrimSuffix(s, "f"))
+	if err != nil || digits < 0 || (digits == 0 && !fixed) {
+		return Precision{}, errors.New("Invalid precision (should be a number of significant digits like '4', or of decimals like '2f'): " + s)
+	}
+	return Precision{Digits: digits, Fixed: fixed}, nil
+}
+
+func (p Precision) String() string {
+	switch {
+	case p.Integer:
+		return "integer"
+	case p.Digits < 0:
+		return "full"
+	case p.Digits == 1 && p.Fixed:
+		return "1 decimal"
+	case p.Fixed:
+		return fmt.Sprintf("%v decimals", p.Digits)
+	case p.Digits == 1:
+		return "1 significant digit"
+	}
+	return fmt.Sprintf("%v significant digits", p.Digits)
+}
+
+// withPrecision returns the headers, recording the effective precision of the values: the
+// output precision, further limited by any precision recorded in the input. When values are
+// written in full, any precision recorded in the input is kept as it is.
+func withPrecision(headers []Header) []Header {
+	if !OutputPrecision.Integer && OutputPrecision.Digits < 0 {
+		return headers
+	}
+	result := make([]Header, 0, len(headers)+1)
+	recorded := ""
+	at := -1
+	for _, h := range headers {
+		if h.Name == precisionHeader {
+			recorded = h.Value
+			at = len(result)
+			continue
+		}
+		result = append(result, h)
+	}
+	header := Header{precisionHeader, effectivePrecision(recorded, OutputPrecision)}
+	if at == -1 {
+		return append(result, header)
+	}
+	return append(result[:at], append([]Header{header}, result[at:]...)...)
+}
+
+// effectivePrecision combines the recorded precision (as written by withPrecision) with
+// the output precision, keeping the fewest significant digits and the fewest decimals. When
+// both are limited, both are given, like '3 significant digits, 2 decimals'.
+func effectivePrecision(recorded string, p Precision) string {
+	digits, decimals := -1, -1
+	integer := false
+	limit := func(q Precision) {
+		if q.Integer {
+			q = Precision{Digits: 0, Fixed: true}
+			integer = true
+		}
+		if q.Digits < 0 {
+			return
+		}
+		if !q.Fixed && (digits < 0 || q.Digits < digits) {
+			digits = q.Digits
+		}
+		if q.Fixed && (decimals < 0 || q.Digits < decimals) {
+			decimals = q.Digits
+		}
+	}
+	for _, part := range strings.Split(recorded, ",") {
+		if q, ok := parsePrecisionName(strings.TrimSpace(part)); ok {
+			limit(q)
+		}
+	}
+	limit(p)
+
+	parts := make([]string, 0, 2)
+	if digits >= 0 {
+		parts = append(parts, Precision{Digits: digits}.String())
+	}
+	if decimals == 0 && integer {
+		parts = append(parts, Precision{Integer: true}.String())
+	} else if decimals >= 0 {
+		parts = append(parts, Precision{Digits: decimals, Fixed: true}.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parsePrecisionName interprets a precision as written by Precision.String
+func parsePrecisionName(s string) (Precision, bool) {
+	if s == "integer" {
+		return Precision{Integer: true}, true
+	}
+	fields := strings.SplitN(s, " ", 2)
+	digits, err := strconv.Atoi(fields[0])
+	if err != nil || digits < 0 || len(fields) < 2 {
+		return Precision{}, false
+	}
+	switch fields[1] {
+	case "decimal", "decimals":
+		return Precision{Digits: digits, Fixed: true}, true
+	case "significant digit", "significant digits":
+		return Precision{Digits: digits}, true
+	}
+	return Precision{}, false
+}
+
+// The largest magnitude for which integer values are formatted directly (beyond it, float64
+// cannot hold every integer, and strconv gives the shortest digits padded with zeros instead)
+const maxIntegerValue = 1 << 53
+
+// LegacyQuoting makes readers accept text CEF files written by older versions, which
+// enclosed fields containing tabs, newlines or double quotes in double quotes (doubling the
+// quotes inside), instead of escaping them, and did not escape backslashes
+var LegacyQuoting = false
+
+// appendField appends a field of a header or attribute, escaping backslashes, tabs, newlines
+// and carriage returns as \\, \t, \n and \r
+func appendField(buf []byte, field string) []byte {
+	if strings.IndexAny(field, "\\\t\n\r") == -1 {
+		return append(buf, field...)
+	}
+	for i := 0; i < len(field); i++ {
+		switch c := field[i]; c {
+		case '\\':
+			buf = append(buf, '\\', '\\')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+// unescape returns the character escaped by a backslash followed by c, or zero if a
+// backslash followed by c is not an escape sequence (and then readers keep the backslash)
+func unescape(c byte) byte {
+	switch c {
+	case '\\':
+		return '\\'
+	case 't':
+		return '\t'
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	}
+	return 0
+}
+
+// unescapeField reads a field escaped by appendField
+func unescapeField(field []byte) string {
+	if LegacyQuoting || bytes.IndexByte(field, '\\') == -1 {
+		return string(field)
+	}
+	result := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+1 < len(field) && unescape(field[i+1]) != 0 {
+			result = append(result, unescape(field[i+1]))
+			i++
+			continue
+		}
+		result = append(result, field[i])
+	}
+	return string(result)
+}
+
+// appendValue appends a value of the main matrix, rounded to the output precision. In full,
+// integers are formatted directly, and other values as by strconv.FormatFloat(float64(v), 'f', -1, 64).
+func appendValue(buf []byte, v float32) []byte {
+	p := OutputPrecision
+	switch {
+	case v != v:
+		// Missing values are written as empty fields
+		return buf
+	case p.Integer:
+		x := math.Round(float64(v))
+		if x > -maxIntegerValue && x < maxIntegerValue {
+			return strconv.AppendInt(buf, int64(x), 10)
+		}
+		return strconv.AppendFloat(buf, x, 'f', -1, 64)
+	case p.Digits < 0:
+		if v > -maxIntegerValue && v < maxIntegerValue && v == float32(int64(v)) && (v != 0 || !math.Signbit(float64(v))) {
+			return strconv.AppendInt(buf, int64(v), 10)
+		}
+		return strconv.AppendFloat(buf, float64(v), 'f', -1, 64)
+	case p.Fixed:
+		// Drop trailing zeros, and the sign of values that round to zero
+		start := len(buf)
+		buf = strconv.AppendFloat(buf, float64(v), 'f', p.Digits, 64)
+		if bytes.IndexByte(buf[start:], '.') >= 0 {
+			for buf[len(buf)-1] == '0' {
+				buf = buf[:len(buf)-1]
+			}
+			if buf[len(buf)-1] == '.' {
+				buf = buf[:len(buf)-1]
+			}
+		}
+		if string(buf[start:]) == "-0" {
+			buf = append(buf[:start], '0')
+		}
+		return buf
+	}
+
+	// Round to the significant digits, then write the rounded value in decimal notation
+	var temp [32]byte
+	digits := strconv.AppendFloat(temp[:0], float64(v), 'e', p.Digits-1, 64)
+	x, err := strconv.ParseFloat(unsafe.String(&digits[0], len(digits)), 64)
+	if err != nil {
+		x = float64(v)
+	}
+	if x == 0 {
+		x = math.Abs(x)
+	}
+	return strconv.AppendFloat(buf, x, 'f', -1, 64)
+}
+
+// appendLine appends a line of the given width, padded with empty fields
+func appendLine(buf []byte, fields []string, width int) []byte {
+	for i := 0; i < width; i++ {
+		if i > 0 {
+			buf = append(buf, '\t')
+		}
+		if i < len(fields) {
+			buf = appendField(buf, fields[i])
+		}
+	}
+	return append(buf, '\n')
+}
+
+// appendRow appends a row of the main matrix, with its row attribute values
+func appendRow(buf []byte, attrs []string, values []float32, width int) []byte {
+	for j := 0; j < len(attrs); j++ {
+		buf = appendField(buf, attrs[j])
+		buf = append(buf, '\t')
+	}
+	for j := 0; j < len(values); j++ {
+		buf = append(buf, '\t')
+		buf = appendValue(buf, values[j])
+	}
+	for n := len(attrs) + 1 + len(values); n < width; n++ {
+		buf = append(buf, '\t')
+	}
+	return append(buf, '\n')
+}
+
+// appendPreamble appends the header line, the headers, the column attributes and the row
+// attribute names
+func appendPreamble(buf []byte, headers []Header, rowAttrs []Attribute, colAttrs []Attribute, nRows int, nColumns int, flags int, width int) []byte {
+	// Write the header line
+	buf = appendLine(buf, []string{"CEF", strconv.Itoa(len(headers)), strconv.Itoa(len(rowAttrs)), strconv.Itoa(len(colAttrs)), strconv.Itoa(nRows), strconv.Itoa(nColumns), strconv.Itoa(flags)}, width)
+
+	// Write the headers
+	for _, hdr := range headers {
+		buf = appendLine(buf, []string{hdr.Name, hdr.Value}, width)
+	}
+
+	// Write the column attributes
+	ralen := len(rowAttrs)
+	for _, attr := range colAttrs {
+		for j := 0; j < ralen; j++ {
+			buf = append(buf, '\t')
+		}
+		buf = appendField(buf, attr.Name)
+		for j := 0; j < nColumns; j++ {
+			buf = append(buf, '\t')
+			buf = appendField(buf, attr.Values[j])
+		}
+		for n := ralen + 1 + nColumns; n < width; n++ {
+			buf = append(buf, '\t')
+		}
+		buf = append(buf, '\n')
+	}
+
+	// Write the row attribute names
+	names := make([]string, ralen)
+	for i := 0; i < ralen; i++ {
+		names[i] = rowAttrs[i].Name
+	}
+	return appendLine(buf, names, width)
+}
+
+// lineWidth is the number of fields on every line of a CEF file
+func lineWidth(nColumns int, nRowAttrs int) int {
+	if nColumns+nRowAttrs+1 > 7 {
+		return nColumns + nRowAttrs + 1
+	}
+	return 7
+}
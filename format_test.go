@@ -0,0 +1,126 @@
+package ceftools
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// The fields that need escaping, and some that look like they might
+var escapeTests = []string{"", "plain", "a\tb", "line\nbreak\r\n", `back\slash`, `\t`, `\\`, `trailing\`, "\t\n\r\\", `"quoted"`, "ünï\tcode"}
+
+func TestEscapeField(t *testing.T) {
+	for _, field := range escapeTests {
+		escaped := appendField(nil, field)
+		if bytes.ContainsAny(escaped, "\t\n\r") {
+			t.Errorf("%q escaped as %q", field, escaped)
+		}
+		if result := unescapeField(escaped); result != field {
+			t.Errorf("%q escaped as %q and read as %q", field, escaped, result)
+		}
+	}
+
+	// A backslash that does not start an escape sequence is kept
+	for _, field := range []string{`a\b`, `a\`, `\"`} {
+		if result := unescapeField([]byte(field)); result != field {
+			t.Errorf("%q read as %q", field, result)
+		}
+	}
+}
+
+// escapeTestCef returns testCef with the fields of escapeTests in its headers and attributes
+func escapeTestCef() *Cef {
+	cef := testCef()
+	cef.Headers = append(cef.Headers, Header{"Citation\tand note", "Doe\tet al.\n2015, \\cite{doe}"})
+	cef.RowAttributes[1].Name = "Chromosome\\n"
+	cef.RowAttributes[1].Values = []string{"a\tb", "line\nbreak\r\n", `trailing\`, "\t\n\r\\"}
+	cef.ColumnAttributes[1].Values = []string{`back\slash`, `\t`, `"quoted"`}
+	return cef
+}
+
+func TestEscapeRoundTrip(t *testing.T) {
+	cef := escapeTestCef()
+	var buf bytes.Buffer
+	if err := Write(cef, &buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 11 {
+		t.Errorf("wrote %v lines, expected 11", lines)
+	}
+	if problems := validate(t, buf.String()); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+	for _, threads := range []int{1, 2} {
+		Threads = threads
+		result, err := Read(bytes.NewReader(buf.Bytes()), false)
+		Threads = 1
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSameCef(t, cef, result)
+	}
+
+	// Also when streaming
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < cef.Rows; i++ {
+		attrs, _, err := r.ReadRow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs[1] != cef.RowAttributes[1].Values[i] {
+			t.Errorf("row %v read as %q, expected %q", i, attrs[1], cef.RowAttributes[1].Values[i])
+		}
+	}
+}
+
+func TestValidateEscapes(t *testing.T) {
+	text := strings.Replace(testText, "Gene\tChromosome", "Ge\\ne\tChromo\\some", 1)
+	problems := validate(t, text)
+	if len(problems) != 1 || problems[0].Line != 6 || problems[0].Field != 2 || problems[0].Severity != SeverityWarning {
+		t.Errorf("expected a warning for line 6, field 2, got %v", problems)
+	}
+}
+
+// legacyText is escapeTestCef as written by older versions, which quoted fields instead of
+// escaping them
+const legacyText = "CEF\t3\t2\t2\t4\t3\t0\n" +
+	"Tissue\tcortex\t\t\t\t\t\n" +
+	"Species\tmouse\t\t\t\t\t\n" +
+	"\"Citation\tand note\"\t\"Doe\tet al.\n2015, \\cite{doe}\"\t\t\t\t\t\n" +
+	"\t\tCellID\tc1\tc2\tc3\t\n" +
+	"\t\tAge\tback\\slash\t\\t\t\"\"\"quoted\"\"\"\t\n" +
+	"Gene\tChromosome\\n\t\t\t\t\t\n" +
+	"Actb\t\"a\tb\"\t\t1\t2\t0\t\n" +
+	"Actb\t\"line\nbreak\r\n\"\t\t3\t4\t\t\n" +
+	"Gapdh\ttrailing\\\t\t0\t0\t0\t\n" +
+	"Xist\t\"\t\n\r\\\"\t\t0.5\t0\t7\t\n"
+
+func TestLegacyQuoting(t *testing.T) {
+	LegacyQuoting = true
+	defer func() { LegacyQuoting = false }()
+	for _, threads := range []int{1, 2} {
+		Threads = threads
+		result, err := Read(strings.NewReader(legacyText), false)
+		Threads = 1
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSameCef(t, escapeTestCef(), result)
+	}
+
+	// Files are always written escaped
+	var legacy, escaped bytes.Buffer
+	if err := CmdDrop(strings.NewReader(legacyText), &legacy, "", "", false, false); err != nil {
+		t.Fatal(err)
+	}
+	LegacyQuoting = false
+	if err := Write(escapeTestCef(), &escaped, false); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.String() != escaped.String() {
+		t.Errorf("wrote %q, expected %q", legacy.String(), escaped.String())
+	}
+}
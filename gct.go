@@ -0,0 +1,309 @@
+package ceftools
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReadGct reads a GCT file (version 1.2 or 1.3), the expression format of GSEA and other
+// Broad Institute tools. The first field of the header line (like 'Name' or 'id') names both
+// the row IDs and the column IDs, which become the first row and column attributes. In
+// version 1.2 the row descriptions become the row attribute 'Description', and in version
+// 1.3 the row and column metadata become further attributes.
+func ReadGct(f io.Reader, transposed bool) (*Cef, error) {
+	r, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	line := 0
+	next := func() ([]string, error) {
+		text, err := r.ReadString('\n')
+		if err == io.EOF && text == "" {
+			return nil, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line++
+		return strings.Split(strings.TrimRight(text, "\r\n"), "\t"), nil
+	}
+
+	// Parse the version and the dimensions
+	fields, err := next()
+	if err != nil {
+		return nil, errors.New("Empty GCT file")
+	}
+	version := strings.TrimSpace(fields[0])
+	if version != "#1.2" && version != "#1.3" {
+		return nil, errors.New("Not a GCT file (line 1 should be '#1.2' or '#1.3')")
+	}
+	fields, err = next()
+	if err != nil {
+		return nil, errors.New("Truncated GCT file (expected the dimensions on line 2)")
+	}
+	dims := strings.Fields(strings.Join(fields, " "))
+	nDims := 2
+	if version == "#1.3" {
+		nDims = 4
+	}
+	counts := make([]int, nDims)
+	if len(dims) != nDims {
+		return nil, errors.New(fmt.Sprintf("Invalid dimensions on line 2 of the GCT file (expected %v numbers)", nDims))
+	}
+	for i := 0; i < nDims; i++ {
+		if counts[i], err = strconv.Atoi(dims[i]); err != nil || counts[i] < 0 {
+			return nil, errors.New("Invalid dimensions on line 2 of the GCT file: " + strings.Join(dims, " "))
+		}
+	}
+	nRows, nColumns := counts[0], counts[1]
+	nRowMeta, nColumnMeta := 1, 0 // The description is the only row metadata in version 1.2
+	if version == "#1.3" {
+		nRowMeta, nColumnMeta = counts[2], counts[3]
+	}
+	lead := 1 + nRowMeta
+	cef := new(Cef)
+	cef.Rows = nRows
+	cef.Columns = nColumns
+	cef.Headers = make([]Header, 0)
+
+	// The header line names the row attributes, and gives the column IDs
+	fields, err = next()
+	if err != nil {
+		return nil, errors.New("Truncated GCT file (expected the header line on line 3)")
+	}
+	if len(fields) != lead+nColumns {
+		return nil, errors.New(fmt.Sprintf("Wrong number of fields on line 3 of the GCT file (%v, expected %v)", len(fields), lead+nColumns))
+	}
+	cef.RowAttributes = make([]Attribute, lead)
+	for i := 0; i < lead; i++ {
+		cef.RowAttributes[i] = Attribute{fields[i], make([]string, 0, nRows)}
+	}
+	if version == "#1.2" {
+		cef.RowAttributes[1].Name = "Description"
+	}
+	cef.ColumnAttributes = make([]Attribute, 1+nColumnMeta)
+	cef.ColumnAttributes[0] = Attribute{fields[0], fields[lead:]}
+
+	// Each line of column metadata gives its name, then (for the row metadata) placeholders
+	for k := 1; k <= nColumnMeta; k++ {
+		fields, err = next()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Truncated GCT file (expected column metadata on line %v)", line+1))
+		}
+		if len(fields) != lead+nColumns {
+			return nil, errors.New(fmt.Sprintf("Wrong number of fields on line %v of the GCT file (%v, expected %v)", line, len(fields), lead+nColumns))
+		}
+		cef.ColumnAttributes[k] = Attribute{fields[0], fields[lead:]}
+	}
+
+	// Read the rows
+	b := newMatrixBuilder(nRows, nColumns, true, false)
+	values := make([]float32, nColumns)
+	for i := 0; i < nRows; i++ {
+		fields, err = next()
+		if err == io.EOF {
+			return nil, errors.New(fmt.Sprintf("Truncated GCT file (found %v rows, expected %v)", i, nRows))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) != lead+nColumns {
+			return nil, errors.New(fmt.Sprintf("Wrong number of fields on line %v of the GCT file (%v, expected %v)", line, len(fields), lead+nColumns))
+		}
+		for k := 0; k < lead; k++ {
+			cef.RowAttributes[k].Values = append(cef.RowAttributes[k].Values, fields[k])
+		}
+		for j := 0; j < nColumns; j++ {
+			value, err := parseGctValue(strings.TrimSpace(fields[lead+j]))
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid float32 value on line %v of the GCT file (row %v, column %v): '%v'", line, i+1, j+1, fields[lead+j]))
+			}
+			values[j] = value
+		}
+		b.appendRow(values)
+	}
+	for {
+		fields, err = next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(strings.Join(fields, "")) != "" {
+			return nil, errors.New(fmt.Sprintf("Unexpected data on line %v of the GCT file (after the last of %v rows)", line, nRows))
+		}
+	}
+	b.finish(cef)
+
+	if transposed {
+		cef = cef.Transpose()
+	}
+	return cef, nil
+}
+
+// parseGctValue parses a value of the main matrix, where missing values can be empty or written
+// as 'NA' or 'NaN' in any case
+func parseGctValue(s string) (float32, error) {
+	if strings.EqualFold(s, "na") || strings.EqualFold(s, "nan") {
+		s = ""
+	}
+	return parseValue(s)
+}
+
+// WriteGct writes a GCT file, in version 1.2 (for GSEA) or 1.3. The first row attribute gives
+// the row IDs (or the row numbers, if there are none), and the first column attribute gives
+// the column IDs. In version 1.2, the row attribute 'Description' (or else 'na') gives the
+// descriptions and the other attributes are left out; in version 1.3, they are all written as
+// row and column metadata. Missing values are written as empty fields. GCT files have no
+// escaping, so tabs and newlines in attribute values are replaced by spaces.
+func WriteGct(cef *Cef, f io.Writer, version string, transposed bool) error {
+	if version != "1.2" && version != "1.3" {
+		return errors.New("Unknown GCT version (expected '1.2' or '1.3'): " + version)
+	}
+	if transposed {
+		cef = cef.Transpose()
+	}
+	w := bufio.NewWriter(f)
+
+	// The row and column IDs (version 1.2 requires the header line to start 'Name', 'Description')
+	rowIDs := Attribute{"id", numbered(cef.Rows)}
+	if len(cef.RowAttributes) > 0 {
+		rowIDs = cef.RowAttributes[0]
+	}
+	if version == "1.2" {
+		rowIDs.Name = "Name"
+	}
+	colIDs := numbered(cef.Columns)
+	if len(cef.ColumnAttributes) > 0 {
+		colIDs = cef.ColumnAttributes[0].Values
+	}
+
+	// The metadata (in version 1.2, only the description)
+	var rowMeta, colMeta []Attribute
+	if version == "1.2" {
+		desc := Attribute{"Description", nil}
+		for _, attr := range cef.RowAttributes {
+			if attr.Name == "Description" {
+				desc = attr
+			}
+		}
+		if desc.Values == nil {
+			desc.Values = make([]string, cef.Rows)
+			for i := 0; i < cef.Rows; i++ {
+				desc.Values[i] = "na"
+			}
+		}
+		rowMeta = []Attribute{desc}
+		fmt.Fprintf(w, "#1.2\n%v\t%v\n", cef.Rows, cef.Columns)
+	} else {
+		if len(cef.RowAttributes) > 0 {
+			rowMeta = cef.RowAttributes[1:]
+		}
+		if len(cef.ColumnAttributes) > 0 {
+			colMeta = cef.ColumnAttributes[1:]
+		}
+		fmt.Fprintf(w, "#1.3\n%v\t%v\t%v\t%v\n", cef.Rows, cef.Columns, len(rowMeta), len(colMeta))
+	}
+
+	// The header line, then the column metadata
+	line := make([]byte, 0)
+	line = appendGctField(line, rowIDs.Name)
+	for _, attr := range rowMeta {
+		line = appendGctField(append(line, '\t'), attr.Name)
+	}
+	for _, val := range colIDs {
+		line = appendGctField(append(line, '\t'), val)
+	}
+	w.Write(append(line, '\n'))
+	for _, attr := range colMeta {
+		line = appendGctField(line[:0], attr.Name)
+		for range rowMeta {
+			line = append(line, "\tna"...)
+		}
+		for _, val := range attr.Values {
+			line = appendGctField(append(line, '\t'), val)
+		}
+		w.Write(append(line, '\n'))
+	}
+
+	// The rows
+	for i := 0; i < cef.Rows; i++ {
+		line = appendGctField(line[:0], rowIDs.Values[i])
+		for _, attr := range rowMeta {
+			line = appendGctField(append(line, '\t'), attr.Values[i])
+		}
+		for _, v := range cef.GetRow(i) {
+			line = appendValue(append(line, '\t'), v)
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// appendGctField appends an attribute name or value, with tabs and newlines replaced by spaces
+func appendGctField(buf []byte, field string) []byte {
+	if strings.IndexAny(field, "\t\n\r") == -1 {
+		return append(buf, field...)
+	}
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c == '\t' || c == '\n' || c == '\r' {
+			c = ' '
+		}
+		buf = append(buf, c)
+	}
+	return buf
+}
+
+// numbered returns the numbers 1 to n, as strings
+func numbered(n int) []string {
+	result := make([]string, n)
+	for i := 0; i < n; i++ {
+		result[i] = strconv.Itoa(i + 1)
+	}
+	return result
+}
+
+// WriteCls writes a categorical CLS file, the phenotype format of GSEA, giving the class of each
+// column by the values of the given column attribute. The classes are numbered in order of
+// first appearance. Class names cannot contain spaces, so these are replaced by underscores.
+func WriteCls(cef *Cef, f io.Writer, attr string, transposed bool) error {
+	if transposed {
+		cef = cef.Transpose()
+	}
+	var labels []string
+	for _, a := range cef.ColumnAttributes {
+		if a.Name == attr {
+			labels = a.Values
+		}
+	}
+	if labels == nil {
+		return errors.New(fmt.Sprintf("Column attribute '%v' not found (needed for the phenotype labels)", attr))
+	}
+	classes := make([]string, 0)
+	seen := make(map[string]bool)
+	names := make([]string, len(labels))
+	for j, label := range labels {
+		name := strings.Join(strings.Fields(label), "_")
+		if name == "" {
+			return errors.New(fmt.Sprintf("Column %v has no phenotype label (empty '%v' attribute)", j+1, attr))
+		}
+		if !seen[name] {
+			seen[name] = true
+			classes = append(classes, name)
+		}
+		names[j] = name
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%v %v 1\n", len(labels), len(classes))
+	fmt.Fprintf(w, "# %v\n", strings.Join(classes, " "))
+	fmt.Fprintf(w, "%v\n", strings.Join(names, " "))
+	return w.Flush()
+}
@@ -0,0 +1,148 @@
+package ceftools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The name of the headers that record the processing steps, in order
+const historyHeader = "History"
+
+// History is the processing step recorded in a 'History' header of every CEF or CEB file
+// written, after the steps recorded in the input (see HistoryStep), or nil for none
+var History *Step
+
+// Step is a processing step: a command run on an input at a given time
+type Step struct {
+	Time  time.Time
+	Args  []string   // The command line
+	Input *InputHash // The input, or nil if there is none
+}
+
+// HistoryStep returns the processing step of the given command line, run now on the given
+// input (or nil for none)
+func HistoryStep(args []string, input *InputHash) *Step {
+	return &Step{time.Now().UTC(), args, input}
+}
+
+// String describes the step as recorded in a 'History' header: the time (UTC), the ceftools
+// version, the content hash of the input ('-' if there is none) and the command line,
+// separated by spaces. The hash covers the whole input, so whatever has not been read yet
+// is read first.
+func (s *Step) String() string {
+	words := make([]string, len(s.Args))
+	for i, arg := range s.Args {
+		if i == 0 {
+			arg = filepath.Base(arg)
+		}
+		words[i] = shellQuote(arg)
+	}
+	hash := "-"
+	if s.Input != nil {
+		hash = s.Input.Sum()
+	}
+	return fmt.Sprintf("%v ceftools-%v.%v %v %v", s.Time.Format(time.RFC3339), MajorVersion, MinorVersion, hash, strings.Join(words, " "))
+}
+
+// historyPending reports whether a step is recorded whose input has not yet been read in
+// full, so that streamed output must wait for its hash (see NewWriter)
+func historyPending() bool {
+	return History != nil && History.Input != nil && History.Input.sum == ""
+}
+
+// shellQuote quotes an argument for the shell, unless that is not needed
+func shellQuote(arg string) string {
+	plain := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.,:/=@+%", r)
+	}
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool { return !plain(r) }) == -1 {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// withHistory returns the headers, with the History step appended (unless nil)
+func withHistory(headers []Header) []Header {
+	if History == nil {
+		return headers
+	}
+	result := make([]Header, len(headers), len(headers)+1)
+	copy(result, headers)
+	return append(result, Header{historyHeader, History.String()})
+}
+
+// InputHash reads the input of a command, and computes its content hash (SHA-256 of the bytes
+// as stored, including the main matrix) as the bytes stream through
+type InputHash struct {
+	r   io.Reader
+	h   hash.Hash
+	sum string // The hash, once the whole input has been read
+}
+
+// HashInput returns a reader for the input that computes its content hash (see Step)
+func HashInput(r io.Reader) *InputHash {
+	return &InputHash{r: r, h: sha256.New()}
+}
+
+func (ih *InputHash) Read(p []byte) (int, error) {
+	n, err := ih.r.Read(p)
+	ih.h.Write(p[:n])
+	if err == io.EOF && ih.sum == "" {
+		ih.sum = hashString(ih.h)
+	}
+	return n, err
+}
+
+// Sum returns the content hash of the input, after reading whatever is left of it, or '-'
+// if it cannot be read
+func (ih *InputHash) Sum() string {
+	if ih.sum == "" {
+		if _, err := io.Copy(io.Discard, ih); err != nil {
+			ih.sum = "-"
+		}
+	}
+	return ih.sum
+}
+
+func hashString(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// WriteHistory writes the processing steps recorded in the headers, in order
+func WriteHistory(cef *Cef, out io.Writer) error {
+	step := 0
+	for _, hdr := range cef.Headers {
+		if hdr.Name != historyHeader {
+			continue
+		}
+		step++
+		fields := strings.SplitN(hdr.Value, " ", 4)
+		if len(fields) < 4 || !strings.HasPrefix(fields[1], "ceftools-") {
+			// Written by hand, or by another tool
+			if _, err := fmt.Fprintf(out, "%v. %v\n", step, hdr.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		version := strings.TrimPrefix(fields[1], "ceftools-")
+		input := "input " + fields[2]
+		if fields[2] == "-" {
+			input = "no input"
+		}
+		if _, err := fmt.Fprintf(out, "%v. %v\n   at %v with ceftools %v, %v\n", step, fields[3], fields[0], version, input); err != nil {
+			return err
+		}
+	}
+	if step == 0 {
+		_, err := fmt.Fprintln(out, "No history recorded")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package ceftools
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// historyOf runs 'cef add --header' on the text, streaming it, and returns the input hash
+// recorded in the History header of the output
+func historyOf(t *testing.T, text string) string {
+	t.Helper()
+	History = HistoryStep([]string{"cef", "add", "--header", "Tissue=cortex"}, HashInput(strings.NewReader(text)))
+	defer func() { History = nil }()
+	var out bytes.Buffer
+	if err := CmdAdd(strings.NewReader(text), &out, "", "Tissue=cortex", false); err != nil {
+		t.Fatal(err)
+	}
+	// The command read its own copy of the input, so the hash is completed when the
+	// header is written
+	cef, err := Read(&out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := cef.Headers[len(cef.Headers)-1]
+	fields := strings.Fields(step.Value)
+	if step.Name != historyHeader || len(fields) < 3 {
+		t.Fatalf("expected a History header last, got %v", cef.Headers)
+	}
+	return fields[2]
+}
+
+func TestHistoryHash(t *testing.T) {
+	sum := sha256.Sum256([]byte(testText))
+	if hash := historyOf(t, testText); hash != "sha256:"+hex.EncodeToString(sum[:]) {
+		t.Errorf("recorded %v, expected the hash of the whole input", hash)
+	}
+
+	// Inputs that differ only in the main matrix have different hashes
+	other := strings.Replace(testText, "Xist\tX\t\t0.5\t0\t7", "Xist\tX\t\t0.5\t0\t8", 1)
+	if historyOf(t, testText) == historyOf(t, other) {
+		t.Error("inputs with different values have the same hash")
+	}
+}
+
+func TestHistoryHashStreamed(t *testing.T) {
+	// The input is read through the hash as the rows are streamed, so the output is held
+	// back until all of it has been read
+	input := HashInput(strings.NewReader(testText))
+	History = HistoryStep([]string{"cef", "drop"}, input)
+	defer func() { History = nil }()
+	var out bytes.Buffer
+	if err := CmdDrop(input, &out, "", "", false, false); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(testText))
+	if !strings.Contains(out.String(), "sha256:"+hex.EncodeToString(sum[:])) {
+		t.Errorf("the hash of the input is not recorded in %q", out.String())
+	}
+	cef, err := Read(&out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cef.Headers = cef.Headers[:len(cef.Headers)-1]
+	checkSameCef(t, testCef(), cef)
+}
@@ -0,0 +1,452 @@
+package ceftools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+)
+
+// MagicCEFI identifies a CEF index file ('CEFI' in little-endian order)
+const MagicCEFI = 0x49464543
+
+// Index holds the byte offset of every row of the main matrix of a text CEF file, and
+// optionally a hash index on the values of one row attribute. It is stored in a sidecar
+// file next to the CEF file (see IndexPath), and is valid only as long as the size and
+// modification time of the CEF file are unchanged.
+type Index struct {
+	Size    int64   // The size of the indexed file
+	ModTime int64   // The modification time of the indexed file (in nanoseconds since the epoch)
+	Offsets []int64 // The offset of each row, followed by the offset of the end of the last row
+	Key     string  // The row attribute in the hash index, or "" if none
+
+	// The rows whose key hashes to bucket b are Rows[Buckets[b]:Buckets[b+1]], in increasing order
+	Buckets []int64
+	Rows    []int64
+}
+
+// IndexPath returns the path of the index of a CEF file ('file.cef' is indexed in 'file.cefi')
+func IndexPath(path string) string {
+	if strings.HasSuffix(path, ".cef") {
+		return path + "i"
+	}
+	return path + ".cefi"
+}
+
+func hashKey(value string, nBuckets int) int {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return int(h.Sum64() % uint64(nBuckets))
+}
+
+// fresh checks that the index matches the current version of the indexed file
+func (idx *Index) fresh(fi os.FileInfo) bool {
+	return fi.Size() == idx.Size && fi.ModTime().UnixNano() == idx.ModTime
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// BuildIndex indexes an uncompressed text CEF file, with a hash index on the given row
+// attribute (if not empty)
+func BuildIndex(path string, key string) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	cr := &countingReader{r: f}
+	r := bufio.NewReader(cr)
+	magic, _ := r.Peek(4)
+	if bytes.HasPrefix(magic, gzipMagic) || bytes.HasPrefix(magic, zstdMagic) || (len(magic) == 4 && binary.LittleEndian.Uint32(magic) == MagicCEB) {
+		return nil, errors.New("Only uncompressed text CEF files can be indexed")
+	}
+
+	cef, line, err := readPreamble(r)
+	if err != nil {
+		return nil, err
+	}
+	keyIndex := -1
+	if key != "" {
+		for i := 0; i < len(cef.RowAttributes); i++ {
+			if cef.RowAttributes[i].Name == key {
+				keyIndex = i
+			}
+		}
+		if keyIndex == -1 {
+			return nil, errors.New("Attribute not found when attempting to index: " + key)
+		}
+	}
+
+	// Record the offset of every row, and hash the keys
+	idx := &Index{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Key: key}
+	idx.Offsets = make([]int64, cef.Rows+1)
+	nBuckets := cef.Rows
+	if nBuckets < 1 {
+		nBuckets = 1
+	}
+	hashes := make([]int, cef.Rows)
+	attrs := make([]string, len(cef.RowAttributes))
+	values := make([]float32, cef.Columns)
+	for i := 0; i < cef.Rows; i++ {
+		idx.Offsets[i] = cr.n - int64(r.Buffered())
+		if line, err = readRow(r, i, line, attrs, values); err != nil {
+			return nil, err
+		}
+		if keyIndex != -1 {
+			hashes[i] = hashKey(attrs[keyIndex], nBuckets)
+		}
+	}
+	idx.Offsets[cef.Rows] = cr.n - int64(r.Buffered())
+
+	// Sort the rows into buckets
+	if keyIndex != -1 {
+		idx.Buckets = make([]int64, nBuckets+1)
+		for _, h := range hashes {
+			idx.Buckets[h+1]++
+		}
+		for b := 0; b < nBuckets; b++ {
+			idx.Buckets[b+1] += idx.Buckets[b]
+		}
+		next := make([]int64, nBuckets)
+		copy(next, idx.Buckets)
+		idx.Rows = make([]int64, cef.Rows)
+		for i, h := range hashes {
+			idx.Rows[next[h]] = int64(i)
+			next[h]++
+		}
+	}
+	return idx, nil
+}
+
+// Write writes the index in binary form: the magic number, the size and modification time
+// of the indexed file, the row count and row offsets, the key attribute name, and (if there
+// is a key) the bucket count, bucket starts and bucketed rows. Numbers are little-endian
+// int64, and the name is a little-endian uint32 byte length followed by UTF-8 bytes.
+func (idx *Index) Write(f io.Writer) error {
+	cw := &cebWriter{w: bufio.NewWriter(f)}
+	binary.LittleEndian.PutUint32(cw.buf[:], MagicCEFI)
+	cw.write(cw.buf[:4])
+	cw.writeInt(int(idx.Size))
+	cw.writeInt(int(idx.ModTime))
+	cw.writeInt(len(idx.Offsets) - 1)
+	for _, offset := range idx.Offsets {
+		cw.writeInt(int(offset))
+	}
+	cw.writeString(idx.Key)
+	if idx.Key != "" {
+		cw.writeInt(len(idx.Buckets) - 1)
+		for _, start := range idx.Buckets {
+			cw.writeInt(int(start))
+		}
+		for _, row := range idx.Rows {
+			cw.writeInt(int(row))
+		}
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+	return cw.w.Flush()
+}
+
+// ReadIndex reads an index written by Index.Write, and checks that it is consistent
+func ReadIndex(f io.Reader) (*Index, error) {
+	cr := &cebReader{r: bufio.NewReader(f)}
+	if err := cr.read(cr.buf[:4]); err != nil || binary.LittleEndian.Uint32(cr.buf[:]) != MagicCEFI {
+		return nil, errors.New("Not a CEF index file")
+	}
+	truncated := errors.New("Truncated CEF index file")
+
+	// The counts are not trusted to allocate all values at once (see cebChunk), so a
+	// corrupt count runs into the end of the file instead
+	readInts := func(n int) ([]int64, error) {
+		if n < 0 {
+			return nil, errors.New("Invalid CEF index file (negative count)")
+		}
+		result := make([]int64, 0, min(n, cebChunk))
+		for i := 0; i < n; i++ {
+			val, err := cr.readInt()
+			if err != nil {
+				return nil, truncated
+			}
+			result = append(result, int64(val))
+		}
+		return result, nil
+	}
+	header, err := readInts(3)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{Size: header[0], ModTime: header[1]}
+	if idx.Offsets, err = readInts(int(header[2]) + 1); err != nil {
+		return nil, err
+	}
+	if idx.Key, err = cr.readString(); err != nil {
+		return nil, truncated
+	}
+	if idx.Key != "" {
+		nBuckets, err := cr.readInt()
+		if err != nil {
+			return nil, truncated
+		}
+		if idx.Buckets, err = readInts(nBuckets + 1); err != nil {
+			return nil, err
+		}
+		if idx.Rows, err = readInts(len(idx.Offsets) - 1); err != nil {
+			return nil, err
+		}
+	}
+	if err := idx.check(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// check verifies that the row offsets are in order and within the indexed file, and that
+// the buckets of the hash index are in order and cover Rows, so that a corrupt index cannot
+// make IndexedReader read outside the file or outside Rows
+func (idx *Index) check() error {
+	invalid := func(what string) error {
+		return errors.New(fmt.Sprintf("Invalid CEF index file (%v)", what))
+	}
+	for i, offset := range idx.Offsets {
+		if offset < 0 || offset > idx.Size || (i > 0 && offset < idx.Offsets[i-1]) {
+			return invalid(fmt.Sprintf("offset of row %v out of range", i+1))
+		}
+	}
+	if idx.Key == "" {
+		return nil
+	}
+	if len(idx.Buckets) < 2 {
+		return invalid("no buckets")
+	}
+	if idx.Buckets[0] != 0 || idx.Buckets[len(idx.Buckets)-1] != int64(len(idx.Rows)) {
+		return invalid("buckets do not cover the rows")
+	}
+	for b := 1; b < len(idx.Buckets); b++ {
+		if idx.Buckets[b] < idx.Buckets[b-1] {
+			return invalid(fmt.Sprintf("bucket %v out of order", b))
+		}
+	}
+	for _, row := range idx.Rows {
+		if row < 0 || row >= int64(len(idx.Rows)) {
+			return invalid(fmt.Sprintf("row %v out of range", row+1))
+		}
+	}
+	return nil
+}
+
+// WriteIndexFile indexes a CEF file and writes the index next to it (see IndexPath)
+func WriteIndexFile(path string, key string) error {
+	idx, err := BuildIndex(path, key)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(IndexPath(path))
+	if err != nil {
+		return err
+	}
+	if err := idx.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// IndexedReader reads individual rows of an indexed CEF file
+type IndexedReader struct {
+	// The shape, flags, headers and column attributes of the file. The row attributes
+	// are given by name only.
+	Cef *Cef
+
+	index    *Index
+	f        *os.File
+	keyIndex int
+}
+
+// ReadIndexed opens a CEF file for random access, using its index. It fails if there is
+// no index, or if the file has changed since it was indexed.
+func ReadIndexed(path string) (*IndexedReader, error) {
+	temp, err := os.Open(IndexPath(path))
+	if err != nil {
+		return nil, err
+	}
+	idx, err := ReadIndex(temp)
+	temp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !idx.fresh(fi) {
+		f.Close()
+		return nil, errors.New("The index is out of date (run 'cef index' again): " + IndexPath(path))
+	}
+
+	// Read the headers and attributes
+	cef, _, err := readPreamble(bufio.NewReader(io.NewSectionReader(f, 0, idx.Offsets[0])))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &IndexedReader{Cef: cef, index: idx, f: f, keyIndex: -1}
+	for i := 0; i < len(cef.RowAttributes); i++ {
+		if cef.RowAttributes[i].Name == idx.Key {
+			r.keyIndex = i
+		}
+	}
+	if cef.Rows != len(idx.Offsets)-1 || (idx.Key != "" && r.keyIndex == -1) {
+		f.Close()
+		return nil, errors.New("The index does not match the file: " + IndexPath(path))
+	}
+	return r, nil
+}
+
+// indexFor returns an IndexedReader if the input is a file with an up-to-date index, or nil
+// (also if the file is stored transposed, since the index is then by columns of the data)
+func indexFor(in io.Reader) *IndexedReader {
+	f, ok := in.(*os.File)
+	if !ok {
+		return nil
+	}
+	r, err := ReadIndexed(f.Name())
+	if err != nil {
+		return nil
+	}
+	if r.Cef.Flags&Transposed != 0 {
+		r.Close()
+		return nil
+	}
+	return r
+}
+
+func (r *IndexedReader) Close() error {
+	return r.f.Close()
+}
+
+// Key returns the name of the row attribute in the hash index, or "" if none
+func (r *IndexedReader) Key() string {
+	return r.index.Key
+}
+
+// ReadRow returns the row attribute values and the main matrix values of row i (zero-based)
+func (r *IndexedReader) ReadRow(i int) ([]string, []float32, error) {
+	if i < 0 || i >= r.Cef.Rows {
+		return nil, nil, errors.New(fmt.Sprintf("Row %v is out of range (the file has %v rows)", i+1, r.Cef.Rows))
+	}
+	start := r.index.Offsets[i]
+	section := io.NewSectionReader(r.f, start, r.index.Offsets[i+1]-start)
+	attrs := make([]string, len(r.Cef.RowAttributes))
+	values := make([]float32, r.Cef.Columns)
+	if _, err := readRow(bufio.NewReader(section), i, 0, attrs, values); err != nil {
+		return nil, nil, err
+	}
+	return attrs, values, nil
+}
+
+// Find returns the rows (zero-based, in increasing order) where the key attribute has the given value
+func (r *IndexedReader) Find(value string) ([]int, error) {
+	if r.index.Key == "" || r.keyIndex == -1 {
+		return nil, errors.New("The index has no key attribute")
+	}
+	result := make([]int, 0)
+	b := hashKey(value, len(r.index.Buckets)-1)
+	for _, row := range r.index.Rows[r.index.Buckets[b]:r.index.Buckets[b+1]] {
+		attrs, _, err := r.ReadRow(int(row))
+		if err != nil {
+			return nil, err
+		}
+		if attrs[r.keyIndex] == value {
+			result = append(result, int(row))
+		}
+	}
+	return result, nil
+}
+
+// Read returns a Cef with the given rows (zero-based) as stored, which are columns of the
+// result if the file is stored transposed
+func (r *IndexedReader) Read(rows []int) (*Cef, error) {
+	result := withoutRowValues(r.Cef)
+	result.Rows = len(rows)
+	for j := 0; j < len(result.RowAttributes); j++ {
+		result.RowAttributes[j].Values = make([]string, len(rows))
+	}
+	b := newMatrixBuilder(len(rows), r.Cef.Columns, true, false)
+	for i, row := range rows {
+		attrs, values, err := r.ReadRow(row)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < len(attrs); j++ {
+			result.RowAttributes[j].Values[i] = attrs[j]
+		}
+		b.appendRow(values)
+	}
+	b.finish(result)
+	result.orient()
+	return result, nil
+}
+
+// ReadRange returns a Cef with rows from (inclusive) to to (exclusive), zero-based
+func (r *IndexedReader) ReadRange(from int, to int) (*Cef, error) {
+	rows := make([]int, 0)
+	for i := from; i < to; i++ {
+		rows = append(rows, i)
+	}
+	return r.Read(rows)
+}
+
+// ReadKey returns a Cef with the rows where the key attribute has the given value
+func (r *IndexedReader) ReadKey(value string) (*Cef, error) {
+	rows, err := r.Find(value)
+	if err != nil {
+		return nil, err
+	}
+	return r.Read(rows)
+}
+
+// writeRows writes the given rows (zero-based) to the output
+func (r *IndexedReader) writeRows(out io.Writer, rows []int) error {
+	template := withoutRowValues(r.Cef)
+	template.Rows = len(rows)
+	w, err := NewWriter(out, template)
+	if err != nil {
+		return err
+	}
+	defer w.Abort()
+	for _, row := range rows {
+		attrs, values, err := r.ReadRow(row)
+		if err != nil {
+			return err
+		}
+		if err := w.WriteRow(attrs, values); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
@@ -0,0 +1,110 @@
+package ceftools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeIndexedFile writes testText to a file, indexed on Gene, and returns its path
+func writeIndexedFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.cef")
+	if err := os.WriteFile(path, []byte(testText), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteIndexFile(path, "Gene"); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIndex(t *testing.T) {
+	r, err := ReadIndexed(writeIndexedFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, c := range []struct {
+		key  string
+		rows []int
+	}{{"Actb", []int{0, 1}}, {"Xist", []int{3}}, {"Sox2", []int{}}} {
+		rows, err := r.Find(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rows, c.rows) {
+			t.Errorf("found %v at %v, expected %v", c.key, rows, c.rows)
+		}
+	}
+	cef, err := r.ReadRange(1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testCef()
+	want.Rows = 3
+	want.Matrix = want.Matrix[3:]
+	for i := range want.RowAttributes {
+		want.RowAttributes[i].Values = want.RowAttributes[i].Values[1:]
+	}
+	checkSameCef(t, want, cef)
+}
+
+func TestIndexCorrupt(t *testing.T) {
+	path := writeIndexedFile(t)
+	data, err := os.ReadFile(IndexPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected bytes.Buffer
+	if err := CmdSelect(strings.NewReader(testText), &expected, "Gene=Actb", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index holds the magic number, size, modification time and row count, five row
+	// offsets, the key 'Gene', the bucket count, five bucket starts and four rows
+	cases := []struct {
+		name   string
+		offset int
+		value  int64
+	}{
+		{"negative row count", 20, -2},
+		{"huge row count", 20, 1 << 61},
+		{"offset beyond the file", 28 + 8*2, 1 << 40},
+		{"offsets out of order", 28 + 8*2, 1},
+		{"no buckets", 76, 0},
+		{"negative bucket count", 76, -5},
+		{"huge bucket count", 76, 1 << 61},
+		{"bucket beyond the rows", 84 + 8*1, 100},
+		{"buckets not covering the rows", 84 + 8*4, 3},
+		{"row out of range", 124, 1000},
+	}
+	for _, c := range cases {
+		corrupt := append([]byte{}, data...)
+		binary.LittleEndian.PutUint64(corrupt[c.offset:], uint64(c.value))
+		if _, err := ReadIndex(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("%v: expected an error", c.name)
+		}
+
+		// cef select falls back to reading the whole file
+		if err := os.WriteFile(IndexPath(path), corrupt, 0666); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		err = CmdSelect(f, &out, "Gene=Actb", false, false)
+		f.Close()
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+		} else if out.String() != expected.String() {
+			t.Errorf("%v: selected %q, expected %q", c.name, out.String(), expected.String())
+		}
+	}
+}
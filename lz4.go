@@ -0,0 +1,137 @@
+package ceftools
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errLz4 = errors.New("Invalid LZ4 data")
+
+// lz4Decompress decompresses one or more LZ4 frames (the format of the lz4 command, and the
+// default compression of Feather files), appending to dst. Checksums are not verified.
+func lz4Decompress(dst []byte, src []byte) ([]byte, error) {
+	for len(src) > 0 {
+		if len(src) < 8 {
+			return nil, errLz4
+		}
+		magic := binary.LittleEndian.Uint32(src)
+		if magic&0xFFFFFFF0 == 0x184D2A50 {
+			// A skippable frame
+			size := int(binary.LittleEndian.Uint32(src[4:]))
+			if len(src)-8 < size {
+				return nil, errLz4
+			}
+			src = src[8+size:]
+			continue
+		}
+		flags := src[4]
+		if magic != 0x184D2204 || flags>>6 != 1 {
+			return nil, errLz4
+		}
+		pos := 6 // After the magic number, the flags and the block size
+		if flags&0x08 != 0 {
+			pos += 8 // The content size
+		}
+		if flags&0x01 != 0 {
+			pos += 4 // The dictionary ID
+		}
+		pos++ // The header checksum
+
+		// The blocks, ending with a zero size
+		for {
+			if len(src)-pos < 4 {
+				return nil, errLz4
+			}
+			size := binary.LittleEndian.Uint32(src[pos:])
+			pos += 4
+			if size == 0 {
+				break
+			}
+			n := int(size & 0x7FFFFFFF)
+			if len(src)-pos < n {
+				return nil, errLz4
+			}
+			var err error
+			if size&0x80000000 != 0 {
+				dst = append(dst, src[pos:pos+n]...) // Stored uncompressed
+			} else if dst, err = lz4Block(dst, src[pos:pos+n]); err != nil {
+				return nil, err
+			}
+			pos += n
+			if flags&0x10 != 0 {
+				pos += 4 // The block checksum
+			}
+		}
+		if flags&0x04 != 0 {
+			pos += 4 // The content checksum
+		}
+		if pos > len(src) {
+			return nil, errLz4
+		}
+		src = src[pos:]
+	}
+	return dst, nil
+}
+
+// lz4Block decompresses an LZ4 block, appending to dst (which holds the preceding blocks,
+// since later blocks can refer back to them)
+func lz4Block(dst []byte, src []byte) ([]byte, error) {
+	pos := 0
+	length := func(n int) (int, error) {
+		if n != 15 {
+			return n, nil
+		}
+		for {
+			if pos >= len(src) {
+				return 0, errLz4
+			}
+			b := src[pos]
+			pos++
+			n += int(b)
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+	for pos < len(src) {
+		token := src[pos]
+		pos++
+
+		// The literals
+		n, err := length(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if len(src)-pos < n {
+			return nil, errLz4
+		}
+		dst = append(dst, src[pos:pos+n]...)
+		pos += n
+		if pos == len(src) {
+			break // The last sequence has no match
+		}
+
+		// The match, which may overlap the bytes it produces
+		if len(src)-pos < 2 {
+			return nil, errLz4
+		}
+		offset := int(binary.LittleEndian.Uint16(src[pos:]))
+		pos += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errLz4
+		}
+		if n, err = length(int(token & 15)); err != nil {
+			return nil, err
+		}
+		n += 4
+		start := len(dst) - offset
+		if offset >= n {
+			dst = append(dst, dst[start:start+n]...)
+		} else {
+			for k := 0; k < n; k++ {
+				dst = append(dst, dst[start+k])
+			}
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,105 @@
+package ceftools
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+// ReadMapped opens an uncompressed binary CEB file with the main matrix memory-mapped
+// instead of read into memory, so that only the parts that are used are paged in. If
+// writable is set, changes to the matrix are written back to the file; otherwise they
+// are private to the process. The Cef must be closed when no longer needed.
+func ReadMapped(path string, writable bool) (*Cef, error) {
+	if !hostLittleEndian() {
+		return nil, errors.New("Memory-mapping is only supported on little-endian machines")
+	}
+	mode := os.O_RDONLY
+	if writable {
+		mode = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, mode, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Read the headers and attributes
+	cr := &cebReader{r: bufio.NewReader(f)}
+	if magic, err := cr.r.Peek(4); err != nil || binary.LittleEndian.Uint32(magic) != MagicCEB {
+		return nil, errors.New("Only uncompressed binary CEB files can be memory-mapped")
+	}
+	cef, err := cr.readPreamble()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	start := cr.n
+	size := int64(cef.Rows) * int64(cef.Columns) * 4
+	if fi.Size() < start+size {
+		return nil, errors.New(fmt.Sprintf("Truncated CEB file (expected %v bytes, found %v)", start+size, fi.Size()))
+	}
+	if size == 0 {
+		cef.Matrix = make([]float32, 0)
+		cef.orient()
+		return cef, nil
+	}
+
+	// Map the whole file (the matrix is aligned within it, but the mapping must start at
+	// the beginning of a page) and view the matrix section as float32 values
+	mapped, err := mapFile(f, int(start+size), writable)
+	if err != nil {
+		return nil, err
+	}
+	cef.mapped = mapped
+	cef.checksumAt = cr.checksumAt
+	cef.Matrix = unsafe.Slice((*float32)(unsafe.Pointer(&mapped[start])), cef.Rows*cef.Columns)
+	cef.orient()
+	return cef, nil
+}
+
+// updateChecksum rewrites the 'Checksum' header of a memory-mapped file, if it has one,
+// after the main matrix has been changed in place
+func (cef *Cef) updateChecksum() error {
+	if cef.mapped == nil || cef.checksumAt == 0 {
+		return nil
+	}
+	old := checksumValue(cef.Headers)
+	sum := checksumOf(cef.storage(), cef.Flags, false)
+	if !strings.HasPrefix(old, checksumPrefix) || len(sum) != len(old) {
+		return errors.New("Cannot update a checksum of unknown format in place: " + old)
+	}
+	copy(cef.mapped[cef.checksumAt:], sum)
+	for i := 0; i < len(cef.Headers); i++ {
+		if cef.Headers[i].Name == checksumHeader {
+			cef.Headers[i].Value = sum
+			break
+		}
+	}
+	return nil
+}
+
+// Close releases the memory-mapped file backing the main matrix, if any (see ReadMapped),
+// after which the matrix must not be used
+func (cef *Cef) Close() error {
+	if cef.mapped == nil {
+		return nil
+	}
+	err := unmapFile(cef.mapped)
+	cef.mapped = nil
+	cef.Matrix = nil
+	return err
+}
+
+// hostLittleEndian checks that the matrix of a CEB file can be used as it is stored
+func hostLittleEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
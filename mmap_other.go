@@ -0,0 +1,16 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package ceftools
+
+import (
+	"errors"
+	"os"
+)
+
+func mapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	return nil, errors.New("Memory-mapping is not supported on this platform")
+}
+
+func unmapFile(mapped []byte) error {
+	return nil
+}
@@ -0,0 +1,123 @@
+package ceftools
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCebFile writes the Cef to a CEB file, with a checksum if requested, and returns its path
+func writeCebFile(t *testing.T, cef *Cef, checksum bool) string {
+	t.Helper()
+	WriteChecksum = checksum
+	defer func() { WriteChecksum = false }()
+	path := filepath.Join(t.TempDir(), "test.ceb")
+	if err := os.WriteFile(path, writeTestCeb(t, cef), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadMapped(t *testing.T) {
+	for _, cef := range []*Cef{testCef(), testCef().Transpose()} {
+		path := writeCebFile(t, cef, false)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped, err := ReadMapped(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mapped.mapped == nil {
+			t.Error("the matrix is not memory-mapped")
+		}
+		checkSameCef(t, cef, mapped)
+
+		// Changes are private unless the file is mapped writable
+		mapped.Set(3, 2, 8)
+		if mapped.Get(3, 2) != 8 {
+			t.Errorf("value %v after Set, expected 8", mapped.Get(3, 2))
+		}
+		if err := mapped.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if mapped.Matrix != nil {
+			t.Error("the matrix is still set after Close")
+		}
+		if after, _ := os.ReadFile(path); !bytes.Equal(after, data) {
+			t.Error("a read-only mapping changed the file")
+		}
+	}
+}
+
+func TestReadMappedWritable(t *testing.T) {
+	for _, checksum := range []bool{false, true} {
+		path := writeCebFile(t, testCef().Transpose(), checksum)
+		mapped, err := ReadMapped(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped.Set(2, 3, 8)
+		if err := mapped.updateChecksum(); err != nil {
+			t.Fatal(err)
+		}
+		if err := mapped.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := readCeb(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := testCef().Transpose()
+		want.Set(2, 3, 8)
+		if checksum {
+			want.Headers = result.Headers
+		}
+		checkSameCef(t, want, result)
+
+		// The checksum recorded in the file was updated with the matrix
+		if !checksum {
+			continue
+		}
+		f, err = os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CmdVerify(f, io.Discard)
+		f.Close()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestReadMappedInvalid(t *testing.T) {
+	path := writeCebFile(t, testCef(), false)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)-1], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMapped(path, false); err == nil || !strings.HasPrefix(err.Error(), "Truncated CEB file") {
+		t.Errorf("got error %v for a truncated file", err)
+	}
+	if err := os.WriteFile(path, []byte(testText), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMapped(path, false); err == nil || err.Error() != "Only uncompressed binary CEB files can be memory-mapped" {
+		t.Errorf("got error %v for a text file", err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package ceftools
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of the file into memory, shared with the file if
+// writable, otherwise copy-on-write
+func mapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	flags := syscall.MAP_PRIVATE
+	if writable {
+		flags = syscall.MAP_SHARED
+	}
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, flags)
+}
+
+func unmapFile(mapped []byte) error {
+	return syscall.Munmap(mapped)
+}
@@ -0,0 +1,301 @@
+package ceftools
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// At most this many entries are allocated up front, whatever the size line of the file says
+const mtxPrealloc = 1 << 16
+
+type mtxEntry struct {
+	row   int32
+	col   int32
+	value float32
+}
+type mtxEntries []mtxEntry
+
+func (a mtxEntries) Len() int      { return len(a) }
+func (a mtxEntries) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a mtxEntries) Less(i, j int) bool {
+	return a[i].row < a[j].row || (a[i].row == a[j].row && a[i].col < a[j].col)
+}
+
+// ReadMtx reads a Matrix Market coordinate file (real or integer field, general or symmetric
+// layout). The optional row and column attribute tables are tab-delimited, with attribute
+// names on the first line and then one line per row (or column) of the matrix.
+func ReadMtx(f io.Reader, rowAttrs io.Reader, colAttrs io.Reader, transposed bool) (*Cef, error) {
+	r, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	// Parse the banner
+	if !scanner.Scan() {
+		return nil, errors.New("Empty Matrix Market file")
+	}
+	banner := strings.Fields(strings.ToLower(scanner.Text()))
+	if len(banner) != 5 || banner[0] != "%%matrixmarket" || banner[1] != "matrix" {
+		return nil, errors.New("Not a Matrix Market file (line 1 should be like '%%MatrixMarket matrix coordinate real general')")
+	}
+	if banner[2] != "coordinate" {
+		return nil, errors.New("Unsupported Matrix Market format '" + banner[2] + "' (only 'coordinate' is supported)")
+	}
+	field := banner[3]
+	if field != "real" && field != "integer" {
+		return nil, errors.New("Unsupported Matrix Market field '" + field + "' (only 'real' and 'integer' are supported)")
+	}
+	symmetry := banner[4]
+	if symmetry != "general" && symmetry != "symmetric" {
+		return nil, errors.New("Unsupported Matrix Market symmetry '" + symmetry + "' (only 'general' and 'symmetric' are supported)")
+	}
+
+	// Skip comments and parse the size line
+	line := 1
+	var size []string
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '%' {
+			continue
+		}
+		size = strings.Fields(text)
+		break
+	}
+	if len(size) != 3 {
+		return nil, errors.New(fmt.Sprintf("Invalid size line (line %v of the Matrix Market file should give rows, columns and entries)", line))
+	}
+	counts := make([]int, 3)
+	for i := 0; i < 3; i++ {
+		counts[i], err = strconv.Atoi(size[i])
+		if err != nil || counts[i] < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid size line (line %v of the Matrix Market file should give rows, columns and entries)", line))
+		}
+	}
+	nRows, nColumns, nEntries := counts[0], counts[1], counts[2]
+	if symmetry == "symmetric" && nRows != nColumns {
+		return nil, errors.New("Symmetric Matrix Market file is not square")
+	}
+
+	// Read the entries
+	entries := make([]mtxEntry, 0, min(nEntries, mtxPrealloc))
+	for n := 0; n < nEntries; {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New(fmt.Sprintf("Truncated Matrix Market file (found %v of %v entries)", n, nEntries))
+		}
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0][0] == '%' {
+			continue
+		}
+		n++
+		if len(fields) != 3 {
+			return nil, errors.New(fmt.Sprintf("Invalid entry on line %v of the Matrix Market file (should be 'row column value')", line))
+		}
+		i, err1 := strconv.Atoi(fields[0])
+		j, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil || i < 1 || i > nRows || j < 1 || j > nColumns {
+			return nil, errors.New(fmt.Sprintf("Invalid row or column index on line %v of the Matrix Market file", line))
+		}
+		var val float64
+		if field == "integer" {
+			temp, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid integer value on line %v of the Matrix Market file: %v", line, fields[2]))
+			}
+			val = float64(temp)
+		} else {
+			val, err = strconv.ParseFloat(fields[2], 32)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid float32 value on line %v of the Matrix Market file: %v", line, fields[2]))
+			}
+		}
+		entries = append(entries, mtxEntry{int32(i - 1), int32(j - 1), float32(val)})
+		if symmetry == "symmetric" && i != j {
+			entries = append(entries, mtxEntry{int32(j - 1), int32(i - 1), float32(val)})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Build the matrix row by row (duplicate entries are summed)
+	sort.Sort(mtxEntries(entries))
+	cef := new(Cef)
+	cef.Rows = nRows
+	cef.Columns = nColumns
+	cef.Headers = make([]Header, 0)
+	b := newMatrixBuilder(nRows, nColumns, true, transposed)
+	next := 0
+	for i := 0; i < nRows; i++ {
+		cols := make([]int32, 0)
+		vals := make([]float32, 0)
+		for ; next < len(entries) && int(entries[next].row) == i; next++ {
+			e := entries[next]
+			if len(cols) > 0 && cols[len(cols)-1] == e.col {
+				vals[len(vals)-1] += e.value
+			} else {
+				cols = append(cols, e.col)
+				vals = append(vals, e.value)
+			}
+		}
+		b.appendSparseRow(cols, vals)
+	}
+	b.finish(cef)
+
+	// Read the attributes
+	cef.RowAttributes = make([]Attribute, 0)
+	if rowAttrs != nil {
+		if cef.RowAttributes, err = readAttributeTable(rowAttrs, nRows, "row"); err != nil {
+			return nil, err
+		}
+	}
+	cef.ColumnAttributes = make([]Attribute, 0)
+	if colAttrs != nil {
+		if cef.ColumnAttributes, err = readAttributeTable(colAttrs, nColumns, "column"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Exchange the rows and columns
+	if transposed {
+		cef.Rows, cef.Columns = cef.Columns, cef.Rows
+		cef.RowAttributes, cef.ColumnAttributes = cef.ColumnAttributes, cef.RowAttributes
+	}
+	return cef, nil
+}
+
+// readAttributeTable reads a tab-delimited table of attributes, with the attribute names on
+// the first line and one line for each of the n rows (or columns)
+func readAttributeTable(f io.Reader, n int, what string) ([]Attribute, error) {
+	in, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(in)
+	r.Comma = '\t'
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	names, err := r.Read()
+	if err != nil {
+		return nil, errors.New("Missing attribute names in the " + what + " attribute table")
+	}
+	attrs := make([]Attribute, len(names))
+	for i := 0; i < len(names); i++ {
+		attrs[i] = Attribute{names[i], make([]string, 0, n)}
+	}
+	for i := 0; ; i++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			if i != n {
+				return nil, errors.New(fmt.Sprintf("The %v attribute table has %v entries, but the matrix has %v %vs", what, i, n, what))
+			}
+			return attrs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i >= n {
+			return nil, errors.New(fmt.Sprintf("The %v attribute table has more entries than the matrix has %vs (%v)", what, what, n))
+		}
+		for j := 0; j < len(attrs); j++ {
+			value := ""
+			if j < len(record) {
+				value = record[j]
+			}
+			attrs[j].Values = append(attrs[j].Values, value)
+		}
+	}
+}
+
+// writeAttributeTable writes a tab-delimited table of attributes (see readAttributeTable)
+func writeAttributeTable(f io.Writer, attrs []Attribute, n int) error {
+	w := csv.NewWriter(f)
+	w.Comma = '\t'
+	record := make([]string, len(attrs))
+	for j := 0; j < len(attrs); j++ {
+		record[j] = attrs[j].Name
+	}
+	w.Write(record)
+	for i := 0; i < n; i++ {
+		for j := 0; j < len(attrs); j++ {
+			record[j] = attrs[j].Values[i]
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// WriteMtx writes the main matrix as a Matrix Market coordinate file in general layout, using
+// the integer field if all values are whole numbers. Matrix Market has no missing values, so
+// they are left out, like zeros. If given, the row and column attributes are written to
+// separate attribute tables (see ReadMtx).
+func WriteMtx(cef *Cef, f io.Writer, rowAttrs io.Writer, colAttrs io.Writer, transposed bool) error {
+	if transposed {
+		cef = cef.Transpose()
+	}
+
+	// Count the non-zero values (other than missing values), and check if they are all integers
+	field := "integer"
+	nEntries := 0
+	for i := 0; i < cef.Rows; i++ {
+		_, vals := cef.nonZeros(i)
+		for _, val := range vals {
+			if val == 0 || val != val {
+				continue
+			}
+			nEntries++
+			if float32(int64(val)) != val {
+				field = "real"
+			}
+		}
+	}
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%%%%MatrixMarket matrix coordinate %v general\n", field)
+	fmt.Fprintf(w, "%v %v %v\n", cef.Rows, cef.Columns, nEntries)
+	value := make([]byte, 0, 32)
+	for i := 0; i < cef.Rows; i++ {
+		cols, vals := cef.nonZeros(i)
+		for k := 0; k < len(cols); k++ {
+			if vals[k] != 0 && vals[k] == vals[k] {
+				// Integers are written in full, since readers reject exponents (like 1e+06)
+				if field == "integer" {
+					value = strconv.AppendInt(value[:0], int64(vals[k]), 10)
+				} else {
+					value = strconv.AppendFloat(value[:0], float64(vals[k]), 'g', -1, 32)
+				}
+				fmt.Fprintf(w, "%v %v %s\n", i+1, cols[k]+1, value)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// Write the attributes
+	if rowAttrs != nil {
+		if err := writeAttributeTable(rowAttrs, cef.RowAttributes, cef.Rows); err != nil {
+			return err
+		}
+	}
+	if colAttrs != nil {
+		if err := writeAttributeTable(colAttrs, cef.ColumnAttributes, cef.Columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
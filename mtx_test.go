@@ -0,0 +1,60 @@
+package ceftools
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMtxMissing(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMtx(testCef(), &buf, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	want := "%%MatrixMarket matrix coordinate real general\n4 3 6\n1 1 1\n1 2 2\n2 1 3\n2 2 4\n4 1 0.5\n4 3 7\n"
+	if buf.String() != want {
+		t.Errorf("wrote %q, expected %q", buf.String(), want)
+	}
+
+	// Without the fraction, the values are integers
+	cef := testCef()
+	cef.Matrix[9] = 1
+	buf.Reset()
+	if err := WriteMtx(cef, &buf, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "%%MatrixMarket matrix coordinate integer general\n") {
+		t.Errorf("wrote %q, expected integer values", buf.String())
+	}
+	if _, err := ReadMtx(&buf, nil, nil, false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMtxRoundTripLargeCounts(t *testing.T) {
+	cef := testCef()
+	cef.Matrix[0] = 1000000
+	cef.Matrix[1] = 16777216
+	cef.Matrix[9] = 1
+	var buf bytes.Buffer
+	if err := WriteMtx(cef, &buf, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\n1 1 1000000\n1 2 16777216\n") {
+		t.Errorf("wrote %q, expected the counts in full", buf.String())
+	}
+	result, err := ReadMtx(&buf, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Get(0, 0) != 1000000 || result.Get(0, 1) != 16777216 {
+		t.Errorf("read %v and %v, expected 1000000 and 16777216", result.Get(0, 0), result.Get(0, 1))
+	}
+}
+
+func TestReadMtxBogusSize(t *testing.T) {
+	text := "%%MatrixMarket matrix coordinate integer general\n2 2 1000000000000\n1 1 1\n"
+	if _, err := ReadMtx(strings.NewReader(text), nil, nil, false); err == nil || !strings.HasPrefix(err.Error(), "Truncated Matrix Market file") {
+		t.Errorf("expected a truncated file, got %v", err)
+	}
+}
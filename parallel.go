@@ -0,0 +1,185 @@
+package ceftools
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// Threads is the number of cores used to parse and format the main matrix of text CEF files,
+// or zero to use all cores. With more than one, Read holds the text of the main matrix in
+// memory while parsing it.
+var Threads = 1
+
+func threads() int {
+	if Threads <= 0 {
+		return runtime.NumCPU()
+	}
+	return Threads
+}
+
+// The text is split into this many chunks per thread, to even out the load
+const chunksPerThread = 4
+
+// parallelFor calls f(0) to f(n-1), using the given number of threads
+func parallelFor(n int, nThreads int, f func(k int)) {
+	jobs := make(chan int, n)
+	for k := 0; k < n; k++ {
+		jobs <- k
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for t := 0; t < nThreads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range jobs {
+				f(k)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// forLines calls f for each non-empty line of the text, where lines are separated by any
+// number of carriage returns and newlines (as for readRow)
+func forLines(data []byte, f func(line []byte) bool) {
+	for len(data) > 0 {
+		end := bytes.IndexAny(data, "\r\n")
+		if end == -1 {
+			end = len(data)
+		}
+		if end > 0 && !f(data[:end]) {
+			return
+		}
+		for end < len(data) && (data[end] == '\r' || data[end] == '\n') {
+			end++
+		}
+		data = data[end:]
+	}
+}
+
+// parseRowsParallel parses the rows of the main matrix from the text that follows the
+// preamble, in line-aligned chunks on several threads. It returns false if the text contains
+// anything that readRow would report as an error or read differently (such as invalid values,
+// missing rows or surplus fields), so that the caller can parse it again one row at a time.
+func parseRowsParallel(data []byte, cef *Cef) bool {
+	nThreads := threads()
+
+	// Split the text into chunks that start at the beginning of a line
+	bounds := []int{0}
+	nChunks := nThreads * chunksPerThread
+	for k := 1; k < nChunks; k++ {
+		pos := len(data) * k / nChunks
+		if pos <= bounds[len(bounds)-1] {
+			continue
+		}
+		end := bytes.IndexAny(data[pos:], "\r\n")
+		if end == -1 {
+			break
+		}
+		bounds = append(bounds, pos+end+1)
+	}
+	bounds = append(bounds, len(data))
+	nChunks = len(bounds) - 1
+
+	// Count the rows in each chunk, to number them
+	starts := make([]int, nChunks+1)
+	parallelFor(nChunks, nThreads, func(k int) {
+		n := 0
+		forLines(data[bounds[k]:bounds[k+1]], func(line []byte) bool {
+			n++
+			return true
+		})
+		starts[k+1] = n
+	})
+	for k := 0; k < nChunks; k++ {
+		starts[k+1] += starts[k]
+	}
+	if starts[nChunks] < cef.Rows {
+		return false
+	}
+
+	// Parse the chunks
+	cef.Matrix = make([]float32, cef.Rows*cef.Columns)
+	cef.Sparse = nil
+	failed := make([]bool, nChunks)
+	parallelFor(nChunks, nThreads, func(k int) {
+		i := starts[k]
+		forLines(data[bounds[k]:bounds[k+1]], func(line []byte) bool {
+			if i >= cef.Rows {
+				return false
+			}
+			if !parseLine(line, i, cef) {
+				failed[k] = true
+				return false
+			}
+			i++
+			return true
+		})
+	})
+	for k := 0; k < nChunks; k++ {
+		if failed[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLine parses row i (zero-based) from a single line, as readRow does, and returns
+// false if readRow would not accept it or would read it differently
+func parseLine(line []byte, i int, cef *Cef) bool {
+	// A line with too few fields is an error, reported by readRow
+	more := true
+	nextField := func() ([]byte, bool) {
+		if !more {
+			return nil, false
+		}
+		end := bytes.IndexByte(line, '\t')
+		if end == -1 {
+			field := line
+			line = line[len(line):]
+			more = false
+			return field, true
+		}
+		field := line[:end]
+		line = line[end+1:]
+		return field, true
+	}
+	for j := 0; j < len(cef.RowAttributes); j++ {
+		field, ok := nextField()
+		if !ok || !utf8.Valid(field) {
+			return false
+		}
+		if LegacyQuoting && len(field) > 0 && field[0] == '"' {
+			// Quoted fields may span several lines
+			return false
+		}
+		cef.RowAttributes[j].Values[i] = unescapeField(field)
+	}
+	if _, ok := nextField(); !ok {
+		return false
+	}
+	for j := 0; j < cef.Columns; j++ {
+		// The value is only parsed, so there is no need to copy the text
+		field, ok := nextField()
+		if !ok {
+			return false
+		}
+		val, err := parseValue(unsafe.String(unsafe.SliceData(field), len(field)))
+		if err != nil {
+			return false
+		}
+		cef.Matrix[i*cef.Columns+j] = val
+	}
+
+	// Anything but trailing whitespace would be read as the start of the next row
+	for _, c := range line {
+		if c != ' ' && c != '\t' {
+			return false
+		}
+	}
+	return true
+}
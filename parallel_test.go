@@ -0,0 +1,144 @@
+package ceftools
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// parallelTestCef returns a file with enough rows to be formatted in several rounds of
+// batches, with escaped characters in the row attributes and values of every kind
+func parallelTestCef() *Cef {
+	const rows = 3000
+	cef := &Cef{
+		Rows:             rows,
+		Columns:          5,
+		Headers:          []Header{{"Citation", "Doe\tet al.\n2015"}},
+		RowAttributes:    []Attribute{{"Gene", make([]string, rows)}, {"Note", make([]string, rows)}},
+		ColumnAttributes: []Attribute{{"CellID", []string{"c1", "c2", "c3", "c4", "c5"}}},
+		Matrix:           make([]float32, rows*5),
+	}
+	for i := 0; i < rows; i++ {
+		cef.RowAttributes[0].Values[i] = fmt.Sprintf("g%v", i)
+		cef.RowAttributes[1].Values[i] = []string{"", "a\tb", "line\nbreak", `back\slash`, "ünïcode"}[i%5]
+		cef.Matrix[i*5] = float32(i)
+		cef.Matrix[i*5+1] = float32(i) / 7
+		cef.Matrix[i*5+2] = -float32(i) * 1e-9
+		if i%11 == 0 {
+			cef.Matrix[i*5+3] = float32(math.NaN())
+		}
+		cef.Matrix[i*5+4] = float32(i) * 1e30
+	}
+	return cef
+}
+
+func TestParallelWrite(t *testing.T) {
+	defer func() { Threads = 1 }()
+	cef := parallelTestCef()
+	for _, transposed := range []bool{false, true} {
+		var expected bytes.Buffer
+		if err := Write(cef, &expected, transposed); err != nil {
+			t.Fatal(err)
+		}
+		for _, threads := range []int{2, 3, 0} {
+			Threads = threads
+			var buf bytes.Buffer
+			if err := Write(cef, &buf, transposed); err != nil {
+				t.Fatal(err)
+			}
+			Threads = 1
+			if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+				t.Errorf("%v threads (transposed: %v): output differs from a single thread", threads, transposed)
+			}
+		}
+	}
+}
+
+// editRows changes the lines of the given rows of the main matrix in the text of parallelTestCef
+func editRows(text string, from int, to int, f func(line string) string) string {
+	lines := strings.SplitAfter(text, "\n")
+	for i := from; i < to; i++ {
+		lines[len(lines)-3001+i] = f(lines[len(lines)-3001+i])
+	}
+	return strings.Join(lines, "")
+}
+
+// withNA writes a missing value as 'NA'
+func withNA(line string) string {
+	fields := strings.Split(line, "\t")
+	if fields[6] == "" {
+		fields[6] = "NA"
+	}
+	return strings.Join(fields, "\t")
+}
+
+func TestParallelRead(t *testing.T) {
+	defer func() { Threads = 1 }()
+	var text bytes.Buffer
+	if err := Write(parallelTestCef(), &text, false); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		text string
+	}{
+		{"as written", text.String()},
+		{"CRLF", strings.ReplaceAll(text.String(), "\n", "\r\n")},
+		{"blank lines", strings.ReplaceAll(text.String(), "\n", "\n\n")},
+		{"trailing whitespace", editRows(text.String(), 0, 3000, func(line string) string { return strings.TrimSuffix(line, "\n") + "\t  \n" })},
+		{"missing values as NA", editRows(text.String(), 0, 3000, withNA)},
+	}
+	for _, c := range cases {
+		Threads = 1
+		expected, err := Read(strings.NewReader(c.text), false)
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		checkSameCef(t, parallelTestCef(), expected)
+		for _, threads := range []int{2, 3, 0} {
+			Threads = threads
+			result, err := Read(strings.NewReader(c.text), false)
+			Threads = 1
+			if err != nil {
+				t.Fatalf("%v, %v threads: %v", c.name, threads, err)
+			}
+			checkSameCef(t, expected, result)
+		}
+	}
+}
+
+func TestParallelReadErrors(t *testing.T) {
+	// Text that the parallel parser does not accept is parsed again one row at a time,
+	// giving the same errors with the same line numbers
+	defer func() { Threads = 1 }()
+	var text bytes.Buffer
+	if err := Write(parallelTestCef(), &text, false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(text.String(), "\n")
+	cases := []struct {
+		name string
+		text string
+	}{
+		{"invalid value", editRows(text.String(), 1700, 1701, func(line string) string { return strings.Replace(line, "\t1700\t", "\t17x0\t", 1) })},
+		{"too few fields", editRows(text.String(), 2500, 2501, func(line string) string { return line[:strings.LastIndex(line[:len(line)-2], "\t")] + "\n" })},
+		{"surplus field", editRows(text.String(), 2000, 2001, func(line string) string { return strings.TrimSuffix(line, "\n") + "\t1\n" })},
+		{"missing rows", strings.Join(lines[:len(lines)-500], "")},
+	}
+	for _, c := range cases {
+		_, expected := Read(strings.NewReader(c.text), false)
+		if expected == nil {
+			t.Fatalf("%v: expected an error", c.name)
+		}
+		for _, threads := range []int{2, 3, 0} {
+			Threads = threads
+			_, err := Read(strings.NewReader(c.text), false)
+			Threads = 1
+			if err == nil || err.Error() != expected.Error() {
+				t.Errorf("%v, %v threads: got error %v, expected %v", c.name, threads, err, expected)
+			}
+		}
+	}
+}
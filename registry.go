@@ -0,0 +1,216 @@
+package ceftools
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Format is a named file format that can be read and/or written as a whole, by 'cef convert'
+// and by the import and export commands (see RegisterFormat)
+type Format struct {
+	Name        string   // Like "cef", as given to 'cef convert --from' and '--to'
+	Description string   // A short description, shown by 'cef convert --list'
+	Extensions  []string // File name extensions that identify the format, like ".cef"
+
+	// Sniff reports whether a file that starts with the given bytes (at most sniffLength of
+	// them, after decompression) is in this format. It is nil if the format cannot be
+	// recognized by its content.
+	Sniff func(magic []byte) bool
+
+	// Read reads a whole file, or is nil if the format cannot be read. The input has already
+	// been decompressed.
+	Read func(f io.Reader, transposed bool) (*Cef, error)
+
+	// Write writes a whole file, or is nil if the format cannot be written. The output is
+	// compressed by the caller (see Compression), unless the format is a container.
+	Write func(cef *Cef, f io.Writer, transposed bool) error
+
+	// Container is set for formats that are compressed containers themselves, like the zip
+	// files of Excel, or that are read by seeking, like Arrow files. They are never compressed.
+	Container bool
+}
+
+// The number of leading bytes of a file passed to Format.Sniff
+const sniffLength = 64
+
+var formats []*Format
+
+// RegisterFormat makes a format available by name and to format detection, which tries the
+// formats in the order they were registered. It is meant to be called from an init function,
+// and panics if the name is empty or already registered.
+func RegisterFormat(format *Format) {
+	if format.Name == "" {
+		panic("ceftools: RegisterFormat called with an empty format name")
+	}
+	if LookupFormat(format.Name) != nil {
+		panic("ceftools: RegisterFormat called twice for format " + format.Name)
+	}
+	formats = append(formats, format)
+}
+
+// LookupFormat returns the registered format with the given name, or nil if there is none
+func LookupFormat(name string) *Format {
+	for _, format := range formats {
+		if format.Name == name {
+			return format
+		}
+	}
+	return nil
+}
+
+// Formats returns the registered formats, in the order they were registered
+func Formats() []*Format {
+	result := make([]*Format, len(formats))
+	copy(result, formats)
+	return result
+}
+
+// DetectFormat returns the first registered format that recognizes the start of a file, or
+// failing that, whose extensions match the file name (ignoring any '.gz' or '.zst' suffix).
+// Either may be empty. It returns nil if no format matches.
+func DetectFormat(magic []byte, path string) *Format {
+	if len(magic) > 0 {
+		for _, format := range formats {
+			if format.Sniff != nil && format.Sniff(magic) {
+				return format
+			}
+		}
+	}
+	if path != "" {
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext == ".gz" || ext == ".zst" {
+			ext = strings.ToLower(filepath.Ext(strings.TrimSuffix(path, filepath.Ext(path))))
+		}
+		for _, format := range formats {
+			for _, e := range format.Extensions {
+				if e == ext {
+					return format
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// formatNames lists the names of the registered formats that can be read (or written)
+func formatNames(write bool) string {
+	names := make([]string, 0, len(formats))
+	for _, format := range formats {
+		if (write && format.Write != nil) || (!write && format.Read != nil) {
+			names = append(names, "'"+format.Name+"'")
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// findFormat returns the registered format with the given name, if it can be read (or written)
+func findFormat(name string, write bool) (*Format, error) {
+	format := LookupFormat(name)
+	if format == nil || (write && format.Write == nil) || (!write && format.Read == nil) {
+		verb := "read"
+		if write {
+			verb = "written"
+		}
+		return nil, errors.New(fmt.Sprintf("Unknown format '%v' (formats that can be %v are %v)", name, verb, formatNames(write)))
+	}
+	return format, nil
+}
+
+func init() {
+	RegisterFormat(&Format{
+		Name:        "cef",
+		Description: "Cell expression format (tab-delimited text)",
+		Extensions:  []string{".cef"},
+		Sniff: func(magic []byte) bool {
+			return bytes.HasPrefix(magic, []byte("CEF\t"))
+		},
+		Read:  Read,
+		Write: writeCef,
+	})
+	RegisterFormat(&Format{
+		Name:        "ceb",
+		Description: "Cell expression binary format",
+		Extensions:  []string{".ceb"},
+		Sniff: func(magic []byte) bool {
+			return bytes.HasPrefix(magic, []byte("CEB\t"))
+		},
+		Read:  Read,
+		Write: WriteCeb,
+	})
+	RegisterFormat(&Format{
+		Name:        "strt",
+		Description: "Linnarsson lab legacy STRT format ('_expression.tab')",
+		Read:        ReadStrt,
+	})
+	RegisterFormat(&Format{
+		Name:        "mtx",
+		Description: "Matrix Market coordinate format (main matrix only)",
+		Extensions:  []string{".mtx"},
+		Sniff: func(magic []byte) bool {
+			return bytes.HasPrefix(bytes.ToLower(magic), []byte("%%matrixmarket"))
+		},
+		Read: func(f io.Reader, transposed bool) (*Cef, error) {
+			return ReadMtx(f, nil, nil, transposed)
+		},
+		Write: func(cef *Cef, f io.Writer, transposed bool) error {
+			return WriteMtx(cef, f, nil, nil, transposed)
+		},
+	})
+	RegisterFormat(&Format{
+		Name:        "gct",
+		Description: "GCT 1.2 expression format of GSEA (reads 1.3 as well)",
+		Extensions:  []string{".gct"},
+		Sniff: func(magic []byte) bool {
+			return bytes.HasPrefix(magic, []byte("#1.2"))
+		},
+		Read: ReadGct,
+		Write: func(cef *Cef, f io.Writer, transposed bool) error {
+			return WriteGct(cef, f, "1.2", transposed)
+		},
+	})
+	RegisterFormat(&Format{
+		Name:        "gct1.3",
+		Description: "GCT 1.3 expression format, with row and column metadata",
+		Sniff: func(magic []byte) bool {
+			return bytes.HasPrefix(magic, []byte("#1.3"))
+		},
+		Read: ReadGct,
+		Write: func(cef *Cef, f io.Writer, transposed bool) error {
+			return WriteGct(cef, f, "1.3", transposed)
+		},
+	})
+	RegisterFormat(&Format{
+		Name:        "arrow",
+		Description: "Arrow IPC file or stream (Feather v2), in the wide layout",
+		Extensions:  []string{".arrow", ".feather"},
+		Sniff: func(magic []byte) bool {
+			return bytes.HasPrefix(magic, arrowMagic) || bytes.HasPrefix(magic, []byte{0xFF, 0xFF, 0xFF, 0xFF})
+		},
+		Read: ReadArrow,
+		Write: func(cef *Cef, f io.Writer, transposed bool) error {
+			return WriteArrow(cef, f, false, transposed)
+		},
+		Container: true,
+	})
+	RegisterFormat(&Format{
+		Name:        "xlsx",
+		Description: "Excel workbook (matrix, headers and attribute summaries)",
+		Extensions:  []string{".xlsx"},
+		Write: func(cef *Cef, f io.Writer, transposed bool) error {
+			return WriteXlsx(cef, f, XlsxMaxRows, XlsxMaxColumns, transposed)
+		},
+		Container: true,
+	})
+	RegisterFormat(&Format{
+		Name:        "cls",
+		Description: "CLS phenotype labels of GSEA, from the column attribute 'Class'",
+		Extensions:  []string{".cls"},
+		Write: func(cef *Cef, f io.Writer, transposed bool) error {
+			return WriteCls(cef, f, "Class", transposed)
+		},
+	})
+}
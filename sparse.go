@@ -0,0 +1,366 @@
+package ceftools
+
+import (
+	"sort"
+)
+
+// SparseThreshold is the highest density (fraction of non-zero values) at which the main
+// matrix is kept in sparse storage when it is read or built. Set it to zero to always use
+// dense storage.
+var SparseThreshold = 0.25
+
+// The density of a matrix being built is first checked after this many rows
+const sparseSampleRows = 100
+
+// SparseMatrix is a matrix in compressed sparse row (CSR) format. The non-zero values of
+// row i are Values[RowStarts[i]:RowStarts[i+1]], and the corresponding entries of
+// ColumnIndexes give their columns, in increasing order.
+type SparseMatrix struct {
+	Rows          int
+	Columns       int
+	RowStarts     []int
+	ColumnIndexes []int32
+	Values        []float32
+
+	csc *SparseMatrix
+}
+
+// NewSparseMatrix creates an empty sparse matrix with the given number of columns;
+// rows are then added with AppendRow or AppendDenseRow
+func NewSparseMatrix(columns int) *SparseMatrix {
+	return &SparseMatrix{Columns: columns, RowStarts: []int{0}}
+}
+
+// find returns the position of the given entry, or the position where it would be inserted
+func (m *SparseMatrix) find(row int, col int) (int, bool) {
+	start := m.RowStarts[row]
+	end := m.RowStarts[row+1]
+	ix := start + sort.Search(end-start, func(k int) bool { return int(m.ColumnIndexes[start+k]) >= col })
+	return ix, ix < end && int(m.ColumnIndexes[ix]) == col
+}
+
+func (m *SparseMatrix) Get(row int, col int) float32 {
+	if ix, found := m.find(row, col); found {
+		return m.Values[ix]
+	}
+	return 0
+}
+
+// Set changes a single value. Inserting a new non-zero value moves all the following
+// entries, so a sparse matrix should be built row by row, not by calling Set.
+func (m *SparseMatrix) Set(row int, col int, val float32) {
+	m.csc = nil
+	ix, found := m.find(row, col)
+	if found {
+		m.Values[ix] = val
+		return
+	}
+	if val == 0 {
+		return
+	}
+	m.ColumnIndexes = append(m.ColumnIndexes, 0)
+	copy(m.ColumnIndexes[ix+1:], m.ColumnIndexes[ix:])
+	m.ColumnIndexes[ix] = int32(col)
+	m.Values = append(m.Values, 0)
+	copy(m.Values[ix+1:], m.Values[ix:])
+	m.Values[ix] = val
+	for i := row + 1; i <= m.Rows; i++ {
+		m.RowStarts[i]++
+	}
+}
+
+// Row returns the columns and values of the non-zero entries in the given row. The slices
+// share storage with the matrix.
+func (m *SparseMatrix) Row(row int) ([]int32, []float32) {
+	start := m.RowStarts[row]
+	end := m.RowStarts[row+1]
+	return m.ColumnIndexes[start:end], m.Values[start:end]
+}
+
+// DenseRow expands the given row into dst, which must hold Columns values
+func (m *SparseMatrix) DenseRow(row int, dst []float32) []float32 {
+	for i := 0; i < len(dst); i++ {
+		dst[i] = 0
+	}
+	cols, vals := m.Row(row)
+	for k := 0; k < len(cols); k++ {
+		dst[cols[k]] = vals[k]
+	}
+	return dst
+}
+
+// AppendRow adds a row, given by the columns (in increasing order) and values of its non-zero entries
+func (m *SparseMatrix) AppendRow(cols []int32, vals []float32) {
+	m.csc = nil
+	m.ColumnIndexes = append(m.ColumnIndexes, cols...)
+	m.Values = append(m.Values, vals...)
+	m.RowStarts = append(m.RowStarts, len(m.Values))
+	m.Rows++
+}
+
+// AppendDenseRow adds a row, storing only its non-zero values
+func (m *SparseMatrix) AppendDenseRow(values []float32) {
+	m.csc = nil
+	for j := 0; j < len(values); j++ {
+		if values[j] != 0 {
+			m.ColumnIndexes = append(m.ColumnIndexes, int32(j))
+			m.Values = append(m.Values, values[j])
+		}
+	}
+	m.RowStarts = append(m.RowStarts, len(m.Values))
+	m.Rows++
+}
+
+// Density returns the fraction of entries that are stored
+func (m *SparseMatrix) Density() float64 {
+	if m.Rows == 0 || m.Columns == 0 {
+		return 0
+	}
+	return float64(len(m.Values)) / float64(m.Rows) / float64(m.Columns)
+}
+
+// Transpose returns the transposed matrix, in CSR format
+func (m *SparseMatrix) Transpose() *SparseMatrix {
+	result := &SparseMatrix{Rows: m.Columns, Columns: m.Rows}
+	result.RowStarts = make([]int, m.Columns+1)
+	result.ColumnIndexes = make([]int32, len(m.Values))
+	result.Values = make([]float32, len(m.Values))
+
+	// Count the entries in each column, and turn the counts into starting positions
+	for _, col := range m.ColumnIndexes {
+		result.RowStarts[col+1]++
+	}
+	for i := 0; i < m.Columns; i++ {
+		result.RowStarts[i+1] += result.RowStarts[i]
+	}
+
+	// Scatter the entries, row by row so that they end up sorted within each column
+	next := make([]int, m.Columns)
+	copy(next, result.RowStarts)
+	for i := 0; i < m.Rows; i++ {
+		cols, vals := m.Row(i)
+		for k := 0; k < len(cols); k++ {
+			ix := next[cols[k]]
+			result.ColumnIndexes[ix] = int32(i)
+			result.Values[ix] = vals[k]
+			next[cols[k]]++
+		}
+	}
+	return result
+}
+
+// CSC returns the compressed sparse column (CSC) view of the matrix, represented as the
+// CSR form of its transpose, so that row i of the view is column i of the matrix. The view
+// is computed on first use and kept until the matrix is modified.
+func (m *SparseMatrix) CSC() *SparseMatrix {
+	if m.csc == nil {
+		m.csc = m.Transpose()
+	}
+	return m.csc
+}
+
+func (m *SparseMatrix) SwapRows(i, j int) {
+	if i == j {
+		return
+	}
+	if i > j {
+		i, j = j, i
+	}
+	m.csc = nil
+
+	// Rearrange the entries from row i to row j (inclusive) as row j, the rows in between, then row i
+	start := m.RowStarts[i]
+	end := m.RowStarts[j+1]
+	lenI := m.RowStarts[i+1] - start
+	lenJ := end - m.RowStarts[j]
+	cols := make([]int32, 0, end-start)
+	cols = append(cols, m.ColumnIndexes[m.RowStarts[j]:end]...)
+	cols = append(cols, m.ColumnIndexes[start+lenI:m.RowStarts[j]]...)
+	cols = append(cols, m.ColumnIndexes[start:start+lenI]...)
+	copy(m.ColumnIndexes[start:end], cols)
+	vals := make([]float32, 0, end-start)
+	vals = append(vals, m.Values[m.RowStarts[j]:end]...)
+	vals = append(vals, m.Values[start+lenI:m.RowStarts[j]]...)
+	vals = append(vals, m.Values[start:start+lenI]...)
+	copy(m.Values[start:end], vals)
+	for k := i + 1; k <= j; k++ {
+		m.RowStarts[k] += lenJ - lenI
+	}
+}
+
+// nonZeros returns the columns and values of the non-zero entries in the given row of the
+// main matrix (shared with the matrix if it is sparse)
+func (cef *Cef) nonZeros(row int) ([]int32, []float32) {
+	if cef.Sparse != nil && cef.Flags&Transposed != 0 {
+		return cef.Sparse.CSC().Row(row)
+	}
+	if cef.Sparse != nil {
+		return cef.Sparse.Row(row)
+	}
+	cols := make([]int32, 0)
+	vals := make([]float32, 0)
+	for j, val := range cef.GetRow(row) {
+		if val != 0 {
+			cols = append(cols, int32(j))
+			vals = append(vals, val)
+		}
+	}
+	return cols, vals
+}
+
+// Density returns the fraction of non-zero values in the main matrix
+func (cef *Cef) Density() float64 {
+	if cef.Sparse != nil {
+		return cef.Sparse.Density()
+	}
+	if len(cef.Matrix) == 0 {
+		return 0
+	}
+	n := 0
+	for _, val := range cef.Matrix {
+		if val != 0 {
+			n++
+		}
+	}
+	return float64(n) / float64(len(cef.Matrix))
+}
+
+// ToSparse converts the main matrix to sparse storage (in the same orientation)
+func (cef *Cef) ToSparse() {
+	if cef.Sparse != nil {
+		return
+	}
+	stored := cef.storage()
+	m := NewSparseMatrix(stored.Columns)
+	for i := 0; i < stored.Rows; i++ {
+		m.AppendDenseRow(stored.GetRow(i))
+	}
+	cef.Sparse = m
+	cef.Matrix = nil
+}
+
+// ToDense converts the main matrix to dense storage (in the same orientation)
+func (cef *Cef) ToDense() {
+	if cef.Sparse == nil {
+		return
+	}
+	stored := cef.storage()
+	matrix := make([]float32, stored.Rows*stored.Columns)
+	for i := 0; i < stored.Rows; i++ {
+		cef.Sparse.DenseRow(i, matrix[i*stored.Columns:(i+1)*stored.Columns])
+	}
+	cef.Matrix = matrix
+	cef.Sparse = nil
+}
+
+// matrixBuilder collects the main matrix one row at a time. If started sparse, it keeps
+// the matrix sparse unless its density turns out to exceed SparseThreshold.
+type matrixBuilder struct {
+	rows       int // The expected number of rows, or -1 if not known in advance
+	columns    int
+	transposed bool // Store the transpose (requires the number of rows)
+	n          int  // The number of rows added so far
+	dense      []float32
+	sparse     *SparseMatrix
+}
+
+func newMatrixBuilder(rows int, columns int, sparse bool, transposed bool) *matrixBuilder {
+	b := &matrixBuilder{rows: rows, columns: columns, transposed: transposed}
+	if sparse && SparseThreshold > 0 {
+		b.sparse = NewSparseMatrix(columns)
+	} else {
+		b.allocateDense()
+	}
+	return b
+}
+
+func (b *matrixBuilder) allocateDense() {
+	if b.rows >= 0 {
+		b.dense = make([]float32, b.rows*b.columns)
+	} else {
+		b.dense = make([]float32, 0, b.n*b.columns)
+	}
+}
+
+// denseRow returns the storage for the next row (not used when transposed)
+func (b *matrixBuilder) denseRow() []float32 {
+	if b.rows >= 0 {
+		return b.dense[b.n*b.columns : (b.n+1)*b.columns]
+	}
+	b.dense = append(b.dense, make([]float32, b.columns)...)
+	return b.dense[b.n*b.columns:]
+}
+
+func (b *matrixBuilder) appendRow(values []float32) {
+	if b.sparse != nil {
+		b.sparse.AppendDenseRow(values)
+		b.n++
+		b.checkDensity()
+		return
+	}
+	if b.transposed {
+		for j := 0; j < len(values); j++ {
+			b.dense[j*b.rows+b.n] = values[j]
+		}
+	} else {
+		copy(b.denseRow(), values)
+	}
+	b.n++
+}
+
+// appendSparseRow adds a row given by the columns (in increasing order) and values of its non-zero entries
+func (b *matrixBuilder) appendSparseRow(cols []int32, vals []float32) {
+	if b.sparse != nil {
+		b.sparse.AppendRow(cols, vals)
+		b.n++
+		b.checkDensity()
+		return
+	}
+	if b.transposed {
+		for k := 0; k < len(cols); k++ {
+			b.dense[int(cols[k])*b.rows+b.n] = vals[k]
+		}
+	} else {
+		row := b.denseRow()
+		for k := 0; k < len(cols); k++ {
+			row[cols[k]] = vals[k]
+		}
+	}
+	b.n++
+}
+
+// checkDensity switches to dense storage once the matrix is known to be too dense
+func (b *matrixBuilder) checkDensity() {
+	if b.n >= sparseSampleRows && b.sparse.Density() > SparseThreshold {
+		b.toDense()
+	}
+}
+
+func (b *matrixBuilder) toDense() {
+	sparse := b.sparse
+	n := b.n
+	b.sparse = nil
+	b.allocateDense()
+	b.n = 0
+	for i := 0; i < n; i++ {
+		b.appendSparseRow(sparse.Row(i))
+	}
+}
+
+// finish stores the matrix in the Cef (as Sparse or Matrix)
+func (b *matrixBuilder) finish(cef *Cef) {
+	if b.sparse != nil && b.sparse.Density() > SparseThreshold {
+		// Too few rows were added for checkDensity to decide
+		b.toDense()
+	}
+	if b.sparse != nil {
+		cef.Matrix = nil
+		cef.Sparse = b.sparse
+		if b.transposed {
+			cef.Sparse = b.sparse.Transpose()
+		}
+	} else {
+		cef.Matrix = b.dense
+		cef.Sparse = nil
+	}
+}
@@ -0,0 +1,195 @@
+package ceftools
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// sparseTestCef returns a file with 150 rows and 20 columns, with about one value in ten
+// non-zero (some of them missing)
+func sparseTestCef() *Cef {
+	cef := &Cef{
+		Rows:             150,
+		Columns:          20,
+		Headers:          []Header{{"Tissue", "cortex"}},
+		RowAttributes:    []Attribute{{"Gene", make([]string, 150)}},
+		ColumnAttributes: []Attribute{{"CellID", make([]string, 20)}},
+		Matrix:           make([]float32, 150*20),
+	}
+	for i := 0; i < cef.Rows; i++ {
+		cef.RowAttributes[0].Values[i] = fmt.Sprintf("g%v", i)
+		for j := 0; j < cef.Columns; j++ {
+			switch (i*7 + j*3) % 10 {
+			case 0:
+				cef.Matrix[i*cef.Columns+j] = float32(i+j) / 4
+			case 5:
+				if j == 0 {
+					cef.Matrix[i*cef.Columns+j] = float32(math.NaN())
+				}
+			}
+		}
+	}
+	for j := 0; j < cef.Columns; j++ {
+		cef.ColumnAttributes[0].Values[j] = fmt.Sprintf("c%v", j)
+	}
+	return cef
+}
+
+func TestSparseConversion(t *testing.T) {
+	for _, transposed := range []bool{false, true} {
+		dense := sparseTestCef()
+		if transposed {
+			dense = dense.Transpose()
+		}
+		sparse := *dense
+		sparse.ToSparse()
+		if sparse.Sparse == nil || sparse.Matrix != nil {
+			t.Fatal("ToSparse did not change the storage")
+		}
+		if d := sparse.Density(); math.Abs(d-dense.Density()) > 1e-9 || d > 0.15 {
+			t.Errorf("density %v, expected %v", d, dense.Density())
+		}
+		checkSameCef(t, dense, &sparse)
+		back := sparse
+		back.ToDense()
+		if back.Sparse != nil || len(back.Matrix) != len(dense.Matrix) {
+			t.Fatal("ToDense did not change the storage")
+		}
+		checkSameCef(t, dense, &back)
+	}
+}
+
+func TestSparseWrite(t *testing.T) {
+	// The output is the same whichever way the main matrix is held
+	for _, transposed := range []bool{false, true} {
+		dense := sparseTestCef()
+		if transposed {
+			dense = dense.Transpose()
+		}
+		sparse := *dense
+		sparse.ToSparse()
+		for _, c := range []struct {
+			name  string
+			write func(cef *Cef, buf *bytes.Buffer) error
+		}{
+			{"CEF", func(cef *Cef, buf *bytes.Buffer) error { return Write(cef, buf, false) }},
+			{"CEF, transposed", func(cef *Cef, buf *bytes.Buffer) error { return Write(cef, buf, true) }},
+			{"CEB", func(cef *Cef, buf *bytes.Buffer) error { return WriteCeb(cef, buf, false) }},
+		} {
+			var fromDense, fromSparse bytes.Buffer
+			if err := c.write(dense, &fromDense); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.write(&sparse, &fromSparse); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(fromDense.Bytes(), fromSparse.Bytes()) {
+				t.Errorf("%v (stored transposed: %v): sparse and dense output differ", c.name, transposed)
+			}
+		}
+	}
+}
+
+func TestSparseRead(t *testing.T) {
+	cef := sparseTestCef()
+	var text bytes.Buffer
+	if err := Write(cef, &text, false); err != nil {
+		t.Fatal(err)
+	}
+	ceb := writeTestCeb(t, cef)
+	read := func() []*Cef {
+		var result []*Cef
+		for _, threads := range []int{1, 2} {
+			Threads = threads
+			fromText, err := Read(bytes.NewReader(text.Bytes()), false)
+			Threads = 1
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, fromText)
+		}
+		fromCeb, err := readCeb(bufio.NewReader(bytes.NewReader(ceb)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(result, fromCeb)
+	}
+
+	// A sparse matrix is kept sparse
+	for _, result := range read() {
+		if result.Sparse == nil {
+			t.Error("a sparse matrix was read into dense storage")
+		}
+		checkSameCef(t, cef, result)
+	}
+
+	// ...unless sparse storage is turned off
+	SparseThreshold = 0
+	defer func() { SparseThreshold = 0.25 }()
+	for _, result := range read() {
+		if result.Sparse != nil {
+			t.Error("read into sparse storage with SparseThreshold = 0")
+		}
+		checkSameCef(t, cef, result)
+	}
+
+	// A dense matrix is stored dense
+	SparseThreshold = 0.25
+	result, err := Read(strings.NewReader(testText), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sparse != nil {
+		t.Error("a dense matrix was read into sparse storage")
+	}
+}
+
+func TestMatrixBuilder(t *testing.T) {
+	// The builder starts sparse, and switches to dense storage once the rows turn out to
+	// be too dense, whether or not the number of rows is known in advance
+	cef := sparseTestCef()
+	for i := 120; i < cef.Rows; i++ {
+		for j := 0; j < cef.Columns; j++ {
+			cef.Matrix[i*cef.Columns+j] = 1
+		}
+	}
+	for _, c := range []struct {
+		rows   int
+		n      int // The number of rows added
+		sparse bool
+	}{{cef.Rows, cef.Rows, false}, {-1, cef.Rows, false}, {cef.Rows, 120, true}, {-1, 120, true}} {
+		b := newMatrixBuilder(c.rows, cef.Columns, true, false)
+		for i := 0; i < c.n; i++ {
+			b.appendRow(cef.GetRow(i))
+		}
+		result := &Cef{Rows: c.n, Columns: cef.Columns}
+		b.finish(result)
+		if (result.Sparse != nil) != c.sparse {
+			t.Errorf("%v rows of %v: sparse %v, expected %v", c.n, c.rows, result.Sparse != nil, c.sparse)
+		}
+		for i := 0; i < c.n; i++ {
+			for j := 0; j < cef.Columns; j++ {
+				if w, g := cef.Get(i, j), result.Get(i, j); w != g && (w == w || g == g) {
+					t.Fatalf("%v rows of %v: value at (%v, %v) is %v, expected %v", c.n, c.rows, i, j, g, w)
+				}
+			}
+		}
+	}
+
+	// Rows given by their non-zero values are stored the same way, also when the
+	// transpose is built
+	b := newMatrixBuilder(cef.Rows, cef.Columns, true, true)
+	for i := 0; i < cef.Rows; i++ {
+		b.appendSparseRow(cef.nonZeros(i))
+	}
+	result := &Cef{Rows: cef.Columns, Columns: cef.Rows, RowAttributes: cef.ColumnAttributes, ColumnAttributes: cef.RowAttributes, Headers: cef.Headers}
+	b.finish(result)
+	if result.Sparse != nil {
+		t.Error("a dense matrix was kept sparse")
+	}
+	checkSameCef(t, cef.Transpose(), result)
+}
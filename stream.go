@@ -0,0 +1,378 @@
+package ceftools
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Reader reads a CEF or CEB file one row at a time, so that the main matrix never
+// needs to be held in memory. The rows are read as they are stored, so if the Transposed
+// flag is set they are the columns of the data that the file holds.
+type Reader struct {
+	// The shape, flags, headers and column attributes of the file. The row attributes
+	// are given by name only; their values are returned row by row by ReadRow.
+	Cef *Cef
+
+	row    int
+	line   int // The line of the next row (for text files)
+	text   *bufio.Reader
+	ceb    *cebReader
+	cebBuf []byte
+	source *Cef // The row attribute values (for CEB) or the whole file (when reading from memory)
+
+	transposed bool // The input is stored transposed (the flag is cleared by readRows)
+
+	// The checksum recorded in the file (if any), verified when the last row has been read
+	sum      *checksum
+	expected string
+}
+
+// NewReader reads the header line, the headers and the attributes of a CEF or CEB file,
+// and prepares to read the rows
+func NewReader(f io.Reader) (*Reader, error) {
+	r, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Binary CEB files are recognized by their magic number
+	magic, err := r.Peek(4)
+	if err == nil && binary.LittleEndian.Uint32(magic) == MagicCEB {
+		cr := &cebReader{r: r}
+		cef, err := cr.readPreamble()
+		if err != nil {
+			return nil, err
+		}
+		result := &Reader{Cef: withoutRowValues(cef), ceb: cr, source: cef}
+		result.startChecksum(cef)
+		return result, nil
+	}
+
+	cef, line, err := readPreamble(r)
+	if err != nil {
+		return nil, err
+	}
+	result := &Reader{Cef: cef, text: r, line: line}
+	result.startChecksum(cef)
+	return result, nil
+}
+
+// startChecksum prepares to verify the checksum recorded in the file, if any
+func (r *Reader) startChecksum(cef *Cef) {
+	r.expected = checksumValue(cef.Headers)
+	if strings.HasPrefix(r.expected, checksumPrefix) {
+		r.sum = newChecksum(cef.Rows, cef.Columns, cef.Flags, cef.RowAttributes, cef.ColumnAttributes, false)
+	} else {
+		r.expected = ""
+	}
+}
+
+// newMemoryReader reads the rows of a Cef that is already in memory
+func newMemoryReader(cef *Cef) *Reader {
+	return &Reader{Cef: withoutRowValues(cef), source: cef}
+}
+
+// readAll reads the main matrix into memory and returns the whole file (see orient). It
+// must be called before any row has been read.
+func (r *Reader) readAll() (*Cef, error) {
+	if r.ceb != nil {
+		return r.ceb.readMatrix(r.source)
+	}
+	return readCefMatrix(r.text, r.Cef, r.line)
+}
+
+// withoutRowValues returns a shallow copy of the Cef with only the names of the row attributes
+func withoutRowValues(cef *Cef) *Cef {
+	result := *cef
+	result.Matrix = nil
+	result.Sparse = nil
+	result.mapped = nil
+	result.RowAttributes = make([]Attribute, len(cef.RowAttributes))
+	for i := 0; i < len(cef.RowAttributes); i++ {
+		result.RowAttributes[i].Name = cef.RowAttributes[i].Name
+	}
+	return &result
+}
+
+// ReadRow returns the row attribute values and the main matrix values of the next row,
+// or io.EOF when all rows have been read
+func (r *Reader) ReadRow() ([]string, []float32, error) {
+	if r.row >= r.Cef.Rows {
+		if r.expected != "" {
+			expected := r.expected
+			r.expected = ""
+			if err := checkChecksum(expected, r.sum.String()); err != nil {
+				return nil, nil, err
+			}
+		}
+		return nil, nil, io.EOF
+	}
+	attrs := make([]string, len(r.Cef.RowAttributes))
+	var values []float32
+	if r.text != nil {
+		values = make([]float32, r.Cef.Columns)
+		var err error
+		if r.line, err = readRow(r.text, r.row, r.line, attrs, values); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		for j := 0; j < len(attrs); j++ {
+			attrs[j] = r.source.RowAttributes[j].Values[r.row]
+		}
+		if r.ceb != nil {
+			var err error
+			if values, r.cebBuf, err = r.ceb.readFloats(nil, r.Cef.Columns, r.cebBuf); err != nil {
+				return nil, nil, errors.New(fmt.Sprintf("Truncated CEB file (in row %v of the main matrix)", r.row+1))
+			}
+		} else {
+			values = r.source.GetRow(r.row)
+		}
+	}
+	if r.sum != nil {
+		r.sum.writeRow(attrs, values)
+	}
+	r.row++
+	return attrs, values, nil
+}
+
+// Writer writes a CEF file (or a CEB file, if BinaryOutput is set) one row at a time. The
+// rows are written as they are to be stored (see Reader).
+type Writer struct {
+	cef  *Cef
+	f    io.Writer
+	out  io.WriteCloser
+	rows int
+
+	// Text output
+	text  *bufio.Writer
+	line  []byte
+	width int
+
+	// Rows that cannot be written until the row count is known (or, for CEB, until all
+	// row attribute values are known) are kept in a temporary file
+	spool *os.File
+
+	// Binary output
+	cebBuf []byte
+
+	// Rows kept in memory, to be written as the columns of the file at Close
+	memory *matrixBuilder
+
+	// The checksum of the rows written, if one is to be recorded (see keepChecksum)
+	sum *checksum
+}
+
+// NewWriter starts writing a file with the shape, flags, headers, column attributes and
+// row attribute names of the given template (row attribute values and the matrix are
+// ignored). If the template has a negative row count, the number of rows is not known in
+// advance and the rows are kept in a temporary file until Close.
+func NewWriter(f io.Writer, template *Cef) (*Writer, error) {
+	out, err := compress(f)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{cef: withoutRowValues(template), f: f, out: out}
+	if keepChecksum(template.Headers) {
+		w.sum = newChecksum(template.Rows, template.Columns, template.Flags, template.RowAttributes, template.ColumnAttributes, !BinaryOutput)
+	}
+	// The compressor is closed on failure, since it may have started goroutines
+	if BinaryOutput {
+		spool, err := os.CreateTemp("", "ceftools-")
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		w.spool = spool
+		w.cebBuf = make([]byte, template.Columns*4)
+		return w, nil
+	}
+
+	w.width = lineWidth(template.Columns, len(template.RowAttributes))
+	// The checksum is only known when all rows have been written, and the hash of the
+	// input (for the History step) when all of it has been read
+	if template.Rows < 0 || w.sum != nil || historyPending() {
+		spool, err := os.CreateTemp("", "ceftools-")
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		w.spool = spool
+		w.text = bufio.NewWriter(spool)
+	} else {
+		w.text = bufio.NewWriter(out)
+		if err := w.writePreamble(w.text); err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// writePreamble writes the header line, the headers, the column attributes and the row attribute names
+func (w *Writer) writePreamble(out io.Writer) error {
+	_, err := out.Write(appendPreamble(nil, withHistory(withChecksum(withPrecision(w.cef.Headers), w.checksum())), w.cef.RowAttributes, w.cef.ColumnAttributes, w.cef.Rows, w.cef.Columns, w.cef.Flags, w.width))
+	return err
+}
+
+// WriteRow writes the row attribute values and the main matrix values of the next row
+func (w *Writer) WriteRow(attrs []string, values []float32) error {
+	if len(attrs) != len(w.cef.RowAttributes) || len(values) != w.cef.Columns {
+		return errors.New(fmt.Sprintf("Row %v has the wrong number of attribute values or matrix values", w.rows+1))
+	}
+	if w.cef.Rows >= 0 && w.rows >= w.cef.Rows {
+		return errors.New(fmt.Sprintf("Too many rows written (expected %v)", w.cef.Rows))
+	}
+	w.rows++
+	if w.sum != nil {
+		w.sum.writeRow(attrs, values)
+	}
+
+	if w.memory != nil {
+		for j := 0; j < len(attrs); j++ {
+			w.cef.RowAttributes[j].Values = append(w.cef.RowAttributes[j].Values, attrs[j])
+		}
+		w.memory.appendRow(values)
+		return nil
+	}
+
+	if w.cebBuf != nil {
+		for j := 0; j < len(attrs); j++ {
+			w.cef.RowAttributes[j].Values = append(w.cef.RowAttributes[j].Values, attrs[j])
+		}
+		for j, v := range values {
+			binary.LittleEndian.PutUint32(w.cebBuf[j*4:], math.Float32bits(v))
+		}
+		_, err := w.spool.Write(w.cebBuf[:len(values)*4])
+		return err
+	}
+	w.line = appendRow(w.line[:0], attrs, values, w.width)
+	_, err := w.text.Write(w.line)
+	return err
+}
+
+// Close completes the file. It must be called after the last row has been written.
+func (w *Writer) Close() error {
+	defer w.Abort()
+	if w.cef.Rows >= 0 && w.rows != w.cef.Rows {
+		return errors.New(fmt.Sprintf("Wrong number of rows written (%v, expected %v)", w.rows, w.cef.Rows))
+	}
+	w.cef.Rows = w.rows
+	if w.sum != nil {
+		w.sum.rows = w.rows
+	}
+	if w.memory != nil {
+		w.memory.finish(w.cef)
+		w.cef.orient()
+		w.cef.ToRowMajor()
+		return Write(w.cef, w.f, false)
+	}
+
+	if err := w.finish(); err != nil {
+		w.out.Close()
+		return err
+	}
+	return w.out.Close()
+}
+
+// Abort gives up on the file, removing the temporary file (if any) without writing the
+// rows kept in it. It does nothing after Close, so it can be deferred right after NewWriter.
+func (w *Writer) Abort() {
+	if w.spool != nil {
+		w.spool.Close()
+		os.Remove(w.spool.Name())
+		w.spool = nil
+	}
+}
+
+// finish writes whatever has not yet been written to the (possibly compressed) output
+func (w *Writer) finish() error {
+	if w.cebBuf != nil {
+		cw := &cebWriter{w: bufio.NewWriter(w.out)}
+		cw.writePreamble(withHistory(withChecksum(w.cef.Headers, w.checksum())), w.cef.RowAttributes, w.cef.ColumnAttributes, w.cef.Rows, w.cef.Columns, w.cef.Flags)
+		if cw.err != nil {
+			return cw.err
+		}
+		if err := cw.w.Flush(); err != nil {
+			return err
+		}
+		return copySpool(w.spool, w.out)
+	}
+
+	if err := w.text.Flush(); err != nil {
+		return err
+	}
+	if w.spool != nil {
+		if err := w.writePreamble(w.out); err != nil {
+			return err
+		}
+		return copySpool(w.spool, w.out)
+	}
+	return nil
+}
+
+// checksum returns the checksum of the rows written, or "" if none is to be recorded
+func (w *Writer) checksum() string {
+	if w.sum == nil {
+		return ""
+	}
+	return w.sum.String()
+}
+
+func copySpool(spool *os.File, f io.Writer) error {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(f, spool)
+	return err
+}
+
+// readRows prepares the input for row-at-a-time processing, by rows or by columns of the
+// data. The rows are streamed if the file is stored that way (see the Transposed flag);
+// otherwise the whole file is read and the rows are taken from memory. Either way, the
+// Transposed flag of the Reader's Cef is cleared.
+func readRows(f io.Reader, bycol bool) (*Reader, error) {
+	r, err := NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	if (r.Cef.Flags&Transposed != 0) == bycol {
+		r.transposed = bycol
+		r.Cef.Flags &^= Transposed
+		return r, nil
+	}
+	cef, err := r.readAll()
+	if err != nil {
+		return nil, err
+	}
+	if bycol {
+		cef = cef.Transpose()
+	}
+	r = newMemoryReader(cef)
+	r.Cef.Flags &^= Transposed
+	return r, nil
+}
+
+// writeRows prepares the output for row-at-a-time processing of the input r (see readRows).
+// The output is stored like the input: when operating by columns of a file stored
+// transposed, the rows are streamed and the file is marked as transposed. Otherwise the
+// columns are kept in memory (as the input already is) and written row by row at Close.
+func writeRows(f io.Writer, template *Cef, r *Reader, bycol bool) (*Writer, error) {
+	stored := *template
+	stored.Flags &^= Transposed
+	if !bycol {
+		return NewWriter(f, &stored)
+	}
+	stored.Flags |= Transposed
+	if r.transposed {
+		return NewWriter(f, &stored)
+	}
+	w := &Writer{cef: withoutRowValues(&stored), f: f}
+	w.memory = newMatrixBuilder(stored.Rows, stored.Columns, true, false)
+	return w, nil
+}
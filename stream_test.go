@@ -0,0 +1,157 @@
+package ceftools
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// streamTestCef writes testCef one row at a time, declaring the given number of rows
+func streamTestCef(t *testing.T, rows int) []byte {
+	t.Helper()
+	cef := testCef()
+	template := *cef
+	template.Rows = rows
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, &template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Abort()
+	for i := 0; i < cef.Rows; i++ {
+		attrs := []string{cef.RowAttributes[0].Values[i], cef.RowAttributes[1].Values[i]}
+		if err := w.WriteRow(attrs, cef.GetRow(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	// The temporary files are removed when the output is complete
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	defer func() {
+		BinaryOutput = false
+		WriteChecksum = false
+		Compression = ""
+	}()
+	for _, c := range []struct {
+		name     string
+		binary   bool
+		checksum bool
+		compress string
+	}{
+		{"text", false, false, ""},
+		{"text with a checksum", false, true, ""},
+		{"binary", true, false, ""},
+		{"binary with a checksum", true, true, ""},
+		{"gzip", false, false, "gzip"},
+		{"zstd", true, true, "zstd"},
+	} {
+		BinaryOutput = c.binary
+		WriteChecksum = c.checksum
+		Compression = c.compress
+
+		// Streamed rows give the same file as the whole, whether or not the number of rows
+		// is known in advance (so that the rows have to be kept until Close)
+		var expected bytes.Buffer
+		var err error
+		if c.binary {
+			err = WriteCeb(testCef(), &expected, false)
+		} else {
+			err = Write(testCef(), &expected, false)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rows := range []int{4, -1} {
+			data := streamTestCef(t, rows)
+			if c.compress == "" && !bytes.Equal(data, expected.Bytes()) {
+				t.Errorf("%v, %v rows: wrote %q, expected %q", c.name, rows, data, expected.Bytes())
+			}
+
+			r, err := NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Cef.Rows != 4 || r.Cef.Columns != 3 || !reflect.DeepEqual(r.Cef.ColumnAttributes, testCef().ColumnAttributes) {
+				t.Errorf("%v, %v rows: read %v", c.name, rows, r.Cef)
+			}
+			result := testCef()
+			result.Matrix = make([]float32, 12)
+			result.RowAttributes[0].Values = make([]string, 4)
+			result.RowAttributes[1].Values = make([]string, 4)
+			for i := 0; ; i++ {
+				attrs, values, err := r.ReadRow()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("%v, %v rows: %v", c.name, rows, err)
+				}
+				// The checksum (if any) is verified after the last row
+				result.RowAttributes[0].Values[i] = attrs[0]
+				result.RowAttributes[1].Values[i] = attrs[1]
+				copy(result.Matrix[i*3:], values)
+			}
+			checkSameCef(t, testCef(), result)
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 0 {
+			t.Errorf("%v: temporary files %v were left", c.name, files)
+		}
+	}
+}
+
+func TestStreamWrongRows(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	cef := testCef()
+	attrs := []string{"Actb", "5"}
+	for _, rows := range []int{4, -1} {
+		template := *cef
+		template.Rows = rows
+		w, err := NewWriter(io.Discard, &template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteRow(attrs[:1], cef.GetRow(0)); err == nil {
+			t.Error("expected an error for a missing attribute value")
+		}
+		if err := w.WriteRow(attrs, cef.GetRow(0)[:2]); err == nil {
+			t.Error("expected an error for a missing matrix value")
+		}
+		for i := 0; i < 3; i++ {
+			if err := w.WriteRow(attrs, cef.GetRow(0)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if rows < 0 {
+			// Any number of rows can be written, and the temporary file is removed on Abort
+			w.Abort()
+			if files, _ := os.ReadDir(os.Getenv("TMPDIR")); len(files) != 0 {
+				t.Errorf("temporary files %v were left", files)
+			}
+			continue
+		}
+		if err := w.Close(); err == nil || err.Error() != "Wrong number of rows written (3, expected 4)" {
+			t.Errorf("got error %v for too few rows", err)
+		}
+		w, err = NewWriter(io.Discard, &template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4; i++ {
+			if err := w.WriteRow(attrs, cef.GetRow(0)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.WriteRow(attrs, cef.GetRow(0)); err == nil || err.Error() != "Too many rows written (expected 4)" {
+			t.Errorf("got error %v for too many rows", err)
+		}
+	}
+}
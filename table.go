@@ -0,0 +1,337 @@
+package ceftools
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ParseDelimiter interprets a delimiter given on the command line, which can be a single
+// character or one of the names 'tab', 'comma', 'semicolon' and 'space' (or '\t')
+func ParseDelimiter(s string) (rune, error) {
+	switch s {
+	case "tab", "\\t":
+		return '\t', nil
+	case "comma":
+		return ',', nil
+	case "semicolon":
+		return ';', nil
+	case "space":
+		return ' ', nil
+	}
+	if utf8.RuneCountInString(s) != 1 {
+		return 0, errors.New("Invalid delimiter (should be a single character, or 'tab', 'comma', 'semicolon' or 'space'): " + s)
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	if r == '"' || r == '\r' || r == '\n' {
+		return 0, errors.New("Invalid delimiter: " + s)
+	}
+	return r, nil
+}
+
+// splitFields splits a line on the delimiter. If quotes is set, fields can be enclosed in
+// double quotes (with "" standing for a literal quote), which protects any delimiters inside.
+func splitFields(line string, delimiter rune, quotes bool) ([]string, error) {
+	if !quotes {
+		return strings.Split(line, string(delimiter)), nil
+	}
+	fields := make([]string, 0)
+	field := make([]rune, 0)
+	chars := []rune(line)
+	quoted := false
+	for i := 0; i < len(chars); i++ {
+		c := chars[i]
+		switch {
+		case quoted && c == '"' && i+1 < len(chars) && chars[i+1] == '"':
+			field = append(field, c)
+			i++
+		case quoted && c == '"':
+			quoted = false
+		case quoted:
+			field = append(field, c)
+		case c == '"' && len(field) == 0:
+			quoted = true
+		case c == delimiter:
+			fields = append(fields, string(field))
+			field = field[:0]
+		default:
+			field = append(field, c)
+		}
+	}
+	if quoted {
+		return nil, errors.New("Unterminated quoted field")
+	}
+	return append(fields, string(field)), nil
+}
+
+// ReadTable reads a delimited table of values. The first colAttrs lines hold the column
+// attributes, and the first rowAttrs fields of the remaining lines hold the row attributes.
+// Each column attribute is named by the last of the leading fields of its line (as in the
+// STRT format). If names is set, the column attributes are followed by a line that names
+// the row attributes. Otherwise, and when there are no leading fields, attributes are named
+// by their position (like 'RowAttr1'). Lines starting with one of the comment prefixes, and
+// empty lines, are skipped.
+func ReadTable(f io.Reader, delimiter rune, rowAttrs int, colAttrs int, names bool, comments []string, quotes bool, transposed bool) (*Cef, error) {
+	in, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024*1024)
+
+	// Read the next line that is not empty or a comment, and count lines as we go
+	line := 0
+	next := func() ([]string, error) {
+		for scanner.Scan() {
+			line++
+			text := strings.TrimRight(scanner.Text(), "\r")
+			if text == "" {
+				continue
+			}
+			comment := false
+			for _, prefix := range comments {
+				if prefix != "" && strings.HasPrefix(text, prefix) {
+					comment = true
+				}
+			}
+			if comment {
+				continue
+			}
+			fields, err := splitFields(text, delimiter, quotes)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%v on line %v", err, line))
+			}
+			return fields, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	checkLength := func(fields []string, expected int, what string) error {
+		if len(fields) != expected {
+			return errors.New(fmt.Sprintf("Wrong number of fields on line %v (%v): found %v, expected %v", line, what, len(fields), expected))
+		}
+		return nil
+	}
+
+	cef := new(Cef)
+	cef.Headers = make([]Header, 0)
+	cef.Columns = -1
+
+	// Read the column attributes
+	cef.ColumnAttributes = make([]Attribute, colAttrs)
+	for i := 0; i < colAttrs; i++ {
+		fields, err := next()
+		if err == io.EOF {
+			return nil, errors.New(fmt.Sprintf("Unexpected end of file (expected %v column attribute lines, found %v)", colAttrs, i))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cef.Columns == -1 {
+			if len(fields) < rowAttrs {
+				return nil, errors.New(fmt.Sprintf("Too few fields on line %v (expected at least %v row attributes)", line, rowAttrs))
+			}
+			cef.Columns = len(fields) - rowAttrs
+		}
+		if err := checkLength(fields, cef.Columns+rowAttrs, fmt.Sprintf("column attribute %v", i+1)); err != nil {
+			return nil, err
+		}
+		name := fmt.Sprintf("ColumnAttr%v", i+1)
+		if rowAttrs > 0 && fields[rowAttrs-1] != "" {
+			name = fields[rowAttrs-1]
+		}
+		cef.ColumnAttributes[i] = Attribute{name, fields[rowAttrs:]}
+	}
+
+	// Name the row attributes
+	cef.RowAttributes = make([]Attribute, rowAttrs)
+	for i := 0; i < rowAttrs; i++ {
+		cef.RowAttributes[i] = Attribute{fmt.Sprintf("RowAttr%v", i+1), make([]string, 0)}
+	}
+	if names {
+		fields, err := next()
+		if err == io.EOF {
+			return nil, errors.New("Unexpected end of file (expected a line with row attribute names)")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) < rowAttrs {
+			return nil, errors.New(fmt.Sprintf("Too few fields on line %v (expected %v row attribute names)", line, rowAttrs))
+		}
+		for i := 0; i < rowAttrs; i++ {
+			cef.RowAttributes[i].Name = fields[i]
+		}
+	}
+
+	// Read the rows
+	var b *matrixBuilder
+	values := make([]float32, 0)
+	for cef.Rows = 0; ; cef.Rows++ {
+		fields, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cef.Columns == -1 {
+			if len(fields) < rowAttrs {
+				return nil, errors.New(fmt.Sprintf("Too few fields on line %v (expected at least %v row attributes)", line, rowAttrs))
+			}
+			cef.Columns = len(fields) - rowAttrs
+		}
+		if b == nil {
+			b = newMatrixBuilder(-1, cef.Columns, true, false)
+			values = make([]float32, cef.Columns)
+		}
+		if err := checkLength(fields, cef.Columns+rowAttrs, fmt.Sprintf("row %v", cef.Rows+1)); err != nil {
+			return nil, err
+		}
+		for i := 0; i < rowAttrs; i++ {
+			cef.RowAttributes[i].Values = append(cef.RowAttributes[i].Values, fields[i])
+		}
+		for j := 0; j < cef.Columns; j++ {
+			value, err := parseValue(strings.TrimSpace(fields[j+rowAttrs]))
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid float32 value on line %v (row %v, column %v): '%v'", line, cef.Rows+1, j+1, fields[j+rowAttrs]))
+			}
+			values[j] = value
+		}
+		b.appendRow(values)
+	}
+	if cef.Columns == -1 {
+		cef.Columns = 0
+	}
+	if b == nil {
+		b = newMatrixBuilder(0, cef.Columns, false, false)
+	}
+	b.finish(cef)
+
+	if transposed {
+		cef = cef.Transpose()
+	}
+	return cef, nil
+}
+
+// attributeIndexes finds the given attributes by name (all of them, if names is empty)
+func attributeIndexes(attrs []Attribute, names []string) ([]int, error) {
+	result := make([]int, 0)
+	if len(names) == 0 {
+		for i := 0; i < len(attrs); i++ {
+			result = append(result, i)
+		}
+		return result, nil
+	}
+	for _, name := range names {
+		index := -1
+		for i := 0; i < len(attrs); i++ {
+			if attrs[i].Name == name {
+				index = i
+			}
+		}
+		if index == -1 {
+			return nil, errors.New("Attribute not found: " + name)
+		}
+		result = append(result, index)
+	}
+	return result, nil
+}
+
+// WriteTable writes the rows from the reader as a plain delimited table, with a header line.
+// In wide mode, the given row attributes are followed by the main matrix, and the header line
+// gives the values of a single column attribute (the first one, if none is given). In long
+// mode, there is one line per non-zero value, giving the row attributes, the column attributes
+// and the value. If no row (or column) attributes are given, all of them are written.
+func WriteTable(r *Reader, f io.Writer, delimiter rune, attrs []string, colAttrs []string, long bool) error {
+	rowIndexes, err := attributeIndexes(r.Cef.RowAttributes, attrs)
+	if err != nil {
+		return err
+	}
+	if !long && len(colAttrs) > 1 {
+		return errors.New("Only one column attribute can be used for the header line (or use long format)")
+	}
+	if !long && len(colAttrs) == 0 && len(r.Cef.ColumnAttributes) > 0 {
+		colAttrs = []string{r.Cef.ColumnAttributes[0].Name}
+	}
+	colIndexes, err := attributeIndexes(r.Cef.ColumnAttributes, colAttrs)
+	if err != nil {
+		return err
+	}
+
+	out, err := compress(f)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(out)
+	w.Comma = delimiter
+
+	// Write the header line
+	line := make([]string, 0)
+	for _, ix := range rowIndexes {
+		line = append(line, r.Cef.RowAttributes[ix].Name)
+	}
+	if long {
+		for _, ix := range colIndexes {
+			line = append(line, r.Cef.ColumnAttributes[ix].Name)
+		}
+		line = append(line, "Value")
+	} else {
+		for j := 0; j < r.Cef.Columns; j++ {
+			if len(colIndexes) > 0 {
+				line = append(line, r.Cef.ColumnAttributes[colIndexes[0]].Values[j])
+			} else {
+				line = append(line, strconv.Itoa(j+1))
+			}
+		}
+	}
+	w.Write(line)
+
+	// Write the rows
+	for {
+		values, row, err := r.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+		line = line[:0]
+		for _, ix := range rowIndexes {
+			line = append(line, values[ix])
+		}
+		if long {
+			nAttrs := len(line)
+			for j := 0; j < len(row); j++ {
+				if row[j] == 0 || row[j] != row[j] {
+					continue // Zeros and missing values (NaN) are not written
+				}
+				line = line[:nAttrs]
+				for _, ix := range colIndexes {
+					line = append(line, r.Cef.ColumnAttributes[ix].Values[j])
+				}
+				line = append(line, string(appendValue(nil, row[j])))
+				w.Write(line)
+			}
+		} else {
+			for j := 0; j < len(row); j++ {
+				line = append(line, string(appendValue(nil, row[j])))
+			}
+			w.Write(line)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,145 @@
+package ceftools
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The feature type of 10x Genomics files that predate multi-modal data (genes.tsv with two columns)
+const tenxDefaultFeatureType = "Gene Expression"
+
+// openFirst opens the first of the given files that exists in the directory
+func openFirst(dir string, names ...string) (*os.File, error) {
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Not a 10x Genomics matrix directory (%v not found in %v)", names[0], dir))
+}
+
+// readTenxTable reads a tab-delimited table without a header line, as used for 10x features and barcodes
+func readTenxTable(f io.Reader, name string, n int) ([][]string, error) {
+	in, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(in)
+	r.Comma = '\t'
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid %v file: %v", name, err))
+	}
+	if len(records) != n {
+		return nil, errors.New(fmt.Sprintf("The %v file has %v lines, but the matrix has %v", name, len(records), n))
+	}
+	return records, nil
+}
+
+// ReadTenx reads a 10x Genomics feature-barcode matrix directory (matrix.mtx.gz, features.tsv.gz
+// and barcodes.tsv.gz, or the older uncompressed matrix.mtx, genes.tsv and barcodes.tsv).
+// Features become rows with attributes ID, Gene and FeatureType; barcodes become columns with
+// attribute CellID.
+func ReadTenx(dir string, transposed bool) (*Cef, error) {
+	// Read the main matrix
+	f, err := openFirst(dir, "matrix.mtx.gz", "matrix.mtx")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cef, err := ReadMtx(f, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the features
+	f, err = openFirst(dir, "features.tsv.gz", "features.tsv", "genes.tsv.gz", "genes.tsv")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	features, err := readTenxTable(f, "features", cef.Rows)
+	if err != nil {
+		return nil, err
+	}
+	id := Attribute{"ID", make([]string, cef.Rows)}
+	gene := Attribute{"Gene", make([]string, cef.Rows)}
+	featureType := Attribute{"FeatureType", make([]string, cef.Rows)}
+	for i, record := range features {
+		if len(record) < 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid features file (line %v should give ID and gene name)", i+1))
+		}
+		id.Values[i] = record[0]
+		gene.Values[i] = record[1]
+		featureType.Values[i] = tenxDefaultFeatureType
+		if len(record) > 2 {
+			featureType.Values[i] = record[2]
+		}
+	}
+	cef.RowAttributes = []Attribute{id, gene, featureType}
+
+	// Read the barcodes
+	f, err = openFirst(dir, "barcodes.tsv.gz", "barcodes.tsv")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	barcodes, err := readTenxTable(f, "barcodes", cef.Columns)
+	if err != nil {
+		return nil, err
+	}
+	cellID := Attribute{"CellID", make([]string, cef.Columns)}
+	for j, record := range barcodes {
+		cellID.Values[j] = record[0]
+	}
+	cef.ColumnAttributes = []Attribute{cellID}
+
+	// Record where the data came from
+	source, err := filepath.Abs(dir)
+	if err != nil {
+		source = dir
+	}
+	cef.Headers = append(cef.Headers, Header{"Source", source})
+
+	if transposed {
+		cef = cef.Transpose()
+	}
+	return cef, nil
+}
+
+// splitRows divides the rows into separate Cefs, one for each distinct value of the given
+// row attribute, in order of first appearance
+func (cef *Cef) splitRows(attr string) ([]string, []*Cef, error) {
+	index := -1
+	for i := 0; i < len(cef.RowAttributes); i++ {
+		if cef.RowAttributes[i].Name == attr {
+			index = i
+		}
+	}
+	if index == -1 {
+		return nil, nil, errors.New("Attribute not found: " + attr)
+	}
+	values := make([]string, 0)
+	orders := make(map[string][]int)
+	for i, value := range cef.RowAttributes[index].Values {
+		if _, found := orders[value]; !found {
+			values = append(values, value)
+		}
+		orders[value] = append(orders[value], i)
+	}
+	result := make([]*Cef, len(values))
+	for i, value := range values {
+		result[i] = cef.reorderRows(orders[value])
+	}
+	return values, result, nil
+}
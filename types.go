@@ -3,6 +3,7 @@ package ceftools
 import (
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"sort"
 	"strconv"
@@ -19,8 +20,9 @@ type Header struct {
 	Value string
 }
 
+// Bits of the Flags value
 const (
-	Transposed = 1 << iota
+	Transposed = 1 << iota // The main matrix is stored transposed (column by column)
 )
 
 const (
@@ -30,6 +32,15 @@ const (
 	MagicCEF     = 0x09464543
 )
 
+// The main matrix is held either in Matrix (dense, row by row) or, if it is mostly
+// zeros, in Sparse (and then Matrix is nil). Matrix can be backed by a memory-mapped
+// file (see ReadMapped). If the Transposed flag is set, Matrix and Sparse hold the
+// transpose instead (column by column), so that transposing takes constant time; use
+// Get, GetRow and GetColumn to access the values in either case.
+//
+// In a file, the Transposed flag means that the file holds the transpose of the data:
+// the counts, attributes and main matrix describe the matrix as stored, and readers
+// exchange the rows and columns.
 type Cef struct {
 	Rows             int
 	Columns          int
@@ -38,28 +49,160 @@ type Cef struct {
 	RowAttributes    []Attribute
 	ColumnAttributes []Attribute
 	Matrix           []float32
+	Sparse           *SparseMatrix
+
+	mapped     []byte
+	checksumAt int64 // The offset of the 'Checksum' header value in the mapped file, if any
 }
 
 func (cef *Cef) Get(row int, col int) float32 {
-	return cef.Matrix[col+row*cef.Columns]
+	stride := cef.Columns
+	if cef.Flags&Transposed != 0 {
+		row, col, stride = col, row, cef.Rows
+	}
+	if cef.Sparse != nil {
+		return cef.Sparse.Get(row, col)
+	}
+	return cef.Matrix[col+row*stride]
 }
 
 func (cef *Cef) Set(row int, col int, val float32) {
-	cef.Matrix[col+row*cef.Columns] = val
+	stride := cef.Columns
+	if cef.Flags&Transposed != 0 {
+		row, col, stride = col, row, cef.Rows
+	}
+	if cef.Sparse != nil {
+		cef.Sparse.Set(row, col, val)
+		return
+	}
+	cef.Matrix[col+row*stride] = val
 }
 
+// GetRow returns the values of the given row. For a dense matrix stored row by row the
+// result shares storage with the matrix; otherwise it is a copy, so changing it has no effect.
 func (cef *Cef) GetRow(row int) []float32 {
+	if cef.Flags&Transposed != 0 {
+		return cef.Transpose().GetColumn(row)
+	}
+	if cef.Sparse != nil {
+		return cef.Sparse.DenseRow(row, make([]float32, cef.Columns))
+	}
 	return cef.Matrix[row*cef.Columns : (row+1)*cef.Columns]
 }
 
+// GetColumn returns a copy of the values of the given column
+func (cef *Cef) GetColumn(col int) []float32 {
+	if cef.Flags&Transposed != 0 {
+		values := cef.Transpose().GetRow(col)
+		if cef.Sparse != nil {
+			return values
+		}
+		return append(make([]float32, 0, len(values)), values...)
+	}
+	if cef.Sparse != nil {
+		return cef.Sparse.CSC().DenseRow(col, make([]float32, cef.Rows))
+	}
+	result := make([]float32, cef.Rows)
+	for i := 0; i < cef.Rows; i++ {
+		result[i] = cef.Matrix[col+i*cef.Columns]
+	}
+	return result
+}
+
+// GetMatrix returns the main matrix in dense form (a copy, if it is stored sparse)
 func (cef *Cef) GetMatrix() *Matrix {
 	temp := new(Matrix)
 	temp.Rows = cef.Rows
 	temp.Columns = cef.Columns
 	temp.Matrix = cef.Matrix
+	if cef.Sparse != nil || cef.Flags&Transposed != 0 {
+		dense := *cef
+		dense.ToRowMajor()
+		dense.ToDense()
+		temp.Matrix = dense.Matrix
+	}
 	return temp
 }
 
+// Transpose returns a new Cef with rows and columns exchanged. The main matrix is shared,
+// and only marked as stored transposed (or not), so this takes constant time.
+func (cef *Cef) Transpose() *Cef {
+	result := *cef
+	result.mapped = nil
+	result.RowAttributes = cef.ColumnAttributes
+	result.ColumnAttributes = cef.RowAttributes
+	result.Rows = cef.Columns
+	result.Columns = cef.Rows
+	result.Flags = cef.Flags ^ Transposed
+	return &result
+}
+
+// ToRowMajor stores the main matrix row by row, physically transposing it if it is
+// stored transposed
+func (cef *Cef) ToRowMajor() {
+	if cef.Flags&Transposed == 0 {
+		return
+	}
+	if cef.Sparse != nil {
+		cef.Sparse = cef.Sparse.Transpose()
+	} else {
+		matrix := make([]float32, len(cef.Matrix))
+		for i := 0; i < cef.Rows; i++ {
+			for j := 0; j < cef.Columns; j++ {
+				matrix[i*cef.Columns+j] = cef.Matrix[j*cef.Rows+i]
+			}
+		}
+		cef.Matrix = matrix
+	}
+	cef.Flags &^= Transposed
+}
+
+// storage returns the Cef as its main matrix is stored (itself, or its transpose if the
+// matrix is stored transposed), so that its rows are the rows of the stored matrix
+func (cef *Cef) storage() *Cef {
+	if cef.Flags&Transposed != 0 {
+		return cef.Transpose()
+	}
+	return cef
+}
+
+// orient turns a Cef as read from a file (see Cef) into the data that it holds, by
+// exchanging the rows and columns if the file holds the transpose
+func (cef *Cef) orient() {
+	if cef.Flags&Transposed != 0 {
+		cef.Rows, cef.Columns = cef.Columns, cef.Rows
+		cef.RowAttributes, cef.ColumnAttributes = cef.ColumnAttributes, cef.RowAttributes
+	}
+}
+
+// reorderRows returns a new Cef with the given rows, in the given order
+func (cef *Cef) reorderRows(order []int) *Cef {
+	result := new(Cef)
+	result.Columns = cef.Columns
+	result.Rows = len(order)
+	result.Headers = cef.Headers
+	result.Flags = cef.Flags &^ Transposed
+	result.ColumnAttributes = cef.ColumnAttributes
+	result.RowAttributes = make([]Attribute, len(cef.RowAttributes))
+	for i := 0; i < len(cef.RowAttributes); i++ {
+		result.RowAttributes[i].Name = cef.RowAttributes[i].Name
+		result.RowAttributes[i].Values = make([]string, 0, len(order))
+	}
+	b := newMatrixBuilder(len(order), cef.Columns, cef.Sparse != nil, false)
+	for _, from := range order {
+		if cef.Sparse != nil {
+			b.appendSparseRow(cef.nonZeros(from))
+		} else {
+			b.appendRow(cef.GetRow(from))
+		}
+		for j := 0; j < len(cef.RowAttributes); j++ {
+			result.RowAttributes[j].Values = append(result.RowAttributes[j].Values, cef.RowAttributes[j].Values[from])
+		}
+	}
+	b.finish(result)
+	return result
+}
+
 // Support the Permutable2D interface
 func (cef *Cef) SwapRows(i, j int) {
 	// Swap entries in all the row attributes
@@ -70,6 +213,11 @@ func (cef *Cef) SwapRows(i, j int) {
 	}
 
 	// Swap rows in the main matrix
+	if cef.Sparse != nil {
+		cef.ToRowMajor()
+		cef.Sparse.SwapRows(i, j)
+		return
+	}
 	for ix := 0; ix < cef.Columns; ix++ {
 		temp := cef.Get(i, ix)
 		cef.Set(i, ix, cef.Get(j, ix))
@@ -125,36 +273,15 @@ func (cef Cef) SortByRowAttribute(attr string, reverse bool) (*Cef, error) {
 	sort.Sort(indexedStrings(recs))
 
 	// Make the resulting Cef
-	result := new(Cef)
-	result.Columns = cef.Columns
-	result.Rows = cef.Rows
-	result.Headers = cef.Headers
-	result.Flags = cef.Flags
-	result.Matrix = make([]float32, 0)
-	result.ColumnAttributes = cef.ColumnAttributes
-	result.RowAttributes = make([]Attribute, len(cef.RowAttributes))
-	for i := 0; i < len(cef.RowAttributes); i++ {
-		result.RowAttributes[i].Name = cef.RowAttributes[i].Name
-		result.RowAttributes[i].Values = make([]string, len(result.RowAttributes[i].Values))
-	}
-	if reverse {
-		for i := cef.Rows - 1; i >= 0; i-- {
-			from := recs[i].index
-			result.Matrix = append(result.Matrix, cef.GetRow(from)...)
-			for j := 0; j < len(cef.RowAttributes); j++ {
-				result.RowAttributes[j].Values = append(result.RowAttributes[j].Values, cef.RowAttributes[j].Values[from])
-			}
-		}
-	} else {
-		for i := 0; i < cef.Rows; i++ {
-			from := recs[i].index
-			result.Matrix = append(result.Matrix, cef.GetRow(from)...)
-			for j := 0; j < len(cef.RowAttributes); j++ {
-				result.RowAttributes[j].Values = append(result.RowAttributes[j].Values, cef.RowAttributes[j].Values[from])
-			}
+	order := make([]int, cef.Rows)
+	for i := 0; i < cef.Rows; i++ {
+		if reverse {
+			order[i] = recs[cef.Rows-1-i].index
+		} else {
+			order[i] = recs[i].index
 		}
 	}
-	return result, nil
+	return cef.reorderRows(order), nil
 }
 
 type numberRec struct {
@@ -163,9 +290,12 @@ type numberRec struct {
 }
 type indexedNumbers []numberRec
 
-func (a indexedNumbers) Len() int           { return len(a) }
-func (a indexedNumbers) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a indexedNumbers) Less(i, j int) bool { return a[i].value < a[j].value }
+func (a indexedNumbers) Len() int      { return len(a) }
+func (a indexedNumbers) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a indexedNumbers) Less(i, j int) bool {
+	// Missing values (NaN) sort last
+	return a[i].value < a[j].value || (a[j].value != a[j].value && a[i].value == a[i].value)
+}
 
 func (cef Cef) SortNumerical(by string, reverse bool) (*Cef, error) {
 	recs := make([]numberRec, cef.Rows)
@@ -180,7 +310,7 @@ func (cef Cef) SortNumerical(by string, reverse bool) (*Cef, error) {
 		}
 		// Make the list of values
 		for i := 0; i < cef.Rows; i++ {
-			recs[i] = numberRec{cef.Get(index-1, i), i}
+			recs[i] = numberRec{cef.Get(i, index-1), i}
 		}
 	} else {
 		temp := strings.Split(by, "=")
@@ -211,7 +341,7 @@ func (cef Cef) SortNumerical(by string, reverse bool) (*Cef, error) {
 
 			// Make the list of values
 			for i := 0; i < cef.Rows; i++ {
-				recs[i] = numberRec{cef.Get(col, i), i}
+				recs[i] = numberRec{cef.Get(i, col), i}
 			}
 		} else {
 			// Find the indexes
@@ -227,11 +357,11 @@ func (cef Cef) SortNumerical(by string, reverse bool) (*Cef, error) {
 
 			// Collect the values to be sorted
 			for i := 0; i < len(index); i++ {
-				value, err := strconv.ParseFloat(index[i], 32)
+				value, err := parseValue(index[i])
 				if err != nil {
 					return nil, err
 				}
-				recs[i] = numberRec{float32(value), i}
+				recs[i] = numberRec{value, i}
 			}
 		}
 
@@ -240,44 +370,33 @@ func (cef Cef) SortNumerical(by string, reverse bool) (*Cef, error) {
 	// Sort them
 	sort.Sort(indexedNumbers(recs))
 
-	// Make the resulting Cef
-	result := new(Cef)
-	result.Columns = cef.Columns
-	result.Rows = cef.Rows
-	result.Headers = cef.Headers
-	result.Flags = cef.Flags
-	result.Matrix = make([]float32, 0)
-	result.ColumnAttributes = cef.ColumnAttributes
-	result.RowAttributes = make([]Attribute, len(cef.RowAttributes))
-	for i := 0; i < len(cef.RowAttributes); i++ {
-		result.RowAttributes[i].Name = cef.RowAttributes[i].Name
-		result.RowAttributes[i].Values = make([]string, len(result.RowAttributes[i].Values))
-	}
-	if reverse {
-		for i := cef.Rows - 1; i >= 0; i-- {
-			from := recs[i].index
-			result.Matrix = append(result.Matrix, cef.GetRow(from)...)
-			for j := 0; j < len(cef.RowAttributes); j++ {
-				result.RowAttributes[j].Values = append(result.RowAttributes[j].Values, cef.RowAttributes[j].Values[from])
-			}
-		}
-	} else {
-		for i := 0; i < cef.Rows; i++ {
-			from := recs[i].index
-			result.Matrix = append(result.Matrix, cef.GetRow(from)...)
-			for j := 0; j < len(cef.RowAttributes); j++ {
-				result.RowAttributes[j].Values = append(result.RowAttributes[j].Values, cef.RowAttributes[j].Values[from])
-			}
+	// Make the resulting Cef (keeping missing values last when reversed)
+	n := 0
+	for n < len(recs) && recs[n].value == recs[n].value {
+		n++
+	}
+	order := make([]int, cef.Rows)
+	for i := 0; i < cef.Rows; i++ {
+		if reverse && i < n {
+			order[i] = recs[n-1-i].index
+		} else {
+			order[i] = recs[i].index
 		}
 	}
-	return result, nil
+	return cef.reorderRows(order), nil
 }
 
 // Join performs a database-style join of two Cef instances, by
 // lining up rows that have the same value for the given attributes.
-// The 'mode' parameter determines the type of join performed: left join (mode "left"),
-// right join (mode "right") or inner join (mode "inner")
+// Rows without a match are dropped (an inner join; see JoinOuter).
 func (left *Cef) Join(right *Cef, leftAttr string, rightAttr string) (*Cef, error) {
+	return left.JoinOuter(right, leftAttr, rightAttr, false, false)
+}
+
+// JoinOuter performs a join like Join, but keeps the rows without a match of the left
+// table (a left join), of the right table (a right join) or of both (an outer join), with
+// missing values (NaN) in the columns of the other table.
+func (left *Cef) JoinOuter(right *Cef, leftAttr string, rightAttr string, keepLeft bool, keepRight bool) (*Cef, error) {
 	// Find the indexes
 	var leftIndex []string
 	for i := 0; i < len(left.RowAttributes); i++ {
@@ -308,8 +427,8 @@ func (left *Cef) Join(right *Cef, leftAttr string, rightAttr string) (*Cef, erro
 	result := new(Cef)
 	result.Columns = left.Columns + right.Columns
 	result.Headers = left.Headers
-	result.Flags = left.Flags
-	result.Matrix = make([]float32, 0)
+	result.Flags = left.Flags &^ Transposed
+	b := newMatrixBuilder(-1, result.Columns, left.Sparse != nil || right.Sparse != nil, false)
 	result.ColumnAttributes = make([]Attribute, len(left.ColumnAttributes)+len(right.ColumnAttributes))
 	// Make empty column attributes
 	for i := 0; i < len(left.ColumnAttributes); i++ {
@@ -341,29 +460,102 @@ func (left *Cef) Join(right *Cef, leftAttr string, rightAttr string) (*Cef, erro
 		result.ColumnAttributes[j+len(left.ColumnAttributes)].Values = append(result.ColumnAttributes[j+len(left.ColumnAttributes)].Values, right.ColumnAttributes[j].Values...)
 	}
 
+	// Rows without a match get missing values, and take their attributes from the other
+	// table where it has an attribute of the same name
+	missing := func(n int) ([]int32, []float32) {
+		cols := make([]int32, n)
+		vals := make([]float32, n)
+		for j := 0; j < n; j++ {
+			cols[j] = int32(j)
+			vals[j] = float32(math.NaN())
+		}
+		return cols, vals
+	}
+	attrValue := func(attrs []Attribute, name string, i int) string {
+		for _, attr := range attrs {
+			if attr.Name == name {
+				return attr.Values[i]
+			}
+		}
+		return ""
+	}
+
+	// Append the given rows of the left and right tables (-1 for no match) to the result
+	sparse := left.Sparse != nil || right.Sparse != nil
+	values := func(cef *Cef, i int) ([]int32, []float32) {
+		if i < 0 {
+			return missing(cef.Columns)
+		}
+		if sparse {
+			return cef.nonZeros(i)
+		}
+		return nil, cef.GetRow(i)
+	}
+	appendRow := func(l int, r int) {
+		leftCols, leftVals := values(left, l)
+		rightCols, rightVals := values(right, r)
+		if sparse {
+			cols := append(make([]int32, 0, len(leftCols)+len(rightCols)), leftCols...)
+			for _, col := range rightCols {
+				cols = append(cols, col+int32(left.Columns))
+			}
+			vals := append(append(make([]float32, 0, len(cols)), leftVals...), rightVals...)
+			b.appendSparseRow(cols, vals)
+		} else {
+			b.appendRow(append(append(make([]float32, 0, result.Columns), leftVals...), rightVals...))
+		}
+
+		// Append to the row attributes
+		for j := 0; j < len(left.RowAttributes); j++ {
+			value := ""
+			if l >= 0 {
+				value = left.RowAttributes[j].Values[l]
+			} else {
+				value = attrValue(right.RowAttributes, left.RowAttributes[j].Name, r)
+			}
+			result.RowAttributes[j].Values = append(result.RowAttributes[j].Values, value)
+		}
+		for j := 0; j < len(right.RowAttributes); j++ {
+			value := ""
+			if r >= 0 {
+				value = right.RowAttributes[j].Values[r]
+			} else {
+				value = attrValue(left.RowAttributes, right.RowAttributes[j].Name, l)
+			}
+			result.RowAttributes[j+len(left.RowAttributes)].Values = append(result.RowAttributes[j+len(left.RowAttributes)].Values, value)
+		}
+	}
+
 	// For each row of the right table, look it up in the hash
 	Rows := 0
+	matched := make([]bool, left.Rows)
 	for i := 0; i < len(rightIndex); i++ {
 		ix := leftKeys[rightIndex[i]]
 		if ix != 0 {
 			// We have a match; append one row to the result
 			Rows++
-			leftKeys[rightIndex[i]] = 0 // Delete the key to prevent future matches (skip if doing right join?)
-			result.Matrix = append(result.Matrix, left.GetRow(ix-1)...)
-			result.Matrix = append(result.Matrix, right.GetRow(i)...)
+			leftKeys[rightIndex[i]] = 0 // Delete the key to prevent future matches
+			matched[ix-1] = true
+			appendRow(ix-1, i)
+		} else if keepRight {
+			Rows++
+			appendRow(-1, i)
+		} else {
+			fmt.Fprintf(os.Stderr, "Dropped %v\n", rightIndex[i])
+		}
+	}
 
-			// Append to the row attributes
-			for j := 0; j < len(left.RowAttributes); j++ {
-				result.RowAttributes[j].Values = append(result.RowAttributes[j].Values, left.RowAttributes[j].Values[ix-1])
-			}
-			for j := 0; j < len(right.RowAttributes); j++ {
-				result.RowAttributes[j+len(left.RowAttributes)].Values = append(result.RowAttributes[j+len(left.RowAttributes)].Values, right.RowAttributes[j].Values[i])
+	// Append the rows of the left table that had no match
+	if keepLeft {
+		for i := 0; i < left.Rows; i++ {
+			if !matched[i] {
+				Rows++
+				appendRow(i, -1)
 			}
-		} else {
-			fmt.Fprintf(os.Stderr, "Dropped %v", rightIndex[i])
 		}
 	}
 	result.Rows = Rows
+	b.finish(result)
 
 	// Merge duplicate column attributes
 	temp := make([]Attribute, 0)
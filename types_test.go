@@ -0,0 +1,50 @@
+package ceftools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJoin(t *testing.T) {
+	left := testCef()
+	right := &Cef{
+		Rows:             2,
+		Columns:          1,
+		Headers:          []Header{},
+		RowAttributes:    []Attribute{{"Gene", []string{"Xist", "Sox2"}}},
+		ColumnAttributes: []Attribute{{"CellID", []string{"c4"}}},
+		Matrix:           []float32{9, 8},
+	}
+
+	inner, err := left.Join(right, "Gene", "Gene")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner.Rows != 1 || inner.Columns != 4 || !reflect.DeepEqual(inner.GetRow(0), []float32{0.5, 0, 7, 9}) {
+		t.Errorf("inner join has %v rows, first %v", inner.Rows, inner.GetRow(0))
+	}
+
+	outer, err := left.JoinOuter(right, "Gene", "Gene", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outer.Rows != 5 {
+		t.Fatalf("outer join has %v rows, expected 5", outer.Rows)
+	}
+	// The rows follow the right table, and the unmatched rows of the left table come last,
+	// with missing values in the columns of the other table
+	if !reflect.DeepEqual(outer.GetRow(0), inner.GetRow(0)) {
+		t.Errorf("first row is %v, expected %v", outer.GetRow(0), inner.GetRow(0))
+	}
+	if v := outer.Get(1, 0); v == v || outer.Get(1, 3) != 8 {
+		t.Errorf("second row is %v, expected the unmatched row of the right table", outer.GetRow(1))
+	}
+	for i := 2; i < 5; i++ {
+		if v := outer.Get(i, 3); v == v {
+			t.Errorf("row %v is %v, expected a missing value in the right column", i, outer.GetRow(i))
+		}
+	}
+	if genes := outer.RowAttributes[0].Values; !reflect.DeepEqual(genes, []string{"Xist", "Sox2", "Actb", "Actb", "Gapdh"}) {
+		t.Errorf("genes %v", genes)
+	}
+}
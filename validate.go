@@ -0,0 +1,354 @@
+package ceftools
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Severities of the problems found by Validate
+const (
+	SeverityError   = "error"   // The file cannot be read, or would be misread
+	SeverityWarning = "warning" // Readers tolerate this, but writers must not produce it
+)
+
+// Problem is a violation of the CEF specification found by Validate. Line and field are
+// numbered from 1, and are zero when not applicable.
+type Problem struct {
+	Line     int
+	Field    int
+	Severity string
+	Message  string
+}
+
+func (p Problem) String() string {
+	if p.Field == 0 {
+		return fmt.Sprintf("line %v: %v: %v", p.Line, p.Severity, p.Message)
+	}
+	return fmt.Sprintf("line %v, field %v: %v: %v", p.Line, p.Field, p.Severity, p.Message)
+}
+
+type validator struct {
+	r        *bufio.Reader
+	report   func(Problem)
+	line     int
+	width    int
+	eof      bool
+	errors   int
+	warnings int
+}
+
+func (v *validator) problem(field int, severity string, format string, args ...interface{}) {
+	if severity == SeverityError {
+		v.errors++
+	} else {
+		v.warnings++
+	}
+	v.report(Problem{v.line, field, severity, fmt.Sprintf(format, args...)})
+}
+
+// next returns the fields of the next non-empty line, checking the line endings and the encoding
+func (v *validator) next() ([]string, bool, error) {
+	for !v.eof {
+		text, err := v.r.ReadString('\n')
+		if err == io.ErrUnexpectedEOF {
+			// A compressed file that is cut short; the partial line is not checked
+			v.eof = true
+			v.line++
+			v.problem(0, SeverityError, "Unexpected end of file (the compressed data is truncated)")
+			return nil, false, nil
+		}
+		if err == io.EOF {
+			v.eof = true
+			if text == "" {
+				return nil, false, nil
+			}
+		} else if err != nil {
+			return nil, false, err
+		}
+		v.line++
+		if v.eof {
+			v.problem(0, SeverityWarning, "Last line is not terminated by a newline")
+		}
+		text = strings.TrimSuffix(text, "\n")
+		if strings.HasSuffix(text, "\r") {
+			v.problem(0, SeverityWarning, "Line ends with a carriage return (lines should end with a single newline)")
+			text = strings.TrimRight(text, "\r")
+		}
+		if strings.Contains(text, "\r") {
+			v.problem(0, SeverityError, "Carriage return inside the line (readers take it as the end of the line)")
+		}
+		if !utf8.ValidString(text) {
+			v.problem(0, SeverityError, "Invalid UTF-8")
+		}
+		if text == "" {
+			v.problem(0, SeverityWarning, "Empty line")
+			continue
+		}
+		return strings.Split(text, "\t"), true, nil
+	}
+	return nil, false, nil
+}
+
+// checkWidth checks the number of fields on a line, of which readers consume the first n
+func (v *validator) checkWidth(fields []string, n int) {
+	for k := n; k < len(fields); k++ {
+		if fields[k] != "" {
+			v.problem(k+1, SeverityError, "Unexpected value after the last field (readers take it as the start of the next line): '%v'", fields[k])
+			break
+		}
+	}
+	if len(fields) > v.width {
+		v.problem(0, SeverityWarning, "Too many fields (found %v, expected %v)", len(fields), v.width)
+	}
+	if len(fields) < v.width {
+		v.problem(0, SeverityWarning, "Too few fields (found %v, expected %v)", len(fields), v.width)
+	}
+}
+
+// checkEscapes checks the escape sequences in fields from (inclusive) to to (exclusive),
+// which hold headers or attributes (see appendField)
+func (v *validator) checkEscapes(fields []string, from int, to int) {
+	for k := from; k < to && k < len(fields); k++ {
+		field := fields[k]
+		for i := 0; i < len(field); i++ {
+			if field[i] != '\\' {
+				continue
+			}
+			if i+1 < len(field) && unescape(field[i+1]) != 0 {
+				i++
+				continue
+			}
+			v.problem(k+1, SeverityWarning, "Backslash that does not start an escape sequence (readers keep it, but writers should write it as '\\\\'): '%v'", field)
+			break
+		}
+	}
+}
+
+// checkNames checks that attribute names are unique
+func (v *validator) checkNames(seen map[string]bool, name string, field int, what string) {
+	if seen[name] {
+		v.problem(field, SeverityWarning, "Duplicate %v attribute name '%v'", what, name)
+	}
+	seen[name] = true
+}
+
+// isDecimal checks that a value is written as required by the CEF specification
+// ([-+]?[0-9]*\.?[0-9]+([eE][-+]?[0-9]+)?)
+func isDecimal(s string) bool {
+	digits := func(s string) (string, int) {
+		n := 0
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		return s[n:], n
+	}
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		s = s[1:]
+	}
+	s, n := digits(s)
+	if s != "" && s[0] == '.' {
+		s, n = digits(s[1:])
+	}
+	if n == 0 {
+		return false
+	}
+	if s != "" && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		if s != "" && (s[0] == '-' || s[0] == '+') {
+			s = s[1:]
+		}
+		s, n = digits(s)
+		if n == 0 {
+			return false
+		}
+	}
+	return s == ""
+}
+
+// Validate checks a CEF file against the specification, and reports every problem found.
+// It returns the number of errors and warnings. Binary CEB files are checked by reading them.
+func Validate(f io.Reader, report func(Problem)) (int, int, error) {
+	r, err := decompress(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	v := &validator{r: r, report: report}
+
+	// Binary CEB files are recognized by their magic number
+	magic, err := r.Peek(4)
+	if err == nil && binary.LittleEndian.Uint32(magic) == MagicCEB {
+		if _, err := readCeb(r); err != nil {
+			v.problem(0, SeverityError, "%v", err)
+		}
+		return v.errors, v.warnings, nil
+	}
+
+	// Check the header line
+	fields, ok, err := v.next()
+	if err != nil {
+		return v.errors, v.warnings, err
+	}
+	if !ok {
+		if v.errors == 0 {
+			v.line = 1
+			v.problem(0, SeverityError, "Empty file")
+		}
+		return v.errors, v.warnings, nil
+	}
+	if strings.HasPrefix(fields[0], "\ufeff") {
+		v.problem(1, SeverityError, "File starts with a byte order mark (BOM)")
+		return v.errors, v.warnings, nil
+	}
+	if fields[0] != "CEF" {
+		v.problem(1, SeverityError, "Unknown file format (the first field should be 'CEF')")
+		return v.errors, v.warnings, nil
+	}
+	names := []string{"Header count", "Row attribute count", "Column attribute count", "Row count", "Column count", "Flags value"}
+	counts := make([]int, len(names))
+	for i := 0; i < len(names); i++ {
+		if i+1 >= len(fields) {
+			v.problem(i+2, SeverityError, "%v is missing", names[i])
+			continue
+		}
+		counts[i], err = strconv.Atoi(fields[i+1])
+		if err != nil {
+			v.problem(i+2, SeverityError, "%v is not a valid integer: '%v'", names[i], fields[i+1])
+		} else if counts[i] < 0 && i < 5 {
+			v.problem(i+2, SeverityError, "%v is negative", names[i])
+		}
+	}
+	if v.errors > 0 {
+		return v.errors, v.warnings, nil
+	}
+	nHeaders, nRowAttrs, nColumnAttrs, nRows, nColumns := counts[0], counts[1], counts[2], counts[3], counts[4]
+	if counts[5]&^Transposed != 0 {
+		v.problem(7, SeverityWarning, "Flags value has unknown bits set: %v", counts[5])
+	}
+	v.width = nColumns + nRowAttrs + 1
+	if v.width < 7 {
+		v.width = 7
+	}
+	v.checkWidth(fields, 7)
+
+	// Check the headers
+	for i := 0; i < nHeaders; i++ {
+		fields, ok, err := v.next()
+		if err != nil {
+			return v.errors, v.warnings, err
+		}
+		if !ok {
+			v.problem(0, SeverityError, "Unexpected end of file (expected %v headers, found %v)", nHeaders, i)
+			return v.errors, v.warnings, nil
+		}
+		v.checkWidth(fields, 2)
+		v.checkEscapes(fields, 0, 2)
+	}
+
+	// Check the column attributes
+	seen := make(map[string]bool)
+	for i := 0; i < nColumnAttrs; i++ {
+		fields, ok, err := v.next()
+		if err != nil {
+			return v.errors, v.warnings, err
+		}
+		if !ok {
+			v.problem(0, SeverityError, "Unexpected end of file (expected %v column attributes, found %v)", nColumnAttrs, i)
+			return v.errors, v.warnings, nil
+		}
+		v.checkWidth(fields, nRowAttrs+1+nColumns)
+		v.checkEscapes(fields, nRowAttrs, nRowAttrs+1+nColumns)
+		for k := 0; k < nRowAttrs && k < len(fields); k++ {
+			if fields[k] != "" {
+				v.problem(k+1, SeverityWarning, "Value ignored by readers (column attribute lines are offset by the row attributes): '%v'", fields[k])
+			}
+		}
+		if nRowAttrs >= len(fields) || fields[nRowAttrs] == "" {
+			v.problem(nRowAttrs+1, SeverityWarning, "Empty column attribute name")
+		} else {
+			v.checkNames(seen, fields[nRowAttrs], nRowAttrs+1, "column")
+		}
+	}
+
+	// Check the row attribute names
+	fields, ok, err = v.next()
+	if err != nil {
+		return v.errors, v.warnings, err
+	}
+	if !ok {
+		v.problem(0, SeverityError, "Unexpected end of file (expected the row attribute names)")
+		return v.errors, v.warnings, nil
+	}
+	v.checkWidth(fields, nRowAttrs)
+	v.checkEscapes(fields, 0, nRowAttrs)
+	seen = make(map[string]bool)
+	for k := 0; k < nRowAttrs; k++ {
+		if k >= len(fields) || fields[k] == "" {
+			v.problem(k+1, SeverityError, "Row attribute name cannot be empty")
+		} else {
+			v.checkNames(seen, fields[k], k+1, "row")
+		}
+	}
+
+	// Check the rows
+	for i := 0; i < nRows; i++ {
+		fields, ok, err := v.next()
+		if err != nil {
+			return v.errors, v.warnings, err
+		}
+		if !ok {
+			v.problem(0, SeverityError, "Unexpected end of file (expected %v rows, found %v)", nRows, i)
+			return v.errors, v.warnings, nil
+		}
+		if len(fields) < nRowAttrs+1+nColumns {
+			// Readers reject a short row, since it is usually the end of a file that was cut short
+			v.problem(0, SeverityError, "Too few fields in row %v of the main matrix (found %v, expected %v)", i+1, len(fields), nRowAttrs+1+nColumns)
+		} else {
+			v.checkWidth(fields, nRowAttrs+1+nColumns)
+		}
+		v.checkEscapes(fields, 0, nRowAttrs)
+		if nRowAttrs < len(fields) && fields[nRowAttrs] != "" {
+			v.problem(nRowAttrs+1, SeverityWarning, "Value ignored by readers (the field before the main matrix should be empty): '%v'", fields[nRowAttrs])
+		}
+		for j := 0; j < nColumns; j++ {
+			k := nRowAttrs + 1 + j
+			if k >= len(fields) {
+				break
+			}
+			val := fields[k]
+			if val == "" {
+				continue
+			}
+			if val == "NA" {
+				v.problem(k+1, SeverityWarning, "Missing value in column %v, row %v of the main matrix is written as 'NA' (it should be empty)", j+1, i+1)
+				continue
+			}
+			if _, err := strconv.ParseFloat(val, 32); err != nil {
+				if errors.Is(err, strconv.ErrRange) {
+					v.problem(k+1, SeverityError, "Value out of float32 range in column %v, row %v of the main matrix: '%v'", j+1, i+1, val)
+				} else {
+					v.problem(k+1, SeverityError, "Invalid float32 value in column %v, row %v of the main matrix: '%v'", j+1, i+1, val)
+				}
+				continue
+			}
+			if !isDecimal(val) {
+				v.problem(k+1, SeverityWarning, "Value in column %v, row %v of the main matrix is not in decimal notation: '%v'", j+1, i+1, val)
+			}
+		}
+	}
+
+	// Nothing should follow the last row
+	fields, ok, err = v.next()
+	if err != nil {
+		return v.errors, v.warnings, err
+	}
+	if ok {
+		v.problem(0, SeverityError, "Unexpected data after the last row (the file has more than %v rows)", nRows)
+	}
+	return v.errors, v.warnings, nil
+}
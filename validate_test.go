@@ -0,0 +1,61 @@
+package ceftools
+
+import (
+	"strings"
+	"testing"
+)
+
+func validate(t *testing.T, text string) []Problem {
+	t.Helper()
+	problems := make([]Problem, 0)
+	nErrors, nWarnings, err := Validate(strings.NewReader(text), func(p Problem) {
+		problems = append(problems, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nErrors+nWarnings != len(problems) {
+		t.Errorf("%v errors and %v warnings counted, but %v problems reported", nErrors, nWarnings, len(problems))
+	}
+	return problems
+}
+
+func TestValidate(t *testing.T) {
+	if problems := validate(t, testText); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
+
+func TestValidateTruncated(t *testing.T) {
+	// Cut short in the middle of the last row
+	problems := validate(t, testText[:len(testText)-4])
+	want := Problem{10, 0, SeverityError, "Too few fields in row 4 of the main matrix (found 5, expected 6)"}
+	found := false
+	for _, p := range problems {
+		if p == want {
+			found = true
+		} else if p.Severity == SeverityError {
+			t.Errorf("unexpected error %v", p)
+		}
+	}
+	if !found {
+		t.Errorf("expected %v, got %v", want, problems)
+	}
+
+	// Cut short at the end of a row
+	problems = validate(t, testText[:len(testText)-len("Xist\tX\t\t0.5\t0\t7\t\n")])
+	want = Problem{9, 0, SeverityError, "Unexpected end of file (expected 4 rows, found 3)"}
+	if len(problems) != 1 || problems[0] != want {
+		t.Errorf("expected %v, got %v", want, problems)
+	}
+}
+
+func TestValidateShortLines(t *testing.T) {
+	// Lines shorter than seven fields are tolerated outside the main matrix, and the
+	// main matrix rows need only as many fields as the header line declares
+	text := "CEF\t0\t1\t0\t1\t1\t0\nGene\nActb\t\t1\n"
+	problems := validate(t, text)
+	if len(problems) != 2 || problems[0].Severity != SeverityWarning || problems[1].Severity != SeverityWarning {
+		t.Errorf("expected two warnings, got %v", problems)
+	}
+}
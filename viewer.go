@@ -2,6 +2,7 @@ package ceftools
 
 import (
 	"github.com/nsf/termbox-go"
+	"io"
 	"os"
 	"strconv"
 )
@@ -11,15 +12,38 @@ var width = 0
 var height = 0
 var sortreverse = false
 
-func Viewer(bycol bool) error {
+func Viewer(in io.Reader, bycol bool) error {
 	println("Loading...")
 
 	// Read the input
-	cef, err := Read(os.Stdin, bycol)
+	cef, err := Read(in, bycol)
 	if err != nil {
 		return err
 	}
+	return View(cef)
+}
 
+// ViewFile views a file, memory-mapping the main matrix if it is an uncompressed CEB
+// file, so that only the parts shown are read
+func ViewFile(path string, bycol bool) error {
+	cef, err := ReadMapped(path, false)
+	if err != nil {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return Viewer(f, bycol)
+	}
+	defer cef.Close()
+	if bycol {
+		cef = cef.Transpose()
+	}
+	return View(cef)
+}
+
+// View shows the Cef in the terminal window
+func View(cef *Cef) error {
 	// Launch the terminal viewer
 	if err := termbox.Init(); err != nil {
 		return err
@@ -135,20 +159,7 @@ loop:
 				sortreverse = !sortreverse
 			case 't':
 				// Transpose
-				result := new(Cef)
-				result.RowAttributes = cef.ColumnAttributes
-				result.ColumnAttributes = cef.RowAttributes
-				result.Headers = cef.Headers
-				result.Rows = cef.Columns
-				result.Columns = cef.Rows
-				result.Flags = cef.Flags
-				result.Matrix = make([]float32, len(cef.Matrix))
-				for col := 0; col < result.Columns; col++ {
-					for row := 0; row < result.Rows; row++ {
-						result.Set(col, row, cef.Get(row, col))
-					}
-				}
-				cef = result
+				cef = cef.Transpose()
 				temp := offsetX
 				offsetX = offsetY
 				offsetY = temp
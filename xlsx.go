@@ -0,0 +1,323 @@
+package ceftools
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The maximum size of an Excel sheet
+const (
+	XlsxMaxRows    = 1048576
+	XlsxMaxColumns = 16384
+)
+
+// The maximum number of characters in a cell of an Excel sheet
+const xlsxMaxText = 32767
+
+// The number of distinct values listed as examples in the attribute summaries
+const xlsxExamples = 5
+
+// The fixed parts of a workbook with the sheets 'Matrix', 'Headers' and 'Attributes' (in
+// xl/worksheets/sheet1.xml to sheet3.xml), and the cell styles plain (0) and bold (1)
+var xlsxParts = [][2]string{
+	{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet2.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet3.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Matrix" sheetId="1" r:id="rId1"/><sheet name="Headers" sheetId="2" r:id="rId2"/><sheet name="Attributes" sheetId="3" r:id="rId3"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet2.xml"/>` +
+		`<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet3.xml"/>` +
+		`<Relationship Id="rId4" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`},
+	{"xl/styles.xml", `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+		`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+		`</styleSheet>`},
+}
+
+// WriteXlsx writes an Excel workbook with three sheets. The sheet 'Matrix' is laid out like a
+// CEF file, with the column attributes above the main matrix and the row attributes to its
+// left, in frozen panes so that they stay in view while scrolling. The sheet 'Headers' lists
+// the headers, and the sheet 'Attributes' summarizes each row and column attribute (the number
+// of distinct and empty values, the range of numeric attributes, and the first few values).
+// Missing values are left empty. The Matrix sheet must fit within the given number of rows
+// and columns, which cannot exceed the size of an Excel sheet.
+func WriteXlsx(cef *Cef, f io.Writer, maxRows int, maxColumns int, transposed bool) error {
+	if transposed {
+		cef = cef.Transpose()
+	}
+	if maxRows < 1 || maxRows > XlsxMaxRows {
+		return errors.New(fmt.Sprintf("The row limit must be between 1 and %v (the number of rows of an Excel sheet)", XlsxMaxRows))
+	}
+	if maxColumns < 1 || maxColumns > XlsxMaxColumns {
+		return errors.New(fmt.Sprintf("The column limit must be between 1 and %v (the number of columns of an Excel sheet)", XlsxMaxColumns))
+	}
+	nRowAttrs := len(cef.RowAttributes)
+	nColAttrs := len(cef.ColumnAttributes)
+	if rows := nColAttrs + 1 + cef.Rows; rows > maxRows {
+		return errors.New(fmt.Sprintf("Too many rows for the Excel sheet (%v, with the column attributes; the limit is %v). Select fewer rows first, e.g. using 'cef select'.", rows, maxRows))
+	}
+	if columns := nRowAttrs + 1 + cef.Columns; columns > maxColumns {
+		return errors.New(fmt.Sprintf("Too many columns for the Excel sheet (%v, with the row attributes; the limit is %v). Select fewer columns first, e.g. using 'cef --bycol select'.", columns, maxColumns))
+	}
+
+	z := zip.NewWriter(f)
+	for _, part := range xlsxParts {
+		w, err := z.Create(part[0])
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, xml.Header+part[1]); err != nil {
+			return err
+		}
+	}
+
+	// The main matrix, with the column attribute names in the column between the row
+	// attributes and the matrix, and the row attribute names on the line in between
+	s, err := newXlsxSheet(z, 1, "Matrix", nRowAttrs+1, nColAttrs+1)
+	if err != nil {
+		return err
+	}
+	for _, attr := range cef.ColumnAttributes {
+		s.row()
+		s.skip(nRowAttrs)
+		s.text(attr.Name, 1)
+		for _, val := range attr.Values {
+			s.text(val, 0)
+		}
+	}
+	s.row()
+	for _, attr := range cef.RowAttributes {
+		s.text(attr.Name, 1)
+	}
+	for i := 0; i < cef.Rows && s.err == nil; i++ {
+		s.row()
+		for _, attr := range cef.RowAttributes {
+			s.text(attr.Values[i], 0)
+		}
+		s.skip(1)
+		for _, v := range cef.GetRow(i) {
+			s.value(v)
+		}
+	}
+	if err := s.close(); err != nil {
+		return err
+	}
+
+	// The headers
+	if s, err = newXlsxSheet(z, 2, "Headers", 0, 1); err != nil {
+		return err
+	}
+	s.row()
+	s.text("Name", 1)
+	s.text("Value", 1)
+	for _, hdr := range withHistory(withChecksum(cef.Headers, "")) {
+		s.row()
+		s.text(hdr.Name, 0)
+		s.text(hdr.Value, 0)
+	}
+	if err := s.close(); err != nil {
+		return err
+	}
+
+	// The attribute summaries
+	if s, err = newXlsxSheet(z, 3, "Attributes", 1, 1); err != nil {
+		return err
+	}
+	s.row()
+	for _, name := range []string{"Attribute", "Axis", "Values", "Distinct", "Empty", "Min", "Max", "Examples"} {
+		s.text(name, 1)
+	}
+	for k, attr := range append(append([]Attribute{}, cef.RowAttributes...), cef.ColumnAttributes...) {
+		axis := "Row"
+		if k >= nRowAttrs {
+			axis = "Column"
+		}
+		distinct := make(map[string]bool)
+		examples := make([]string, 0, xlsxExamples)
+		empty := 0
+		numeric := true
+		minValue, maxValue := math.Inf(1), math.Inf(-1)
+		for _, val := range attr.Values {
+			if val == "" {
+				empty++
+				continue
+			}
+			if !distinct[val] {
+				distinct[val] = true
+				if len(examples) < xlsxExamples {
+					examples = append(examples, val)
+				}
+			}
+			if x, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil && !math.IsNaN(x) && !math.IsInf(x, 0) {
+				minValue = math.Min(minValue, x)
+				maxValue = math.Max(maxValue, x)
+			} else {
+				numeric = false
+			}
+		}
+		s.row()
+		s.text(attr.Name, 1)
+		s.text(axis, 0)
+		s.number(float64(len(attr.Values)))
+		s.number(float64(len(distinct)))
+		s.number(float64(empty))
+		if numeric && len(distinct) > 0 {
+			s.number(minValue)
+			s.number(maxValue)
+		} else {
+			s.skip(2)
+		}
+		text := strings.Join(examples, ", ")
+		if len(distinct) > len(examples) {
+			text += ", ..."
+		}
+		if utf8.RuneCountInString(text) > xlsxMaxText {
+			text = "..."
+		}
+		s.text(text, 0)
+	}
+	if err := s.close(); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// xlsxSheet writes a worksheet one cell at a time. Empty cells are left out. The first error
+// is kept, and returned by close.
+type xlsxSheet struct {
+	w    *bufio.Writer
+	name string
+	line int // The current row (from 1)
+	col  int // The next column (from 0)
+	buf  []byte
+	err  error
+}
+
+// newXlsxSheet starts a sheet, with the given number of leading columns and rows frozen
+func newXlsxSheet(z *zip.Writer, number int, name string, frozenColumns int, frozenRows int) (*xlsxSheet, error) {
+	f, err := z.Create(fmt.Sprintf("xl/worksheets/sheet%v.xml", number))
+	if err != nil {
+		return nil, err
+	}
+	s := &xlsxSheet{w: bufio.NewWriter(f), name: name}
+	s.w.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	if frozenColumns > 0 || frozenRows > 0 {
+		pane := "bottomRight"
+		split := fmt.Sprintf(` xSplit="%v" ySplit="%v"`, frozenColumns, frozenRows)
+		if frozenColumns == 0 {
+			pane, split = "bottomLeft", fmt.Sprintf(` ySplit="%v"`, frozenRows)
+		} else if frozenRows == 0 {
+			pane, split = "topRight", fmt.Sprintf(` xSplit="%v"`, frozenColumns)
+		}
+		fmt.Fprintf(s.w, `<sheetViews><sheetView workbookViewId="0"><pane%v topLeftCell="%v" activePane="%v" state="frozen"/><selection pane="%v"/></sheetView></sheetViews>`,
+			split, xlsxCell(frozenRows+1, frozenColumns), pane, pane)
+	}
+	s.w.WriteString("<sheetData>")
+	return s, nil
+}
+
+// xlsxCell returns the reference of a cell, like 'B3', given its row (from 1) and column (from 0)
+func xlsxCell(row int, col int) string {
+	name := make([]byte, 0, 4)
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = append([]byte{byte('A' + (col-1)%26)}, name...)
+	}
+	return string(name) + strconv.Itoa(row)
+}
+
+// row starts the next row
+func (s *xlsxSheet) row() {
+	if s.line > 0 {
+		s.w.WriteString("</row>")
+	}
+	s.line++
+	s.col = 0
+	fmt.Fprintf(s.w, `<row r="%v">`, s.line)
+}
+
+// skip leaves the given number of cells empty
+func (s *xlsxSheet) skip(n int) {
+	s.col += n
+}
+
+// text writes a string, in the given style (0 for plain, 1 for bold)
+func (s *xlsxSheet) text(value string, style int) {
+	if value == "" {
+		s.col++
+		return
+	}
+	if n := utf8.RuneCountInString(value); n > xlsxMaxText && s.err == nil {
+		s.err = errors.New(fmt.Sprintf("Cell %v of the Excel sheet '%v' would hold %v characters, more than the limit of %v", xlsxCell(s.line, s.col), s.name, n, xlsxMaxText))
+	}
+	fmt.Fprintf(s.w, `<c r="%v" t="inlineStr"`, xlsxCell(s.line, s.col))
+	if style != 0 {
+		fmt.Fprintf(s.w, ` s="%v"`, style)
+	}
+	s.w.WriteString(`><is><t xml:space="preserve">`)
+	xml.EscapeText(s.w, []byte(value))
+	s.w.WriteString("</t></is></c>")
+	s.col++
+}
+
+// value writes a value of the main matrix, as formatted for CEF files (see OutputPrecision).
+// Infinite values are written as text, since Excel cannot represent them.
+func (s *xlsxSheet) value(v float32) {
+	switch {
+	case v != v:
+		s.col++
+	case math.IsInf(float64(v), 0):
+		s.text(string(appendValue(nil, v)), 0)
+	default:
+		s.cell(appendValue(s.buf[:0], v))
+	}
+}
+
+// number writes a number in the shortest form that reads back the same
+func (s *xlsxSheet) number(v float64) {
+	s.cell(strconv.AppendFloat(s.buf[:0], v, 'g', -1, 64))
+}
+
+func (s *xlsxSheet) cell(number []byte) {
+	s.buf = number
+	fmt.Fprintf(s.w, `<c r="%v"><v>`, xlsxCell(s.line, s.col))
+	s.w.Write(number)
+	s.w.WriteString("</v></c>")
+	s.col++
+}
+
+// close ends the sheet
+func (s *xlsxSheet) close() error {
+	if s.line > 0 {
+		s.w.WriteString("</row>")
+	}
+	s.w.WriteString("</sheetData></worksheet>")
+	if s.err != nil {
+		return s.err
+	}
+	return s.w.Flush()
+}
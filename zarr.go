@@ -0,0 +1,570 @@
+package ceftools
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The main matrix of a Zarr store is written in chunks of at most this many rows and columns
+const (
+	zarrChunkRows    = 256
+	zarrChunkColumns = 4096
+)
+
+// The zlib compression level of the chunks written (fast, as for the other compressed output)
+const zarrLevel = 1
+
+// zarrArray is the metadata of a Zarr v2 array (the '.zarray' file)
+type zarrArray struct {
+	ZarrFormat         int         `json:"zarr_format"`
+	Shape              []int       `json:"shape"`
+	Chunks             []int       `json:"chunks"`
+	Dtype              string      `json:"dtype"`
+	Compressor         *zarrCodec  `json:"compressor"`
+	FillValue          interface{} `json:"fill_value"`
+	Order              string      `json:"order"`
+	Filters            []zarrCodec `json:"filters"`
+	DimensionSeparator string      `json:"dimension_separator,omitempty"`
+}
+
+// zarrCodec is a compressor or filter of a Zarr array
+type zarrCodec struct {
+	ID    string `json:"id"`
+	Level int    `json:"level,omitempty"`
+}
+
+// zarrGroup is the content of the '.zattrs' file at the root of the store, which keeps what
+// the arrays cannot: the headers, and the order of the attributes
+type zarrGroup struct {
+	Headers          [][2]string `json:"headers"`
+	RowAttributes    []string    `json:"row_attributes"`
+	ColumnAttributes []string    `json:"column_attributes"`
+}
+
+// WriteZarr writes a Zarr v2 directory store, which must not exist or be empty. The main
+// matrix is written as the chunked float32 array 'matrix' (rows by columns, with missing
+// values as NaN), and each row and column attribute as a string array in 'row_attrs' or
+// 'col_attrs', named by the attribute. The headers and the order of the attributes are kept
+// in the attributes ('.zattrs') of the root group. Chunks are compressed with zlib.
+func WriteZarr(cef *Cef, dir string, transposed bool) error {
+	if transposed {
+		cef = cef.Transpose()
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return errors.New(fmt.Sprintf("The directory '%v' already exists and is not empty", dir))
+	}
+	group := zarrGroup{make([][2]string, 0), make([]string, 0), make([]string, 0)}
+	for _, hdr := range withHistory(withChecksum(cef.Headers, "")) {
+		group.Headers = append(group.Headers, [2]string{hdr.Name, hdr.Value})
+	}
+	for _, attr := range cef.RowAttributes {
+		group.RowAttributes = append(group.RowAttributes, attr.Name)
+	}
+	for _, attr := range cef.ColumnAttributes {
+		group.ColumnAttributes = append(group.ColumnAttributes, attr.Name)
+	}
+	for _, name := range append(append([]string{}, group.RowAttributes...), group.ColumnAttributes...) {
+		if name == "" || name[0] == '.' || strings.ContainsAny(name, "/\\") {
+			return errors.New(fmt.Sprintf("The attribute name '%v' cannot be used as the name of a Zarr array", name))
+		}
+	}
+
+	for _, sub := range []string{"", "row_attrs", "col_attrs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0777); err != nil {
+			return err
+		}
+		if err := writeZarrJSON(filepath.Join(dir, sub, ".zgroup"), map[string]int{"zarr_format": 2}); err != nil {
+			return err
+		}
+	}
+	if err := writeZarrJSON(filepath.Join(dir, ".zattrs"), group); err != nil {
+		return err
+	}
+	for _, attr := range cef.RowAttributes {
+		if err := writeZarrStrings(filepath.Join(dir, "row_attrs", attr.Name), attr.Values); err != nil {
+			return err
+		}
+	}
+	for _, attr := range cef.ColumnAttributes {
+		if err := writeZarrStrings(filepath.Join(dir, "col_attrs", attr.Name), attr.Values); err != nil {
+			return err
+		}
+	}
+	return writeZarrMatrix(cef, filepath.Join(dir, "matrix"))
+}
+
+func writeZarrJSON(path string, v interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // Keep data types like '<f4' readable
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0666)
+}
+
+// writeZarrChunk writes a chunk of an array, compressed with zlib
+func writeZarrChunk(path string, data []byte) error {
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, zarrLevel)
+	if err != nil {
+		return err
+	}
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0666)
+}
+
+// writeZarrStrings writes a string array in a single chunk, encoded as variable-length UTF-8
+func writeZarrStrings(dir string, values []string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	meta := zarrArray{2, []int{len(values)}, []int{max(len(values), 1)}, "|O", &zarrCodec{"zlib", zarrLevel}, nil, "C", []zarrCodec{{ID: "vlen-utf8"}}, "."}
+	if err := writeZarrJSON(filepath.Join(dir, ".zarray"), meta); err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	data := binary.LittleEndian.AppendUint32(nil, uint32(len(values)))
+	for _, val := range values {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(val)))
+		data = append(data, val...)
+	}
+	return writeZarrChunk(filepath.Join(dir, "0"), data)
+}
+
+// writeZarrMatrix writes the main matrix as a chunked float32 array. Chunks at the edges are
+// padded with zeros, which are never read.
+func writeZarrMatrix(cef *Cef, dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	chunkRows := max(min(cef.Rows, zarrChunkRows), 1)
+	chunkColumns := max(min(cef.Columns, zarrChunkColumns), 1)
+	meta := zarrArray{2, []int{cef.Rows, cef.Columns}, []int{chunkRows, chunkColumns}, "<f4", &zarrCodec{"zlib", zarrLevel}, "NaN", "C", nil, "."}
+	if err := writeZarrJSON(filepath.Join(dir, ".zarray"), meta); err != nil {
+		return err
+	}
+	chunk := make([]byte, chunkRows*chunkColumns*4)
+	block := make([][]float32, 0, chunkRows)
+	for i0 := 0; i0 < cef.Rows; i0 += chunkRows {
+		block = block[:0]
+		for i := i0; i < min(i0+chunkRows, cef.Rows); i++ {
+			block = append(block, cef.GetRow(i))
+		}
+		for j0 := 0; j0 < cef.Columns; j0 += chunkColumns {
+			clear(chunk)
+			for di, row := range block {
+				for dj := 0; dj < chunkColumns && j0+dj < cef.Columns; dj++ {
+					binary.LittleEndian.PutUint32(chunk[(di*chunkColumns+dj)*4:], math.Float32bits(row[j0+dj]))
+				}
+			}
+			if err := writeZarrChunk(filepath.Join(dir, fmt.Sprintf("%v.%v", i0/chunkRows, j0/chunkColumns)), chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadZarr reads a Zarr v2 directory store in the layout written by WriteZarr. Stores written
+// by other tools (such as zarr-python) can be read as long as they have this layout: the
+// numeric array 'matrix' (of any integer or floating point type, in either order), and
+// optionally string or numeric arrays in 'row_attrs' and 'col_attrs'. Without the attribute
+// order in the root '.zattrs', the attributes are read in alphabetical order. Chunks can be
+// uncompressed or compressed with zlib, gzip, bz2 or zstd, but not with blosc (the default of
+// zarr-python).
+func ReadZarr(dir string, transposed bool) (*Cef, error) {
+	meta, err := readZarrMeta(filepath.Join(dir, "matrix"))
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Shape) != 2 {
+		return nil, errors.New(fmt.Sprintf("The Zarr array 'matrix' must have two dimensions (found %v)", len(meta.Shape)))
+	}
+	cef := new(Cef)
+	cef.Rows, cef.Columns = meta.Shape[0], meta.Shape[1]
+	cef.Headers = make([]Header, 0)
+	if cef.Matrix, err = readZarrMatrix(filepath.Join(dir, "matrix"), meta); err != nil {
+		return nil, err
+	}
+
+	// The headers and the order of the attributes, if known
+	var group zarrGroup
+	if data, err := os.ReadFile(filepath.Join(dir, ".zattrs")); err == nil {
+		if err := json.Unmarshal(data, &group); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid Zarr group attributes in %v: %v", filepath.Join(dir, ".zattrs"), err))
+		}
+	}
+	for _, hdr := range group.Headers {
+		cef.Headers = append(cef.Headers, Header{hdr[0], hdr[1]})
+	}
+	if cef.RowAttributes, err = readZarrAttributes(filepath.Join(dir, "row_attrs"), group.RowAttributes, cef.Rows); err != nil {
+		return nil, err
+	}
+	if cef.ColumnAttributes, err = readZarrAttributes(filepath.Join(dir, "col_attrs"), group.ColumnAttributes, cef.Columns); err != nil {
+		return nil, err
+	}
+
+	if SparseThreshold > 0 && cef.Density() <= SparseThreshold {
+		cef.ToSparse()
+	}
+	if transposed {
+		cef = cef.Transpose()
+	}
+	return cef, nil
+}
+
+func readZarrMeta(dir string) (*zarrArray, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ".zarray"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New(fmt.Sprintf("Not a Zarr array (%v not found)", filepath.Join(dir, ".zarray")))
+		}
+		return nil, err
+	}
+	meta := new(zarrArray)
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid Zarr array metadata in %v: %v", dir, err))
+	}
+	if meta.ZarrFormat != 2 {
+		return nil, errors.New(fmt.Sprintf("Unsupported Zarr format version %v in %v (expected 2)", meta.ZarrFormat, dir))
+	}
+	if len(meta.Chunks) != len(meta.Shape) {
+		return nil, errors.New("Invalid Zarr array metadata in " + dir + " (the chunks do not match the shape)")
+	}
+	for k := 0; k < len(meta.Shape); k++ {
+		if meta.Shape[k] < 0 || meta.Chunks[k] < 1 {
+			return nil, errors.New("Invalid Zarr array metadata in " + dir + " (invalid shape or chunks)")
+		}
+	}
+	if meta.Order != "C" && meta.Order != "F" {
+		return nil, errors.New(fmt.Sprintf("Invalid Zarr array order '%v' in %v", meta.Order, dir))
+	}
+	if meta.Compressor != nil {
+		switch meta.Compressor.ID {
+		case "zlib", "gzip", "bz2", "zstd":
+		default:
+			return nil, errors.New(fmt.Sprintf("Unsupported Zarr compressor '%v' in %v (use zlib, gzip, bz2, zstd or none)", meta.Compressor.ID, dir))
+		}
+	}
+	for _, filter := range meta.Filters {
+		if filter.ID != "vlen-utf8" || meta.Dtype != "|O" {
+			return nil, errors.New(fmt.Sprintf("Unsupported Zarr filter '%v' in %v", filter.ID, dir))
+		}
+	}
+	return meta, nil
+}
+
+// readZarrChunk reads and decompresses a chunk, given by its indexes, or returns nil if the
+// chunk was not written (so that it holds only the fill value)
+func readZarrChunk(dir string, meta *zarrArray, index []int) ([]byte, error) {
+	keys := make([]string, len(index))
+	for k, i := range index {
+		keys[k] = strconv.Itoa(i)
+	}
+	sep := meta.DimensionSeparator
+	if sep == "" {
+		sep = "."
+	}
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(strings.Join(keys, sep))))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if meta.Compressor != nil {
+		switch meta.Compressor.ID {
+		case "zlib":
+			r, err = zlib.NewReader(f)
+		case "gzip":
+			r, err = gzip.NewReader(f)
+		case "bz2":
+			r = bzip2.NewReader(f)
+		case "zstd":
+			var zr *zstd.Decoder
+			zr, err = zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+			r = zr
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid Zarr chunk %v: %v", f.Name(), err))
+		}
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid Zarr chunk %v: %v", f.Name(), err))
+	}
+	return data, nil
+}
+
+// zarrNumber returns the size of the elements of a numeric Zarr data type (like '<f4'), and
+// a function that decodes one of them
+func zarrNumber(dtype string) (int, func([]byte) float64, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if strings.HasPrefix(dtype, ">") {
+		order = binary.BigEndian
+	}
+	unsupported := errors.New(fmt.Sprintf("Unsupported Zarr data type '%v'", dtype))
+	if len(dtype) < 3 || strings.IndexByte("<>|", dtype[0]) == -1 {
+		return 0, nil, unsupported
+	}
+	size, err := strconv.Atoi(dtype[2:])
+	if err != nil {
+		return 0, nil, unsupported
+	}
+	switch dtype[1:] {
+	case "f4":
+		return size, func(b []byte) float64 { return float64(math.Float32frombits(order.Uint32(b))) }, nil
+	case "f8":
+		return size, func(b []byte) float64 { return math.Float64frombits(order.Uint64(b)) }, nil
+	case "i1":
+		return size, func(b []byte) float64 { return float64(int8(b[0])) }, nil
+	case "i2":
+		return size, func(b []byte) float64 { return float64(int16(order.Uint16(b))) }, nil
+	case "i4":
+		return size, func(b []byte) float64 { return float64(int32(order.Uint32(b))) }, nil
+	case "i8":
+		return size, func(b []byte) float64 { return float64(int64(order.Uint64(b))) }, nil
+	case "u1", "b1":
+		return size, func(b []byte) float64 { return float64(b[0]) }, nil
+	case "u2":
+		return size, func(b []byte) float64 { return float64(order.Uint16(b)) }, nil
+	case "u4":
+		return size, func(b []byte) float64 { return float64(order.Uint32(b)) }, nil
+	case "u8":
+		return size, func(b []byte) float64 { return float64(order.Uint64(b)) }, nil
+	}
+	return 0, nil, unsupported
+}
+
+// zarrFill returns the fill value of a numeric array
+func zarrFill(meta *zarrArray) float64 {
+	switch v := meta.FillValue.(type) {
+	case float64:
+		return v
+	case string:
+		switch v {
+		case "NaN":
+			return math.NaN()
+		case "Infinity":
+			return math.Inf(1)
+		case "-Infinity":
+			return math.Inf(-1)
+		}
+	case bool:
+		if v {
+			return 1
+		}
+	}
+	return 0
+}
+
+// readZarrMatrix reads a two-dimensional numeric array as float32 values, row by row
+func readZarrMatrix(dir string, meta *zarrArray) ([]float32, error) {
+	size, decode, err := zarrNumber(meta.Dtype)
+	if err != nil {
+		return nil, err
+	}
+	rows, columns := meta.Shape[0], meta.Shape[1]
+	chunkRows, chunkColumns := meta.Chunks[0], meta.Chunks[1]
+	fill := float32(zarrFill(meta))
+	matrix := make([]float32, rows*columns)
+	for i0 := 0; i0 < rows; i0 += chunkRows {
+		for j0 := 0; j0 < columns; j0 += chunkColumns {
+			data, err := readZarrChunk(dir, meta, []int{i0 / chunkRows, j0 / chunkColumns})
+			if err != nil {
+				return nil, err
+			}
+			if data != nil && len(data) != chunkRows*chunkColumns*size {
+				return nil, errors.New(fmt.Sprintf("Invalid Zarr chunk %v.%v in %v (%v bytes, expected %v)", i0/chunkRows, j0/chunkColumns, dir, len(data), chunkRows*chunkColumns*size))
+			}
+			for i := i0; i < min(i0+chunkRows, rows); i++ {
+				for j := j0; j < min(j0+chunkColumns, columns); j++ {
+					if data == nil {
+						matrix[i*columns+j] = fill
+						continue
+					}
+					k := (i-i0)*chunkColumns + (j - j0)
+					if meta.Order == "F" {
+						k = (j-j0)*chunkRows + (i - i0)
+					}
+					matrix[i*columns+j] = float32(decode(data[k*size:]))
+				}
+			}
+		}
+	}
+	return matrix, nil
+}
+
+// readZarrAttributes reads the attributes in the given group, in the given order (or else in
+// alphabetical order), each of which must have n values. A missing group has no attributes.
+func readZarrAttributes(dir string, names []string, n int) ([]Attribute, error) {
+	if len(names) == 0 {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	attrs := make([]Attribute, len(names))
+	for k, name := range names {
+		values, err := readZarrStrings(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != n {
+			return nil, errors.New(fmt.Sprintf("The Zarr array %v has %v values, but the matrix has %v", filepath.Join(dir, name), len(values), n))
+		}
+		attrs[k] = Attribute{name, values}
+	}
+	return attrs, nil
+}
+
+// readZarrStrings reads a one-dimensional array of strings (variable-length UTF-8, or fixed-
+// length bytes or UTF-32) or numbers, as strings
+func readZarrStrings(dir string) ([]string, error) {
+	meta, err := readZarrMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Shape) != 1 {
+		return nil, errors.New(fmt.Sprintf("The Zarr array %v must have one dimension (found %v)", dir, len(meta.Shape)))
+	}
+
+	// Find how to decode the elements
+	var size int
+	var decode func([]byte) string
+	kind := ""
+	if len(meta.Dtype) >= 2 {
+		kind = meta.Dtype[1:2]
+	}
+	switch {
+	case meta.Dtype == "|O":
+		if len(meta.Filters) == 0 {
+			return nil, errors.New(fmt.Sprintf("Unsupported Zarr object array %v (only vlen-utf8 strings can be read)", dir))
+		}
+	case kind == "S" || kind == "U":
+		n, err := strconv.Atoi(meta.Dtype[2:])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Unsupported Zarr data type '%v'", meta.Dtype))
+		}
+		size = n
+		decode = func(b []byte) string { return string(bytes.TrimRight(b[:n], "\x00")) }
+		if kind == "U" {
+			size = n * 4
+			var order binary.ByteOrder = binary.LittleEndian
+			if meta.Dtype[0] == '>' {
+				order = binary.BigEndian
+			}
+			decode = func(b []byte) string {
+				runes := make([]rune, 0, n)
+				for k := 0; k < n; k++ {
+					r := rune(order.Uint32(b[k*4:]))
+					if r == 0 {
+						break
+					}
+					runes = append(runes, r)
+				}
+				return string(runes)
+			}
+		}
+	default:
+		n, number, err := zarrNumber(meta.Dtype)
+		if err != nil {
+			return nil, err
+		}
+		size = n
+		bits := 64
+		if meta.Dtype[1:] == "f4" {
+			bits = 32
+		}
+		decode = func(b []byte) string {
+			if kind == "b" {
+				return strconv.FormatBool(b[0] != 0)
+			}
+			return strconv.FormatFloat(number(b), 'f', -1, bits)
+		}
+	}
+
+	values := make([]string, 0, meta.Shape[0])
+	for k := 0; len(values) < meta.Shape[0]; k++ {
+		want := min(meta.Chunks[0], meta.Shape[0]-len(values))
+		data, err := readZarrChunk(dir, meta, []int{k})
+		if err != nil {
+			return nil, err
+		}
+		var chunk []string
+		switch {
+		case data == nil:
+			chunk = make([]string, want)
+			if fill, ok := meta.FillValue.(string); ok && meta.Dtype == "|O" {
+				for i := range chunk {
+					chunk[i] = fill
+				}
+			}
+		case meta.Dtype == "|O":
+			if chunk, err = decodeVlenUTF8(data); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid Zarr chunk %v in %v: %v", k, dir, err))
+			}
+		default:
+			if len(data) != meta.Chunks[0]*size {
+				return nil, errors.New(fmt.Sprintf("Invalid Zarr chunk %v in %v (%v bytes, expected %v)", k, dir, len(data), meta.Chunks[0]*size))
+			}
+			chunk = make([]string, meta.Chunks[0])
+			for i := range chunk {
+				chunk[i] = decode(data[i*size:])
+			}
+		}
+		if len(chunk) < want {
+			return nil, errors.New(fmt.Sprintf("Invalid Zarr chunk %v in %v (%v values, expected %v)", k, dir, len(chunk), want))
+		}
+		values = append(values, chunk[:want]...)
+	}
+	return values, nil
+}
+
+// decodeVlenUTF8 decodes strings encoded as variable-length UTF-8: the number of strings, then
+// the length and bytes of each, with lengths as little-endian uint32
+func decodeVlenUTF8(data []byte) ([]string, error) {
+	if len(data) < 4 {
+		return nil, errors.New("truncated")
+	}
+	n := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	values := make([]string, 0, min(n, len(data)/4))
+	for i := 0; i < n; i++ {
+		if len(data) < 4 || uint64(len(data)-4) < uint64(binary.LittleEndian.Uint32(data)) {
+			return nil, errors.New("truncated")
+		}
+		length := int(binary.LittleEndian.Uint32(data))
+		values = append(values, string(data[4:4+length]))
+		data = data[4+length:]
+	}
+	return values, nil
+}
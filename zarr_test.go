@@ -0,0 +1,139 @@
+package ceftools
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func roundTripZarr(t *testing.T, cef *Cef, transposed bool) *Cef {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "store.zarr")
+	if err := WriteZarr(cef, dir, transposed); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ReadZarr(dir, transposed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestZarrRoundTrip(t *testing.T) {
+	cef := testCef()
+	checkSameCef(t, cef, roundTripZarr(t, cef, false))
+	checkSameCef(t, cef, roundTripZarr(t, cef, true))
+}
+
+func TestZarrRoundTripChunks(t *testing.T) {
+	// More rows than fit in a chunk, and a partial last chunk
+	cef := &Cef{Rows: zarrChunkRows + 44, Columns: 3, Headers: []Header{}}
+	cef.RowAttributes = []Attribute{{"Gene", make([]string, cef.Rows)}}
+	cef.ColumnAttributes = []Attribute{{"CellID", []string{"a", "b", "c"}}}
+	for i := 0; i < cef.Rows; i++ {
+		cef.RowAttributes[0].Values[i] = "g" + string(rune('A'+i%26))
+		for j := 0; j < cef.Columns; j++ {
+			cef.Matrix = append(cef.Matrix, float32(i*cef.Columns+j))
+		}
+	}
+	checkSameCef(t, cef, roundTripZarr(t, cef, false))
+}
+
+func TestZarrRoundTripEmpty(t *testing.T) {
+	cef := testCef()
+	cef.Rows = 0
+	cef.Matrix = []float32{}
+	for i := range cef.RowAttributes {
+		cef.RowAttributes[i].Values = []string{}
+	}
+	checkSameCef(t, cef, roundTripZarr(t, cef, false))
+}
+
+func TestWriteZarrNotEmpty(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "other"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteZarr(testCef(), dir, false); err == nil {
+		t.Error("expected an error for a directory that is not empty")
+	}
+}
+
+// TestReadZarrForeign reads a store laid out as zarr-python writes it: no group attributes,
+// an int32 matrix in Fortran order with a chunk left out (holding the fill value), fixed-length
+// UTF-32 row attributes, and gzip-compressed variable-length UTF-8 column attributes
+func TestReadZarrForeign(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A 3x2 matrix in chunks of 2x2, of which only the first is written
+	write("matrix/.zarray", []byte(`{"zarr_format": 2, "shape": [3, 2], "chunks": [2, 2], "dtype": "<i4", "compressor": null, "fill_value": 9, "order": "F", "filters": null}`))
+	chunk := make([]byte, 0)
+	for _, v := range []int32{1, 3, 2, 4} { // Column by column
+		chunk = binary.LittleEndian.AppendUint32(chunk, uint32(v))
+	}
+	write("matrix/0.0", chunk)
+
+	write("row_attrs/Gene/.zarray", []byte(`{"zarr_format": 2, "shape": [3], "chunks": [3], "dtype": "<U4", "compressor": null, "fill_value": "", "order": "C", "filters": null}`))
+	genes := make([]byte, 0)
+	for _, gene := range []string{"Actb", "Xist", "Sox"} {
+		for k := 0; k < 4; k++ {
+			r := uint32(0)
+			if k < len(gene) {
+				r = uint32(gene[k])
+			}
+			genes = binary.LittleEndian.AppendUint32(genes, r)
+		}
+	}
+	write("row_attrs/Gene/0", genes)
+
+	write("col_attrs/CellID/.zarray", []byte(`{"zarr_format": 2, "shape": [2], "chunks": [2], "dtype": "|O", "compressor": {"id": "gzip", "level": 1}, "fill_value": 0, "order": "C", "filters": [{"id": "vlen-utf8"}]}`))
+	cells := binary.LittleEndian.AppendUint32(nil, 2)
+	for _, cell := range []string{"cell_1", "cell_2"} {
+		cells = binary.LittleEndian.AppendUint32(cells, uint32(len(cell)))
+		cells = append(cells, cell...)
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(cells)
+	zw.Close()
+	write("col_attrs/CellID/0", compressed.Bytes())
+
+	cef, err := ReadZarr(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Cef{
+		Rows:             3,
+		Columns:          2,
+		Headers:          []Header{},
+		RowAttributes:    []Attribute{{"Gene", []string{"Actb", "Xist", "Sox"}}},
+		ColumnAttributes: []Attribute{{"CellID", []string{"cell_1", "cell_2"}}},
+		Matrix:           []float32{1, 2, 3, 4, 9, 9},
+	}
+	checkSameCef(t, want, cef)
+}
+
+func TestReadZarrInvalidChunk(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store.zarr")
+	if err := WriteZarr(testCef(), dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "matrix", "0.0"), []byte("not zlib"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadZarr(dir, false); err == nil {
+		t.Error("expected an error for a corrupt chunk")
+	}
+}